@@ -0,0 +1,40 @@
+package async
+
+import (
+	"context"
+	"sync"
+)
+
+type ackHooksKey struct{}
+
+// Functions to run once the request delivery is acked.
+type ackHooks struct {
+	mutex sync.Mutex
+	hooks []func()
+}
+
+// AfterAck runs fn once the request being processed with the given
+// context is acked by the broker, that is once it won't be delivered
+// again. Requests sent to the dead letter queue don't run fn, they can
+// still be inspected there. It returns false, without running fn, when
+// the context doesn't belong to a request delivery.
+func AfterAck(ctx context.Context, fn func()) bool {
+	hooks, ok := ctx.Value(ackHooksKey{}).(*ackHooks)
+	if !ok {
+		return false
+	}
+	hooks.mutex.Lock()
+	hooks.hooks = append(hooks.hooks, fn)
+	hooks.mutex.Unlock()
+	return true
+}
+
+func (h *ackHooks) run() {
+	h.mutex.Lock()
+	hooks := h.hooks
+	h.hooks = nil
+	h.mutex.Unlock()
+	for _, fn := range hooks {
+		fn()
+	}
+}
@@ -1,297 +1,385 @@
 package async
 
 import (
+	"errors"
 	"fmt"
-	"strings"
+	"strconv"
+	"sync"
 	"time"
 
-	"github.com/satori/go.uuid"
 	"github.com/streadway/amqp"
-
-	log "github.com/sirupsen/logrus"
-)
-
-var (
-	// ResponseQueueName is the queue name we'll consume the response messages from.
-	ResponseQueueName = createResponseQueueName()
-	// ServiceName is the name of our service.
-	ServiceName string
-	// We'll use only one connection, this is the one.
-	conn *amqp.Connection
-	// Signal to notify if connection fails
-	connCloseError = make(chan *amqp.Error)
 )
 
-// Create a random response queue name.
-// We'll listen to responses to the outgoing requests
-// on this queue name.
-func createResponseQueueName() string {
-	uniqid := uuid.NewV4()
-	return fmt.Sprintf("postman.resp.%s", uniqid)
+// The AMQP transport implementation.
+// We'll use only one connection. Consumers get a dedicated channel,
+// everything else uses the channels from the pool.
+type amqpTransport struct {
+	uris []string
+	// Index of the uri we'll try first on the next connection.
+	next  int
+	node  string
+	uri   string
+	conn  *amqp.Connection
+	mutex sync.RWMutex
+	pool  *channelPool
+	// Channels of the consumers that can be canceled.
+	consumers map[string]*amqp.Channel
 }
 
-// Connect starts the connection to the AMQP server.
-func Connect(uri string, service string) {
-	ServiceName = service
-	connCloseError = make(chan *amqp.Error)
-	go serverConnector(uri)
-	// Unlock the first loop in serverConnection
-	// by passing a value to the channel.
-	connCloseError <- amqp.ErrClosed
+// NewAMQPTransport creates a new transport that will connect to
+// the AMQP server on the given uris, the nodes of a cluster. The node
+// we connect to depends on the failover strategy.
+func NewAMQPTransport(uris ...string) Transport {
+	return &amqpTransport{
+		uris:      uris,
+		pool:      newChannelPool(channelPoolSize),
+		consumers: map[string]*amqp.Channel{},
+	}
 }
 
-// Try to connect to the server and gracefully
-// handle any server connection errors and retries.
-func serverConnector(uri string) {
-	var amqpErr *amqp.Error
-
-	for {
-		amqpErr = <-connCloseError
-		if amqpErr != nil {
-			log.Infof("Connecting to %s", uri)
-
-			conn = connectToServer(uri)
-			connCloseError = make(chan *amqp.Error)
-			conn.NotifyClose(connCloseError)
-
-			// Response queue
-			err := consumeReponseMessages()
-			if err != nil {
-				continue
-			}
-			// Request queue
-			err = consumeRequestMessages()
-			if err != nil {
-				continue
-			}
+// Connect to the first AMQP server available.
+func (t *amqpTransport) Connect() error {
+	if len(t.uris) == 0 {
+		return errors.New("no broker uri given")
+	}
+	start := 0
+	if failoverStrategy == FailoverRoundRobin {
+		start = t.next
+	}
+	var err error
+	for i := range t.uris {
+		index := (start + i) % len(t.uris)
+		node := getNodeName(t.uris[index])
+		conn, dialErr := amqp.DialConfig(t.uris[index], getDialConfig())
+		if dialErr != nil {
+			err = fmt.Errorf("%s: %s", node, dialErr)
+			continue
 		}
+		t.mutex.Lock()
+		t.conn = conn
+		t.node = node
+		t.uri = t.uris[index]
+		t.next = (index + 1) % len(t.uris)
+		t.mutex.Unlock()
+		t.pool.reset(func() (poolChannel, error) {
+			return openConfirmChannel(conn)
+		})
+		return nil
 	}
+	return err
 }
 
-// Connect to the AMQP server.
-func connectToServer(uri string) *amqp.Connection {
-	for {
-		con, err := amqp.Dial(uri)
-		if err == nil {
-			return con
-		}
-		log.WithFields(log.Fields{
-			"error": err,
-		}).Warnf("Connection error")
-		log.Info("Trying to reconnect to AMQP server")
-		time.Sleep(1 * time.Second)
-	}
+// Node returns the node we are connected to.
+func (t *amqpTransport) Node() string {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.node
 }
 
-// CreateNewChannel is used to create new channels.
-// This func is intended for use outside of this package, for example
-// in the proxy package, it will create one channel per http request.
-func CreateNewChannel() (*amqp.Channel, *Error) {
-	ch, err := conn.Channel()
+// The node name is the host and port, the uri may include credentials.
+func getNodeName(uri string) string {
+	parsed, err := amqp.ParseURI(uri)
 	if err != nil {
-		return nil, createError("unexpected", "Unable to create new channel", map[string]string{"trace": err.Error()})
+		return "invalid uri"
 	}
-	return ch, nil
+	return fmt.Sprintf("%s:%d", parsed.Host, parsed.Port)
 }
 
-// Declare the channel and queue we'll use for getting the response messages.
-// Notice that this queue needs to be exclusive. This unique instance will be
-// consuming from that queue. Plus, that queue will be destroyed when this
-// instance gets disconnected.
-func declareResponseChannelAndQueue() error {
-	responseChannel, err := conn.Channel()
-	if err != nil {
-		return err
+func (t *amqpTransport) NotifyClose() <-chan error {
+	closed := make(chan error, 1)
+	conn := t.getConnection()
+	if conn == nil {
+		closed <- ErrNotConnected
+		return closed
 	}
-	_, err = responseChannel.QueueDeclare(
-		ResponseQueueName, // Name
-		true,              // Durable
-		true,              // Delete when unused
-		false,             // Exclusive
-		false,             // No-wait
-		nil,               // arguments
-	)
-	return err
+	amqpErrors := conn.NotifyClose(make(chan *amqp.Error, 1))
+	go func() {
+		// The amqp library closes the channel without sending
+		// anything when the connection is closed gracefully.
+		if err, ok := <-amqpErrors; ok && err != nil {
+			closed <- err
+			return
+		}
+		closed <- nil
+	}()
+	return closed
 }
 
-// Make sure there is a request queue for the current service
-// already defined. If it already exists then we'll do nothing.
-func ensureRequestQueue() error {
-	ch, err := conn.Channel()
-	if err != nil {
+func (t *amqpTransport) DeclareQueue(name string, options QueueOptions) error {
+	err := t.withChannel(func(ch *confirmChannel) error {
+		_, err := ch.QueueDeclare(
+			name,               // Name
+			options.Durable,    // Durable
+			options.AutoDelete, // Delete when unused
+			options.Exclusive,  // Exclusive
+			false,              // No-wait
+			options.Args,       // arguments
+		)
 		return err
+	})
+	if amqpErr, ok := err.(*amqp.Error); ok && amqpErr.Code == amqp.PreconditionFailed {
+		return ErrPreconditionFailed
 	}
-	_, err = ch.QueueDeclare(
-		getRequestQueueName(), // Name
-		true,  // Durable
-		true,  // Delete when unused
-		false, // Exclusive
-		false, // No-wait
-		nil,   // arguments
-	)
 	return err
 }
 
-// Get the request queue name for the current service.
-func getRequestQueueName() string {
-	return fmt.Sprintf("postman.req.%s", ServiceName)
+// Messages are published as mandatory, the broker returns
+// them when the queue doesn't exist.
+func (t *amqpTransport) Publish(queueName string, message *Message) error {
+	return t.withChannel(func(ch *confirmChannel) error {
+		return ch.publish("", queueName, true, message)
+	})
 }
 
-// Close the connection to the AMQP server.
-func Close() {
-	if conn != nil {
-		conn.Close()
+func (t *amqpTransport) BindQueue(queueName string, exchange string) error {
+	return t.withChannel(func(ch *confirmChannel) error {
+		if err := declareFanoutExchange(ch.Channel, exchange); err != nil {
+			return err
+		}
+		return ch.QueueBind(queueName, "", exchange, false, nil)
+	})
+}
+
+// Broadcast declares the exchange before publishing, publishing
+// to an exchange that doesn't exist is a channel error in AMQP.
+func (t *amqpTransport) Broadcast(exchange string, message *Message) error {
+	return t.withChannel(func(ch *confirmChannel) error {
+		if err := declareFanoutExchange(ch.Channel, exchange); err != nil {
+			return err
+		}
+		// Routing key is ignored by fanout exchanges.
+		return ch.publish(exchange, "", false, message)
+	})
+}
+
+// The exchange gets deleted once the last queue is unbound from it.
+func declareFanoutExchange(ch *amqp.Channel, exchange string) error {
+	return ch.ExchangeDeclare(
+		exchange,
+		"fanout",
+		false, // Durable
+		true,  // Delete when unused
+		false, // Internal
+		false, // No-wait
+		nil,   // Arguments
+	)
+}
+
+func createPublishing(message *Message) amqp.Publishing {
+	expiration := ""
+	if message.Expiration > 0 {
+		// AMQP expects the expiration in milliseconds.
+		expiration = strconv.FormatInt(int64(message.Expiration/time.Millisecond), 10)
+	}
+	return amqp.Publishing{
+		ContentType:     "application/octet-stream",
+		ContentEncoding: message.ContentEncoding,
+		Headers:         amqp.Table(message.Headers),
+		Body:            message.Body,
+		DeliveryMode:    amqp.Persistent,
+		Expiration:      expiration,
 	}
 }
 
-// Consume messages on the response queue.
-func consumeReponseMessages() error {
-	err := declareResponseChannelAndQueue()
+// Consume opens a new dedicated channel for the consumer. The channel
+// will be closed when the consumer stops and all its deliveries
+// are acked, acks must go through the same channel.
+func (t *amqpTransport) Consume(queueName string, options ConsumeOptions) (<-chan *Delivery, error) {
+	ch, err := t.channel()
 	if err != nil {
-		log.WithFields(log.Fields{
-			"error": err,
-		}).Errorf("Error creating the response queue")
-		return err
+		return nil, err
 	}
-	ch, err := conn.Channel()
-	if err != nil {
-		log.WithFields(log.Fields{
-			"error": err,
-		}).Errorf("Error creating channel for response")
-		return err
+	if options.Prefetch > 0 {
+		if err := ch.Qos(options.Prefetch, 0, false); err != nil {
+			ch.Close()
+			return nil, err
+		}
 	}
-
 	msgs, err := ch.Consume(
-		ResponseQueueName, // Queue name
-		"",                // Consumer
-		true,              // Auto ack
-		true,              // Exclusive
+		queueName,         // Queue name
+		options.Consumer,  // Consumer
+		options.AutoAck,   // Auto ack
+		options.Exclusive, // Exclusive
 		false,             // No-local
 		false,             // No-wait
 		nil,               // args
 	)
 	if err != nil {
-		return err
+		ch.Close()
+		return nil, err
+	}
+	if options.Consumer != "" {
+		t.mutex.Lock()
+		t.consumers[options.Consumer] = ch
+		t.mutex.Unlock()
 	}
-	go func(ch *amqp.Channel) {
-		defer ch.Close()
+	deliveries := make(chan *Delivery)
+	go func() {
+		var unacked sync.WaitGroup
+		defer func() {
+			close(deliveries)
+			unacked.Wait()
+			ch.Close()
+		}()
 		for d := range msgs {
-			err := processMessageResponse(d.Body)
-			if err != nil {
-				log.Error(err)
+			delivery := &Delivery{
+				Message: Message{
+					Body:            d.Body,
+					Headers:         map[string]interface{}(d.Headers),
+					ContentEncoding: d.ContentEncoding,
+				},
+				Redelivered: d.Redelivered,
+			}
+			if !options.AutoAck {
+				unacked.Add(1)
+				delivery.Acknowledger = &amqpAcknowledger{delivery: d, done: unacked.Done}
 			}
+			deliveries <- delivery
 		}
-		go consumeReponseMessages()
-		log.Warn("Stopped consuming response messages")
-	}(ch)
-	return nil
+	}()
+	return deliveries, nil
 }
 
-// Consume messages on the request queue.
-// Note that this is a shared queue, a non exclusive queue.
-func consumeRequestMessages() error {
-	// Ensure there is a request queue declared.
-	err := ensureRequestQueue()
-	if err != nil {
-		log.WithFields(log.Fields{
-			"error": err,
-		}).Errorf("Error creating the request queue")
-		return err
+func (t *amqpTransport) Cancel(consumer string) error {
+	t.mutex.Lock()
+	ch, ok := t.consumers[consumer]
+	delete(t.consumers, consumer)
+	t.mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("consumer '%s' not found", consumer)
 	}
-	ch, err := conn.Channel()
-	if err != nil {
-		log.WithFields(log.Fields{
-			"error": err,
-		}).Errorf("Error creating channel for request")
+	return ch.Cancel(consumer, false)
+}
+
+func (t *amqpTransport) Consumers(queueName string) (int, error) {
+	consumers := 0
+	err := t.withChannel(func(ch *confirmChannel) error {
+		queue, err := ch.QueueInspect(queueName)
+		consumers = queue.Consumers
 		return err
+	})
+	return consumers, err
+}
+
+// Close the connection to the AMQP server.
+func (t *amqpTransport) Close() error {
+	t.pool.reset(nil)
+	conn := t.getConnection()
+	if conn == nil {
+		return nil
 	}
-	msgs, err := ch.Consume(
-		getRequestQueueName(), // Queue name
-		"",    // Consumer
-		false, // Auto ack
-		false, // Exclusive
-		false, // No-local
-		false, // No-wait
-		nil,   // args
-	)
-	if err != nil {
-		log.WithFields(log.Fields{
-			"error": err,
-		}).Fatalf("Error creating request channel")
-	}
-	go func(ch *amqp.Channel) {
-		defer ch.Close()
-		for d := range msgs {
-			if err := processMessageRequest(d.Body); err != nil {
-				log.WithFields(log.Fields{
-					"error": err,
-				}).Error("Error processing request")
-			}
-			d.Ack(false)
-		}
-		go consumeRequestMessages()
-		log.Warn("Stopped consuming request messages")
-	}(ch)
-	return nil
+	return conn.Close()
 }
 
-// Utility function to get the service name given the queue name.
-func extractServiceNameFromQueueName(queueName string) string {
-	parts := strings.Split(queueName, ".")
-	return parts[len(parts)-1]
+func (t *amqpTransport) getConnection() *amqp.Connection {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return t.conn
 }
 
-// Check if a given queue name exists on the AMQP server.
-func queueExists(ch *amqp.Channel, queueName string) bool {
-	_, err := ch.QueueInspect(queueName)
-	if err == nil {
-		return true
+// Run the operation using a channel from the pool. Channel exceptions,
+// like declaring a queue that doesn't exist, close the channel on the
+// server so we won't put it back in the pool. Neither will we put back
+// channels with a confirmation that may still be on its way.
+func (t *amqpTransport) withChannel(operation func(*confirmChannel) error) error {
+	pc, err := t.pool.get()
+	if err != nil {
+		return notConnectedError(err)
 	}
-	return false
+	err = operation(pc.poolChannel.(*confirmChannel))
+	_, broken := err.(*amqp.Error)
+	t.pool.put(pc, broken || err == ErrNotConfirmed)
+	return notConnectedError(err)
 }
 
-// Publish a new AMQP message.
-func publishMessage(ch *amqp.Channel, message []byte, queueName string) *Error {
-	err := ch.Publish(
-		"", // Exchange, we don't use exchange
-		queueName,
-		false, // Mandatory
-		false, // Immediate?
-		amqp.Publishing{
-			ContentType:  "application/octet-stream",
-			Body:         message,
-			DeliveryMode: amqp.Persistent,
-		},
-	)
-	if err == nil {
-		return nil
+// The connection may be closed before we find out and start
+// reconnecting, that is the same as not being connected.
+func notConnectedError(err error) error {
+	if err == amqp.ErrClosed {
+		return ErrNotConnected
 	}
-	return createError("unexpected", err.Error(), nil)
+	return err
 }
 
-// Utility function to create an invalid queue error message.
-func createInvalidQueueNameError(queueName string) *Error {
-	return createError(
-		"queue_not_found",
-		"The service name is invalid or there is no service instances available at the moment",
-		map[string]string{
-			"queue_name": queueName,
-		},
-	)
+// Create a new channel on the current connection.
+func (t *amqpTransport) channel() (*amqp.Channel, error) {
+	conn := t.getConnection()
+	if conn == nil {
+		return nil, ErrNotConnected
+	}
+	return conn.Channel()
+}
+
+// Publishing channels work in confirm mode, the broker acks every
+// message once it takes care of it. Mandatory messages that can't be
+// routed are returned before they get acked.
+type confirmChannel struct {
+	*amqp.Channel
+	confirms chan amqp.Confirmation
+	returns  chan amqp.Return
 }
 
-// GetServiceInstances returns the number of consumers of a given request
-// queue on the AMQP server. In other words that means the number of instances
-// available for that given service.
-func GetServiceInstances(serviceName string) int {
+func openConfirmChannel(conn *amqp.Connection) (*confirmChannel, error) {
 	ch, err := conn.Channel()
 	if err != nil {
-		return 0
+		return nil, err
 	}
-	queueName := buildRequestQueueName(serviceName)
-	queue, err := ch.QueueInspect(queueName)
+	if err := ch.Confirm(false); err != nil {
+		ch.Close()
+		return nil, err
+	}
+	return &confirmChannel{
+		Channel:  ch,
+		confirms: ch.NotifyPublish(make(chan amqp.Confirmation, 1)),
+		returns:  ch.NotifyReturn(make(chan amqp.Return, 1)),
+	}, nil
+}
+
+// Publish the message and wait for the broker to confirm it.
+// Only one message can be published at a time on each channel.
+func (ch *confirmChannel) publish(exchange string, key string, mandatory bool, message *Message) error {
+	err := ch.Publish(
+		exchange,
+		key,
+		mandatory,
+		false, // Immediate?
+		createPublishing(message),
+	)
 	if err != nil {
-		return 0
+		return err
+	}
+	select {
+	case confirmation, ok := <-ch.confirms:
+		if !ok || !confirmation.Ack {
+			return ErrNotConfirmed
+		}
+	case <-time.After(confirmTimeout):
+		return ErrNotConfirmed
 	}
-	return queue.Consumers
+	// The return, if any, is already here by the time we get the ack.
+	select {
+	case _, ok := <-ch.returns:
+		if ok {
+			return ErrUnroutable
+		}
+	default:
+	}
+	return nil
+}
+
+type amqpAcknowledger struct {
+	delivery amqp.Delivery
+	// Lets the consumer know the delivery is not pending anymore.
+	done func()
+	once sync.Once
+}
+
+func (a *amqpAcknowledger) Ack() error {
+	defer a.once.Do(a.done)
+	return a.delivery.Ack(false)
+}
+
+func (a *amqpAcknowledger) Nack(requeue bool) error {
+	defer a.once.Do(a.done)
+	return a.delivery.Nack(false, requeue)
 }
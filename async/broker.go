@@ -0,0 +1,193 @@
+package async
+
+import (
+	"fmt"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ConnectionState is the state of the connection to the broker.
+type ConnectionState string
+
+// Connection states.
+const (
+	ConnectionConnected    ConnectionState = "connected"
+	ConnectionReconnecting ConnectionState = "reconnecting"
+	ConnectionClosed       ConnectionState = "closed"
+)
+
+// What to do with the outgoing requests while the broker is down.
+const (
+	// BrokerDownFail fails the requests right away.
+	BrokerDownFail = "fail"
+	// BrokerDownBuffer holds the requests in memory and
+	// sends them once we reconnect to the broker.
+	BrokerDownBuffer = "buffer"
+)
+
+var (
+	brokerMutex     = &sync.Mutex{}
+	connectionState = ConnectionClosed
+	brokerDownMode  = BrokerDownFail
+	// Max number of requests held while the broker is down.
+	bufferSize = 0
+	buffered   = []*bufferedMessage{}
+)
+
+// A request waiting for the broker to come back.
+type bufferedMessage struct {
+	queueName string
+	requestID string
+	body      []byte
+	headers   map[string]interface{}
+	// Someone is waiting for the response to the request.
+	pending bool
+}
+
+// SetBrokerDownMode sets what to do with the outgoing requests while the
+// broker is down, either BrokerDownFail or BrokerDownBuffer. In buffer
+// mode at most size requests are held, once the buffer is full new
+// requests fail.
+func SetBrokerDownMode(mode string, size int) error {
+	if mode != BrokerDownFail && mode != BrokerDownBuffer {
+		return fmt.Errorf("invalid broker down mode '%s'", mode)
+	}
+	if size < 0 {
+		size = 0
+	}
+	brokerMutex.Lock()
+	defer brokerMutex.Unlock()
+	brokerDownMode = mode
+	bufferSize = size
+	return nil
+}
+
+// GetConnectionState returns the current state of the connection to the broker.
+func GetConnectionState() ConnectionState {
+	brokerMutex.Lock()
+	defer brokerMutex.Unlock()
+	return connectionState
+}
+
+// CountBufferedRequests returns the number of requests
+// waiting for the broker to come back.
+func CountBufferedRequests() int {
+	brokerMutex.Lock()
+	defer brokerMutex.Unlock()
+	return len(buffered)
+}
+
+func setConnectionState(state ConnectionState) {
+	brokerMutex.Lock()
+	defer brokerMutex.Unlock()
+	connectionState = state
+}
+
+// Publish an outgoing request, or buffer it while the broker is down.
+func publishRequestMessage(queueName string, requestID string, message []byte, headers map[string]interface{}, pending bool) *Error {
+	brokerMutex.Lock()
+	connected := connectionState == ConnectionConnected
+	brokerMutex.Unlock()
+	if connected {
+		err := publishMessage(message, headers, queueName)
+		if err == nil || err.Code != ErrorCodeBrokerUnavailable {
+			return err
+		}
+		// The connection is gone, we just don't know yet.
+	}
+	return bufferMessage(&bufferedMessage{
+		queueName: queueName,
+		requestID: requestID,
+		body:      message,
+		headers:   headers,
+		pending:   pending,
+	})
+}
+
+// Hold the message until we reconnect, unless we are not supposed to.
+func bufferMessage(msg *bufferedMessage) *Error {
+	brokerMutex.Lock()
+	defer brokerMutex.Unlock()
+	if brokerDownMode != BrokerDownBuffer || connectionState == ConnectionClosed {
+		return createBrokerUnavailableError()
+	}
+	if len(buffered) >= bufferSize {
+		return createError(
+			ErrorCodeBrokerUnavailable,
+			"The broker is not available and the request buffer is full",
+			nil,
+		)
+	}
+	buffered = append(buffered, msg)
+	return nil
+}
+
+// Mark the connection as established and send the buffered messages.
+// Requests that timed out or got canceled in the meantime are dropped.
+func flushBufferedMessages() {
+	brokerMutex.Lock()
+	connectionState = ConnectionConnected
+	messages := buffered
+	buffered = []*bufferedMessage{}
+	brokerMutex.Unlock()
+	if len(messages) > 0 {
+		log.WithFields(log.Fields{
+			"requests": len(messages),
+		}).Info("Sending the requests buffered while the broker was down")
+	}
+	for i, msg := range messages {
+		if msg.pending && getResponseRequest(msg.requestID) == nil {
+			continue
+		}
+		if isMessageExpired(&Message{Headers: msg.headers}) {
+			continue
+		}
+		err := publishMessage(msg.body, msg.headers, msg.queueName)
+		if err == nil {
+			continue
+		}
+		if err.Code == ErrorCodeBrokerUnavailable {
+			// Lost the connection again, keep the rest for the next time.
+			restoreBufferedMessages(messages[i:])
+			return
+		}
+		failBufferedMessage(msg, err)
+	}
+}
+
+// Put the messages back in front of the buffer.
+func restoreBufferedMessages(messages []*bufferedMessage) {
+	brokerMutex.Lock()
+	defer brokerMutex.Unlock()
+	buffered = append(messages, buffered...)
+}
+
+// Fail every buffered message, there is no broker to send them to.
+func discardBufferedMessages() {
+	brokerMutex.Lock()
+	messages := buffered
+	buffered = []*bufferedMessage{}
+	brokerMutex.Unlock()
+	for _, msg := range messages {
+		failBufferedMessage(msg, createBrokerUnavailableError())
+	}
+}
+
+// Let the caller know the request couldn't be sent.
+func failBufferedMessage(msg *bufferedMessage, err *Error) {
+	if !msg.pending {
+		log.WithFields(log.Fields{
+			"error":      err,
+			"request_id": msg.requestID,
+		}).Warn("Unable to send the buffered request")
+		return
+	}
+	if requestRecord := takeRequest(msg.requestID); requestRecord != nil {
+		requestRecord.onResponse(nil, err)
+	}
+}
+
+func createBrokerUnavailableError() *Error {
+	return createError(ErrorCodeBrokerUnavailable, "The broker is not available at the moment", nil)
+}
@@ -0,0 +1,113 @@
+package async
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rgamba/postman/async/protobuf"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnectionState(t *testing.T) {
+	_connect()
+	assert.Equal(t, ConnectionConnected, GetConnectionState())
+	_close_connection()
+	assert.Equal(t, ConnectionClosed, GetConnectionState())
+}
+
+func TestSetBrokerDownModeInvalid(t *testing.T) {
+	assert.NotNil(t, SetBrokerDownMode("retry", 10))
+}
+
+func TestBrokerDownFail(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	setConnectionState(ConnectionReconnecting)
+	errs := make(chan *Error)
+	SendRequestMessage("test-service", &protobuf.Request{ResponseQueue: ResponseQueueName}, func(resp *protobuf.Response, err *Error) {
+		errs <- err
+	})
+	err := <-errs
+	assert.NotNil(t, err)
+	assert.Equal(t, ErrorCodeBrokerUnavailable, err.Code)
+	assert.Equal(t, 0, CountPendingRequests())
+	err = SendMessageAndDiscardResponse("test-service", &protobuf.Request{})
+	assert.NotNil(t, err)
+	assert.Equal(t, ErrorCodeBrokerUnavailable, err.Code)
+}
+
+func TestBrokerDownBuffer(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	defer _resetBrokerDownMode()
+	defer func() {
+		ResponseMiddleware = nil
+	}()
+	ResponseMiddleware = func(ctx context.Context, req *protobuf.Request) (*protobuf.Response, error) {
+		return &protobuf.Response{StatusCode: 200, RequestId: req.Id}, nil
+	}
+	SetBrokerDownMode(BrokerDownBuffer, 1)
+	setConnectionState(ConnectionReconnecting)
+	responses := make(chan *protobuf.Response, 1)
+	SendRequestMessage("test-service", &protobuf.Request{ResponseQueue: ResponseQueueName}, func(resp *protobuf.Response, err *Error) {
+		assert.Nil(t, err)
+		responses <- resp
+	})
+	assert.Equal(t, 1, CountBufferedRequests())
+	// The buffer is full.
+	err := SendMessageAndDiscardResponse("test-service", &protobuf.Request{})
+	assert.NotNil(t, err)
+	assert.Equal(t, ErrorCodeBrokerUnavailable, err.Code)
+	select {
+	case <-responses:
+		t.Fatal("Request sent while the broker was down")
+	case <-time.After(50 * time.Millisecond):
+	}
+	flushBufferedMessages()
+	assert.Equal(t, ConnectionConnected, GetConnectionState())
+	assert.Equal(t, 0, CountBufferedRequests())
+	select {
+	case resp := <-responses:
+		assert.Equal(t, int32(200), resp.StatusCode)
+	case <-time.After(time.Second):
+		t.Fatal("Buffered request not sent")
+	}
+}
+
+func TestBufferedRequestsDropExpired(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	defer _resetBrokerDownMode()
+	SetBrokerDownMode(BrokerDownBuffer, 10)
+	setConnectionState(ConnectionReconnecting)
+	errs := make(chan *Error, 1)
+	deadline := time.Now().Add(10 * time.Millisecond)
+	SendRequestMessageWithDeadline("test-service", &protobuf.Request{ResponseQueue: ResponseQueueName}, deadline, func(resp *protobuf.Response, err *Error) {
+		errs <- err
+	})
+	err := <-errs
+	assert.Equal(t, ErrorCodeTimeout, err.Code)
+	flushBufferedMessages()
+	assert.Equal(t, 0, CountBufferedRequests())
+}
+
+func TestBufferedRequestsFailOnClose(t *testing.T) {
+	_connect()
+	defer _resetBrokerDownMode()
+	SetBrokerDownMode(BrokerDownBuffer, 10)
+	setConnectionState(ConnectionReconnecting)
+	errs := make(chan *Error, 1)
+	SendRequestMessage("test-service", &protobuf.Request{ResponseQueue: ResponseQueueName}, func(resp *protobuf.Response, err *Error) {
+		errs <- err
+	})
+	_close_connection()
+	err := <-errs
+	assert.NotNil(t, err)
+	assert.Equal(t, ErrorCodeBrokerUnavailable, err.Code)
+	assert.Equal(t, 0, CountBufferedRequests())
+}
+
+func _resetBrokerDownMode() {
+	SetBrokerDownMode(BrokerDownFail, 0)
+}
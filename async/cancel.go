@@ -0,0 +1,131 @@
+package async
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Control messages carry the control type on this header.
+const headerControl = "control"
+
+// Control message types.
+const controlCancel = "cancel"
+
+// How long we'll remember a request was canceled when the
+// cancel message doesn't come with the request deadline.
+const canceledRequestTTL = time.Minute
+
+var (
+	// Requests being processed by this instance at the moment.
+	inFlightRequests = map[string]context.CancelFunc{}
+	// Requests canceled before this instance got to process them,
+	// along with the time when we can forget about them.
+	canceledRequests = map[string]time.Time{}
+	cancelMutex      sync.Mutex
+)
+
+// Control messages for a service are broadcasted through
+// this exchange to all the instances of the service.
+func getControlExchangeName(serviceName string) string {
+	return fmt.Sprintf("postman.control.%s", serviceName)
+}
+
+// Let the instances of the destination service know we are not
+// waiting for the response anymore. We don't know which instance
+// got the request, if any, so all of them get the message.
+func sendCancelMessage(requestRecord *requestRecord) error {
+	if transport == nil {
+		return ErrNotConnected
+	}
+	headers := map[string]interface{}{
+		headerControl:   controlCancel,
+		headerRequestID: requestRecord.request.Id,
+		headerVersion:   int32(MessageVersion),
+	}
+	setDeadlineHeader(headers, requestRecord.deadline)
+	msg := &Message{Headers: headers}
+	setMessageExpiration(msg)
+	return transport.Broadcast(getControlExchangeName(requestRecord.serviceName), msg)
+}
+
+func processControlMessage(msg *Message) error {
+	control := getHeaderString(msg.Headers, headerControl)
+	switch control {
+	case controlCancel:
+		expires := time.Now().Add(canceledRequestTTL)
+		if deadline, ok := getMessageDeadline(msg); ok {
+			expires = deadline
+		}
+		cancelRequest(getHeaderString(msg.Headers, headerRequestID), expires)
+		return nil
+	case controlStreamAck:
+		return processStreamAck(msg)
+	}
+	return fmt.Errorf("Unknown control message '%s'", control)
+}
+
+// Abort the request if this instance is processing it. Otherwise
+// remember it was canceled in case it is still in the queue.
+func cancelRequest(requestID string, expires time.Time) {
+	cancelMutex.Lock()
+	defer cancelMutex.Unlock()
+	if cancel, ok := inFlightRequests[requestID]; ok {
+		cancel()
+		return
+	}
+	now := time.Now()
+	for id, until := range canceledRequests {
+		if now.After(until) {
+			delete(canceledRequests, id)
+		}
+	}
+	canceledRequests[requestID] = expires
+}
+
+type noDeadlineKey struct{}
+
+// Register the request as in flight. The returned context is done once the
+// request gets canceled or the deadline is reached, a zero deadline means
+// no deadline at all. The done function must be called once we are done
+// processing the request. It returns false if the request was already canceled.
+func startRequest(requestID string, deadline time.Time) (context.Context, func(), bool) {
+	cancelMutex.Lock()
+	defer cancelMutex.Unlock()
+	if _, ok := canceledRequests[requestID]; ok {
+		delete(canceledRequests, requestID)
+		return nil, nil, false
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	// The context without the deadline is kept for the streamed responses.
+	ctx = context.WithValue(ctx, noDeadlineKey{}, ctx)
+	stop := cancel
+	if !deadline.IsZero() {
+		var cancelDeadline context.CancelFunc
+		ctx, cancelDeadline = context.WithDeadline(ctx, deadline)
+		stop = func() {
+			cancelDeadline()
+			cancel()
+		}
+	}
+	inFlightRequests[requestID] = cancel
+	done := func() {
+		cancelMutex.Lock()
+		delete(inFlightRequests, requestID)
+		cancelMutex.Unlock()
+		stop()
+	}
+	return ctx, done, true
+}
+
+// WithoutDeadline returns the context of the request being processed
+// without the request deadline, it's still done once the request gets
+// canceled or we are done processing it. Once the response head is sent,
+// the rest of a streamed response is not bound to the deadline.
+func WithoutDeadline(ctx context.Context) context.Context {
+	if noDeadline, ok := ctx.Value(noDeadlineKey{}).(context.Context); ok {
+		return noDeadline
+	}
+	return ctx
+}
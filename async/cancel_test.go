@@ -0,0 +1,80 @@
+package async
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rgamba/postman/async/protobuf"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCancelInFlightRequest(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	defer func() {
+		ResponseMiddleware = nil
+	}()
+	started := make(chan bool)
+	canceled := make(chan error)
+	ResponseMiddleware = func(ctx context.Context, req *protobuf.Request) (*protobuf.Response, error) {
+		started <- true
+		<-ctx.Done()
+		canceled <- ctx.Err()
+		return nil, ctx.Err()
+	}
+	req := &protobuf.Request{Method: "GET", ResponseQueue: ResponseQueueName}
+	SendRequestMessageWithDeadline("test-service", req, time.Now().Add(5*time.Second), func(resp *protobuf.Response, err *Error) {
+		t.Error("Canceled request callback was called")
+	})
+	<-started
+	assert.True(t, CancelRequest(req.Id))
+	assert.Equal(t, context.Canceled, <-canceled)
+}
+
+func TestSkipCanceledRequest(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	defer func() {
+		ResponseMiddleware = nil
+	}()
+	called := false
+	ResponseMiddleware = func(ctx context.Context, req *protobuf.Request) (*protobuf.Response, error) {
+		called = true
+		return &protobuf.Response{StatusCode: 200, RequestId: req.Id}, nil
+	}
+	processControlMessage(&Message{Headers: map[string]interface{}{
+		headerControl:   controlCancel,
+		headerRequestID: "queued",
+	}})
+	req := &protobuf.Request{Id: "queued", Method: "GET"}
+	body, _ := encodeRequest(req, MessageVersion)
+	assert.Nil(t, processMessageRequest(&Message{Body: body, Headers: createRequestHeaders(req, MessageVersion)}))
+	assert.False(t, called)
+	// The request is only skipped once.
+	assert.Nil(t, processMessageRequest(&Message{Body: body, Headers: createRequestHeaders(req, MessageVersion)}))
+	assert.True(t, called)
+}
+
+func TestCanceledRequestsExpire(t *testing.T) {
+	cancelRequest("expired", time.Now().Add(-time.Second))
+	cancelRequest("not-expired", time.Now().Add(time.Minute))
+	defer removeCanceledRequest("not-expired")
+	cancelMutex.Lock()
+	defer cancelMutex.Unlock()
+	_, ok := canceledRequests["expired"]
+	assert.False(t, ok)
+	_, ok = canceledRequests["not-expired"]
+	assert.True(t, ok)
+}
+
+func TestUnknownControlMessage(t *testing.T) {
+	err := processControlMessage(&Message{Headers: map[string]interface{}{headerControl: "unknown"}})
+	assert.NotNil(t, err)
+}
+
+func removeCanceledRequest(requestID string) {
+	cancelMutex.Lock()
+	delete(canceledRequests, requestID)
+	cancelMutex.Unlock()
+}
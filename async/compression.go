@@ -0,0 +1,214 @@
+package async
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/rgamba/postman/stats"
+)
+
+// Headers used to negotiate the compression of the message body.
+const (
+	// Encoding of the message body, no header means no compression. It is
+	// sent as the content encoding of the message, older instances only
+	// send it as a header.
+	headerContentEncoding = "content_encoding"
+	// Comma separated encodings the sender is able to decode.
+	headerAcceptEncoding = "accept_encoding"
+)
+
+// EncodingGzip compresses the message body with gzip.
+const EncodingGzip = "gzip"
+
+// A way to compress and decompress the message body.
+type codec struct {
+	compress   func([]byte) ([]byte, error)
+	decompress func([]byte) ([]byte, error)
+}
+
+// Every instance is able to decode all of these, whatever the
+// compression it uses to send its own messages.
+var codecs = map[string]codec{
+	EncodingGzip: {compress: gzipCompress, decompress: gzipDecompress},
+}
+
+// Compression used for the outgoing messages, empty when disabled,
+// and the size of the encoded message from which it is used.
+var compression string
+var compressionThreshold int
+
+// Max size of a decompressed message body, bigger bodies are rejected.
+var maxBodySize = 128 * 1024 * 1024
+
+// ErrBodyTooBig is returned when the message body is bigger than
+// the max body size once decompressed.
+var ErrBodyTooBig = errors.New("The decompressed message body is too big")
+
+// We'll keep track of the encodings each service is able to decode.
+// Until we know, we won't compress the requests sent to the service.
+var peerEncodings = map[string]string{}
+var peerEncodingsMutex sync.RWMutex
+
+// SetCompression sets the encoding used to compress the messages bigger
+// than the threshold, in bytes. Messages are only compressed for peers
+// that are able to decode them. An empty encoding disables compression.
+func SetCompression(encoding string, threshold int) error {
+	if _, ok := codecs[encoding]; encoding != "" && !ok {
+		return fmt.Errorf("Unsupported compression '%s', the supported ones are: %s", encoding, getAcceptedEncodings())
+	}
+	if threshold < 0 {
+		threshold = 0
+	}
+	compression = encoding
+	compressionThreshold = threshold
+	return nil
+}
+
+// The encodings we are able to decode, sorted and comma separated.
+func getAcceptedEncodings() string {
+	encodings := []string{}
+	for encoding := range codecs {
+		encodings = append(encodings, encoding)
+	}
+	sort.Strings(encodings)
+	return strings.Join(encodings, ",")
+}
+
+// Get the encodings the service is able to decode.
+func getPeerEncodings(serviceName string) string {
+	peerEncodingsMutex.RLock()
+	defer peerEncodingsMutex.RUnlock()
+	return peerEncodings[serviceName]
+}
+
+func setPeerEncodings(serviceName string, encodings string) {
+	peerEncodingsMutex.Lock()
+	peerEncodings[serviceName] = encodings
+	peerEncodingsMutex.Unlock()
+}
+
+// Responders let us know the encodings they are able to decode. Responders
+// that fail to decode a message may not understand compression at all,
+// so we stop compressing the requests sent to that service.
+func updatePeerEncodings(requestID string, msg *Message) {
+	requestRecord := getResponseRequest(requestID)
+	if requestRecord == nil {
+		return
+	}
+	if getHeaderString(msg.Headers, headerError) == ErrorCodeInvalidFormat {
+		setPeerEncodings(requestRecord.serviceName, "")
+		return
+	}
+	setPeerEncodings(requestRecord.serviceName, getHeaderString(msg.Headers, headerAcceptEncoding))
+}
+
+func isAcceptedEncoding(accepted string, encoding string) bool {
+	for _, value := range strings.Split(accepted, ",") {
+		if strings.TrimSpace(value) == encoding {
+			return true
+		}
+	}
+	return false
+}
+
+// Compress the encoded message if it is big enough and the peer accepts
+// the encoding, the content encoding header is set in that case.
+// The message is sent as is if compression doesn't make it smaller.
+func compressMessage(message []byte, headers map[string]interface{}, accepted string) []byte {
+	encoding := compression
+	if encoding == "" || len(message) < compressionThreshold || !isAcceptedEncoding(accepted, encoding) {
+		return message
+	}
+	compressed, err := codecs[encoding].compress(message)
+	if err != nil || len(compressed) >= len(message) {
+		return message
+	}
+	go stats.RecordCompression(len(message), len(compressed))
+	headers[headerContentEncoding] = encoding
+	return compressed
+}
+
+// The content encoding set by compressMessage goes in the message property
+// instead of the headers. The headers are copied, buffered messages are
+// published again with the same headers.
+func moveContentEncoding(msg *Message) {
+	encoding := getHeaderString(msg.Headers, headerContentEncoding)
+	if encoding == "" {
+		return
+	}
+	headers := map[string]interface{}{}
+	for name, value := range msg.Headers {
+		if name != headerContentEncoding {
+			headers[name] = value
+		}
+	}
+	msg.Headers = headers
+	msg.ContentEncoding = encoding
+}
+
+// SetMaxBodySize sets the max size, in bytes, of a message body once
+// decompressed. A few bytes can decompress to a huge body otherwise.
+func SetMaxBodySize(size int) {
+	if size > 0 {
+		maxBodySize = size
+	}
+}
+
+// Decompress the message body in place, if it is compressed,
+// and remove the content encoding.
+func decompressMessage(msg *Message) error {
+	encoding := msg.ContentEncoding
+	if encoding == "" {
+		encoding = getHeaderString(msg.Headers, headerContentEncoding)
+	}
+	if encoding == "" {
+		return nil
+	}
+	c, ok := codecs[encoding]
+	if !ok {
+		return fmt.Errorf("Unsupported content encoding '%s'", encoding)
+	}
+	body, err := c.decompress(msg.Body)
+	if err != nil {
+		return err
+	}
+	msg.Body = body
+	msg.ContentEncoding = ""
+	delete(msg.Headers, headerContentEncoding)
+	return nil
+}
+
+func gzipCompress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	if _, err := w.Write(data); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func gzipDecompress(data []byte) ([]byte, error) {
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(r, int64(maxBodySize)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > maxBodySize {
+		return nil, ErrBodyTooBig
+	}
+	return body, nil
+}
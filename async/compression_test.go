@@ -0,0 +1,135 @@
+package async
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/rgamba/postman/async/protobuf"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSetCompression(t *testing.T) {
+	defer SetCompression("", 0)
+	assert.NotNil(t, SetCompression("zstd", 0))
+	assert.Nil(t, SetCompression(EncodingGzip, -1))
+	assert.Equal(t, 0, compressionThreshold)
+}
+
+func TestCompressMessage(t *testing.T) {
+	defer SetCompression("", 0)
+	SetCompression(EncodingGzip, 100)
+	big := bytes.Repeat([]byte("a"), 1000)
+	cases := []struct {
+		message    []byte
+		accepted   string
+		compressed bool
+	}{
+		{big, "gzip", true},
+		{big, "zstd, gzip", true},
+		{big, "", false},
+		{big, "zstd", false},
+		{big[:50], "gzip", false},
+	}
+	for _, c := range cases {
+		headers := map[string]interface{}{}
+		message := compressMessage(c.message, headers, c.accepted)
+		_, ok := headers[headerContentEncoding]
+		assert.Equal(t, c.compressed, ok)
+		assert.Equal(t, c.compressed, len(message) < len(c.message))
+		msg := &Message{Body: message, Headers: headers}
+		assert.Nil(t, decompressMessage(msg))
+		assert.Equal(t, c.message, msg.Body)
+		assert.Empty(t, msg.Headers)
+	}
+}
+
+func TestCompressionDisabled(t *testing.T) {
+	headers := map[string]interface{}{}
+	big := bytes.Repeat([]byte("a"), 1000)
+	assert.Equal(t, big, compressMessage(big, headers, "gzip"))
+	assert.Empty(t, headers)
+}
+
+func TestDecompressInvalidMessage(t *testing.T) {
+	msg := &Message{Body: []byte("test"), Headers: map[string]interface{}{headerContentEncoding: "zstd"}}
+	assert.NotNil(t, decompressMessage(msg))
+	msg.Headers[headerContentEncoding] = EncodingGzip
+	assert.NotNil(t, decompressMessage(msg))
+}
+
+func TestMoveContentEncoding(t *testing.T) {
+	headers := map[string]interface{}{headerContentEncoding: EncodingGzip, headerVersion: int32(2)}
+	body, _ := gzipCompress([]byte("test"))
+	msg := &Message{Body: body, Headers: headers}
+	moveContentEncoding(msg)
+	assert.Equal(t, EncodingGzip, msg.ContentEncoding)
+	assert.Equal(t, map[string]interface{}{headerVersion: int32(2)}, msg.Headers)
+	// The headers of the caller are left as they are.
+	assert.Equal(t, EncodingGzip, headers[headerContentEncoding])
+	assert.Nil(t, decompressMessage(msg))
+	assert.Equal(t, "test", string(msg.Body))
+	assert.Empty(t, msg.ContentEncoding)
+}
+
+func TestDecompressBodyTooBig(t *testing.T) {
+	defer SetMaxBodySize(128 * 1024 * 1024)
+	SetMaxBodySize(1024)
+	body, _ := gzipCompress(bytes.Repeat([]byte("a"), 1024))
+	msg := &Message{Body: body, Headers: map[string]interface{}{headerContentEncoding: EncodingGzip}}
+	assert.Nil(t, decompressMessage(msg))
+	assert.Len(t, msg.Body, 1024)
+	body, _ = gzipCompress(bytes.Repeat([]byte("a"), 1025))
+	msg = &Message{Body: body, Headers: map[string]interface{}{headerContentEncoding: EncodingGzip}}
+	assert.Equal(t, ErrBodyTooBig, decompressMessage(msg))
+}
+
+func TestCompressionNegotiation(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	defer SetCompression("", 0)
+	SetCompression(EncodingGzip, 0)
+	setPeerEncodings("compression", "")
+	_createQueue("postman.req.compression")
+	msgs, _ := transport.Consume("postman.req.compression", ConsumeOptions{AutoAck: true})
+	body := bytes.Repeat([]byte("a"), 1000)
+	for _, compressed := range []bool{false, true} {
+		c := make(chan *protobuf.Response)
+		req := &protobuf.Request{Method: "POST", Body: body, ResponseQueue: ResponseQueueName}
+		SendRequestMessage("compression", req, func(resp *protobuf.Response, err *Error) {
+			assert.Nil(t, err)
+			c <- resp
+		})
+		d := <-msgs
+		assert.Equal(t, compressed, d.ContentEncoding == EncodingGzip)
+		_, ok := d.Headers[headerContentEncoding]
+		assert.False(t, ok)
+		assert.Equal(t, "gzip", getHeaderString(d.Headers, headerAcceptEncoding))
+		sendResponseMessage(req, &protobuf.Response{RequestId: req.Id, Body: body}, getMessageVersion(&d.Message), "gzip")
+		resp := <-c
+		assert.Equal(t, body, resp.Body)
+	}
+}
+
+func TestCompressedRequestIsProcessed(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	defer SetCompression("", 0)
+	defer func() {
+		ResponseMiddleware = nil
+	}()
+	ResponseMiddleware = func(ctx context.Context, req *protobuf.Request) (*protobuf.Response, error) {
+		return &protobuf.Response{StatusCode: 200, RequestId: req.Id, Body: req.Body}, nil
+	}
+	SetCompression(EncodingGzip, 0)
+	setPeerEncodings("test-service", "gzip")
+	body := bytes.Repeat([]byte("a"), 1000)
+	c := make(chan *protobuf.Response)
+	req := &protobuf.Request{Method: "POST", Body: body, ResponseQueue: ResponseQueueName}
+	SendRequestMessage("test-service", req, func(resp *protobuf.Response, err *Error) {
+		assert.Nil(t, err)
+		c <- resp
+	})
+	resp := <-c
+	assert.Equal(t, body, resp.Body)
+}
@@ -0,0 +1,315 @@
+package async
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/satori/go.uuid"
+
+	"github.com/rgamba/postman/stats"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// ResponseQueueName is the queue name we'll consume the response messages from.
+	ResponseQueueName = createResponseQueueName()
+	// ServiceName is the name of our service.
+	ServiceName string
+	// The transport we use to talk to the broker.
+	transport Transport
+)
+
+// Create a random response queue name.
+// We'll listen to responses to the outgoing requests
+// on this queue name.
+func createResponseQueueName() string {
+	uniqid := uuid.NewV4()
+	return fmt.Sprintf("postman.resp.%s", uniqid)
+}
+
+// Connect starts the connection to the AMQP server. The uris are
+// the nodes of the cluster, we only connect to one of them.
+func Connect(uris []string, service string) {
+	ConnectTransport(NewAMQPTransport(uris...), service)
+}
+
+// ConnectTransport starts the connection to the broker using
+// the given transport. The first connection attempt is made right
+// away, if it fails we'll keep trying in the background.
+func ConnectTransport(t Transport, service string) {
+	ServiceName = service
+	transport = t
+	resumeOutboxReplays()
+	closed, err := setupConnection(t)
+	if err != nil {
+		setConnectionState(ConnectionReconnecting)
+		logConnectionError(err)
+	}
+	go serverConnector(t, closed)
+}
+
+// Wait for the connection to be closed and gracefully
+// handle any server connection errors and retries.
+func serverConnector(t Transport, closed <-chan error) {
+	for {
+		if closed != nil {
+			err := <-closed
+			if err == nil {
+				log.Info("Connection closed")
+				return
+			}
+			setConnectionState(ConnectionReconnecting)
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Warnf("Connection lost")
+		}
+		closed = connectToServer(t)
+	}
+}
+
+// Connect to the broker, retrying until we succeed. We wait
+// longer after each failed attempt.
+func connectToServer(t Transport) <-chan error {
+	for attempt := 0; ; attempt++ {
+		scheduleReconnect(attempt, 0)
+		log.Info("Trying to reconnect to the broker")
+		closed, err := setupConnection(t)
+		if err == nil {
+			return closed
+		}
+		logConnectionError(err)
+		delay := getReconnectDelay(attempt)
+		scheduleReconnect(attempt+1, delay)
+		time.Sleep(delay)
+	}
+}
+
+// Transports that can connect to more than one
+// node let us know which one they are connected to.
+type nodeTransport interface {
+	Node() string
+}
+
+// Open the connection and start consuming both the response
+// and the request queues. The requests buffered while we were
+// disconnected are sent once we are ready.
+func setupConnection(t Transport) (closed <-chan error, err error) {
+	defer func() {
+		node := ""
+		if nt, ok := t.(nodeTransport); ok {
+			node = nt.Node()
+		}
+		stats.RecordConnectionAttempt(node, err)
+	}()
+	if err := t.Connect(); err != nil {
+		return nil, err
+	}
+	closed = t.NotifyClose()
+	// Response queue
+	if err := consumeReponseMessages(); err != nil {
+		t.Close()
+		return nil, err
+	}
+	// Request queue, a drained instance doesn't take new requests.
+	if !IsDraining() {
+		if err := consumeRequestMessages(); err != nil {
+			t.Close()
+			return nil, err
+		}
+	}
+	flushBufferedMessages()
+	startOutboxReplay()
+	return closed, nil
+}
+
+func logConnectionError(err error) {
+	log.WithFields(log.Fields{
+		"error": err,
+	}).Warnf("Connection error")
+}
+
+// Declare the queue we'll use for getting the response messages.
+// Notice that this queue needs to be exclusive. This unique instance will be
+// consuming from that queue. Plus, that queue will be destroyed when this
+// instance gets disconnected.
+func declareResponseQueue() error {
+	return transport.DeclareQueue(ResponseQueueName, QueueOptions{
+		Durable:    true,
+		AutoDelete: true,
+	})
+}
+
+// Make sure there is a request queue for the current service
+// already defined. If it already exists then we'll do nothing.
+// The messages the broker rejects end up in the dead letter queue.
+func ensureRequestQueue() error {
+	if err := ensureDeadLetterQueue(); err != nil {
+		return err
+	}
+	err := transport.DeclareQueue(getRequestQueueName(), QueueOptions{
+		Durable:    true,
+		AutoDelete: true,
+		Args: map[string]interface{}{
+			"x-dead-letter-exchange": getDeadLetterExchangeName(),
+		},
+	})
+	if err != ErrPreconditionFailed {
+		return err
+	}
+	// The queue was declared by an older version, without the dead letter
+	// exchange, and its arguments can't be changed. We still send the failed
+	// requests to the dead letter queue ourselves.
+	err = transport.DeclareQueue(getRequestQueueName(), QueueOptions{
+		Durable:    true,
+		AutoDelete: true,
+	})
+	if err == nil {
+		applyDeadLetterPolicy(getRequestQueueName(), getDeadLetterExchangeName())
+	}
+	return err
+}
+
+// Get the request queue name for the current service.
+func getRequestQueueName() string {
+	return fmt.Sprintf("postman.req.%s", ServiceName)
+}
+
+// Close the connection to the broker. Buffered requests are failed,
+// they won't get to the broker.
+func Close() {
+	setConnectionState(ConnectionClosed)
+	discardBufferedMessages()
+	if transport != nil {
+		transport.Close()
+	}
+	waitForOutboxReplays()
+}
+
+// Consume messages on the response queue.
+func consumeReponseMessages() error {
+	err := declareResponseQueue()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Errorf("Error creating the response queue")
+		return err
+	}
+	// Control messages for this service get to every instance
+	// through their response queue.
+	if err := transport.BindQueue(ResponseQueueName, getControlExchangeName(ServiceName)); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Errorf("Error binding the response queue to the control exchange")
+		return err
+	}
+	msgs, err := transport.Consume(ResponseQueueName, ConsumeOptions{
+		AutoAck:   true,
+		Exclusive: true,
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Errorf("Error consuming the response queue")
+		return err
+	}
+	go func() {
+		for d := range msgs {
+			err := processMessageResponse(&d.Message)
+			if err != nil {
+				log.Error(err)
+			}
+		}
+		log.Warn("Stopped consuming response messages")
+	}()
+	return nil
+}
+
+// Consume messages on the request queue.
+// Note that this is a shared queue, a non exclusive queue.
+func consumeRequestMessages() error {
+	// Ensure there is a request queue declared.
+	err := ensureRequestQueue()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Errorf("Error creating the request queue")
+		return err
+	}
+	msgs, err := transport.Consume(getRequestQueueName(), ConsumeOptions{
+		AutoAck:   false,
+		Exclusive: false,
+		Consumer:  requestConsumerTag,
+		Prefetch:  prefetch,
+	})
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Errorf("Error consuming the request queue")
+		return err
+	}
+	startRequestWorkers(msgs)
+	return nil
+}
+
+// Utility function to get the service name given the queue name.
+func extractServiceNameFromQueueName(queueName string) string {
+	parts := strings.Split(queueName, ".")
+	return parts[len(parts)-1]
+}
+
+// Publish a new message. Messages with no version get stamped with the current one.
+func publishMessage(message []byte, headers map[string]interface{}, queueName string) *Error {
+	if transport == nil {
+		return createBrokerUnavailableError()
+	}
+	if headers == nil {
+		headers = map[string]interface{}{}
+	}
+	if _, ok := headers[headerVersion]; !ok {
+		headers[headerVersion] = int32(MessageVersion)
+	}
+	if _, ok := headers[headerAcceptEncoding]; !ok {
+		headers[headerAcceptEncoding] = getAcceptedEncodings()
+	}
+	msg := &Message{Body: message, Headers: headers}
+	moveContentEncoding(msg)
+	setMessageExpiration(msg)
+	err := transport.Publish(queueName, msg)
+	if err == nil {
+		return nil
+	}
+	if err == ErrUnroutable {
+		return createInvalidQueueNameError(queueName)
+	}
+	if err == ErrNotConnected {
+		return createBrokerUnavailableError()
+	}
+	return createError("unexpected", err.Error(), nil)
+}
+
+// Utility function to create an invalid queue error message.
+func createInvalidQueueNameError(queueName string) *Error {
+	return createError(
+		ErrorCodeQueueNotFound,
+		"The service name is invalid or there is no service instances available at the moment",
+		map[string]string{
+			"queue_name": queueName,
+		},
+	)
+}
+
+// GetServiceInstances returns the number of consumers of a given request
+// queue on the broker. In other words that means the number of instances
+// available for that given service.
+func GetServiceInstances(serviceName string) int {
+	if transport == nil {
+		return 0
+	}
+	consumers, err := transport.Consumers(buildRequestQueueName(serviceName))
+	if err != nil {
+		return 0
+	}
+	return consumers
+}
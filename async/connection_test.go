@@ -0,0 +1,120 @@
+package async
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+func TestRequestQueueName(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	assert.Equal(t, getRequestQueueName(), "postman.req.test-service")
+}
+
+func TestEnsureRequestQueue(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	if !_queueExists(getRequestQueueName()) {
+		t.Error("Request queue does not exist")
+	}
+}
+
+func TestEnsureRequestQueueDeclaredByOlderVersion(t *testing.T) {
+	// The queue exists already, without the dead letter exchange.
+	tr := NewMemoryTransport()
+	tr.Connect()
+	tr.DeclareQueue("postman.req.test-service", QueueOptions{Durable: true, AutoDelete: true})
+	ConnectTransport(tr, "test-service")
+	defer _close_connection()
+	assert.Equal(t, ConnectionConnected, GetConnectionState())
+	assert.Equal(t, ErrPreconditionFailed, tr.DeclareQueue("postman.req.test-service", QueueOptions{
+		Args: map[string]interface{}{"x-dead-letter-exchange": getDeadLetterExchangeName()},
+	}))
+}
+
+func TestResponseQueueCreation(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	assert.NotEmpty(t, ResponseQueueName)
+	assert.True(t, _queueExists(ResponseQueueName))
+}
+
+func TestPublishMessageToUnknownQueue(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	err := publishMessage([]byte("test"), nil, "postman.req.invalid")
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "queue_not_found", err.Code)
+	}
+}
+
+func TestPublishMessage(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	resp := make(chan []byte)
+	_createQueue("test")
+	_consumeQueue("test", func(msg []byte) {
+		resp <- msg
+	})
+	err := publishMessage([]byte("test"), nil, "test")
+	assert.Nil(t, err)
+	assert.Equal(t, string(<-resp), "test")
+}
+
+func TestPublishMessageWhenClosedConnection(t *testing.T) {
+	_connect()
+	_close_connection()
+	err := publishMessage([]byte("test"), nil, "test")
+	assert.NotNil(t, err)
+}
+
+func TestGetServiceInstances(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	assert.Equal(t, 1, GetServiceInstances("test-service"))
+	assert.Equal(t, 0, GetServiceInstances("invalid"))
+}
+
+// Misc functions
+
+func _queueExists(queueName string) bool {
+	_, err := transport.Consumers(queueName)
+	return err == nil
+}
+
+func _connect() {
+	ConnectTransport(NewMemoryTransport(), "test-service")
+}
+
+func _close_connection() {
+	Close()
+}
+
+func _publishMessage(message []byte, queueName string) error {
+	return transport.Publish(queueName, &Message{Body: message})
+}
+
+func _consumeQueue(queueName string, fn func([]byte)) {
+	msgs, _ := transport.Consume(queueName, ConsumeOptions{AutoAck: true})
+	go func() {
+		for d := range msgs {
+			fn(d.Body)
+		}
+	}()
+}
+
+func _createQueue(name string) {
+	transport.DeclareQueue(name, QueueOptions{
+		Durable:    true,
+		AutoDelete: true,
+	})
+}
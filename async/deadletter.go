@@ -0,0 +1,177 @@
+package async
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Headers added to the messages sent to the dead letter queue.
+const (
+	headerRedeliveries     = "redeliveries"
+	headerDeadLetterReason = "dead_letter_reason"
+	headerDeadLetterError  = "dead_letter_error"
+	headerDeadLetterTime   = "dead_letter_time"
+)
+
+// DeadLetterPoison is the dead letter reason of the requests
+// that were redelivered too many times.
+const DeadLetterPoison = "poison"
+
+// Number of times a request can be redelivered before we quarantine it.
+var maxRedeliveries = 3
+
+// SetMaxRedeliveries sets the number of times a request can be
+// redelivered, because the instance processing it went away, before
+// it is sent to the dead letter queue instead of processed again.
+func SetMaxRedeliveries(redeliveries int) {
+	if redeliveries < 0 {
+		redeliveries = 0
+	}
+	maxRedeliveries = redeliveries
+}
+
+// A request that failed to be processed, it goes to the
+// dead letter queue with the error code as the reason.
+type requestError struct {
+	code string
+	err  error
+}
+
+func (e *requestError) Error() string {
+	return e.err.Error()
+}
+
+func newRequestError(code string, err error) *requestError {
+	return &requestError{code: code, err: err}
+}
+
+// A request that wasn't processed and couldn't be put back in the queue.
+type requeueError struct {
+	err error
+}
+
+func (e *requeueError) Error() string {
+	return e.err.Error()
+}
+
+// Put the request back in the request queue, without processing it.
+func publishRequeued(msg *Message) error {
+	if err := transport.Publish(getRequestQueueName(), msg); err != nil {
+		return &requeueError{err: err}
+	}
+	return nil
+}
+
+// Get the dead letter queue name for the current service.
+func getDeadLetterQueueName() string {
+	return fmt.Sprintf("postman.dlq.%s", ServiceName)
+}
+
+// The request queue dead letters the messages the broker rejects
+// or drops through this exchange.
+func getDeadLetterExchangeName() string {
+	return fmt.Sprintf("postman.dlx.%s", ServiceName)
+}
+
+// The dead letter queue is not deleted when unused, the messages
+// must be there once someone looks at them.
+func ensureDeadLetterQueue() error {
+	err := transport.DeclareQueue(getDeadLetterQueueName(), QueueOptions{
+		Durable: true,
+	})
+	if err != nil {
+		return err
+	}
+	return transport.BindQueue(getDeadLetterQueueName(), getDeadLetterExchangeName())
+}
+
+// Process the request delivery and ack it. Requests that fail to be
+// processed go to the dead letter queue.
+func processRequestDelivery(d *Delivery) {
+	var err error
+	d.ackHooks = &ackHooks{}
+	if d.Redelivered {
+		err = requeueRedelivered(&d.Message)
+	} else {
+		err = processMessageRequest(&d.Message)
+	}
+	if err == nil {
+		ackAndRunHooks(d)
+		return
+	}
+	log.WithFields(log.Fields{
+		"error":      err,
+		"request_id": getHeaderString(d.Headers, headerRequestID),
+	}).Error("Error processing request")
+	if _, ok := err.(*requeueError); ok {
+		// The request wasn't processed and we couldn't put it back
+		// in the queue, the broker gets to deliver it again.
+		d.Nack(true)
+		return
+	}
+	failed, ok := err.(*requestError)
+	if !ok {
+		// The request was processed, only the response couldn't be sent.
+		// Processing it again could repeat what the service did.
+		ackAndRunHooks(d)
+		return
+	}
+	if err := sendToDeadLetterQueue(&d.Message, failed.code, failed.Error()); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Unable to send the request to the dead letter queue")
+		// The broker dead letters it, without the reason though.
+		d.Nack(false)
+		return
+	}
+	d.Ack()
+}
+
+// Once acked, the request won't be delivered again.
+func ackAndRunHooks(d *Delivery) {
+	if err := d.Ack(); err != nil {
+		log.WithFields(log.Fields{
+			"error":      err,
+			"request_id": getHeaderString(d.Headers, headerRequestID),
+		}).Warn("Unable to ack the request")
+		return
+	}
+	d.ackHooks.run()
+}
+
+// A redelivered request may be the reason the instance that got it before
+// went down. Instead of processing it right away, we put it back in the
+// queue counting the redeliveries, once it goes over the limit it is
+// quarantined in the dead letter queue.
+func requeueRedelivered(msg *Message) error {
+	if isMessageExpired(msg) {
+		return nil
+	}
+	redeliveries := getHeaderInt(msg.Headers, headerRedeliveries) + 1
+	if redeliveries > maxRedeliveries {
+		return newRequestError(DeadLetterPoison, fmt.Errorf("Redelivered %d times", redeliveries))
+	}
+	clone := msg.Clone()
+	if clone.Headers == nil {
+		clone.Headers = map[string]interface{}{}
+	}
+	clone.Headers[headerRedeliveries] = int32(redeliveries)
+	setMessageExpiration(clone)
+	return publishRequeued(clone)
+}
+
+// Send a copy of the message to the dead letter queue along with the reason.
+func sendToDeadLetterQueue(msg *Message, reason string, description string) error {
+	clone := msg.Clone()
+	if clone.Headers == nil {
+		clone.Headers = map[string]interface{}{}
+	}
+	clone.Headers[headerDeadLetterReason] = reason
+	clone.Headers[headerDeadLetterError] = description
+	clone.Headers[headerDeadLetterTime] = time.Now().UnixNano() / int64(time.Millisecond)
+	// Dead letters never expire.
+	clone.Expiration = 0
+	return transport.Publish(getDeadLetterQueueName(), clone)
+}
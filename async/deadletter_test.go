@@ -0,0 +1,233 @@
+package async
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rgamba/postman/async/protobuf"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInvalidFormatGoesToDeadLetterQueue(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	deadLetters := _consumeDeadLetters(t)
+	headers := map[string]interface{}{
+		headerVersion:   int32(MessageVersion),
+		headerRequestID: "invalid-format",
+	}
+	transport.Publish(getRequestQueueName(), &Message{Body: []byte("not protobuf"), Headers: headers})
+	d := _waitForDeadLetter(t, deadLetters)
+	assert.Equal(t, ErrorCodeInvalidFormat, getHeaderString(d.Headers, headerDeadLetterReason))
+	assert.NotEqual(t, "", getHeaderString(d.Headers, headerDeadLetterError))
+	assert.Equal(t, "invalid-format", getHeaderString(d.Headers, headerRequestID))
+	assert.Equal(t, "not protobuf", string(d.Body))
+}
+
+func TestFailedRequestGoesToDeadLetterQueue(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	defer func() {
+		ResponseMiddleware = nil
+	}()
+	ResponseMiddleware = func(ctx context.Context, req *protobuf.Request) (*protobuf.Response, error) {
+		return nil, NewError(ErrorCodeUpstreamUnavailable, "connection refused", nil)
+	}
+	deadLetters := _consumeDeadLetters(t)
+	assert.Nil(t, SendMessageAndDiscardResponse("test-service", &protobuf.Request{Id: "failed"}))
+	d := _waitForDeadLetter(t, deadLetters)
+	assert.Equal(t, ErrorCodeUpstreamUnavailable, getHeaderString(d.Headers, headerDeadLetterReason))
+	assert.Equal(t, "upstream_unavailable: connection refused", getHeaderString(d.Headers, headerDeadLetterError))
+	assert.Equal(t, "failed", getHeaderString(d.Headers, headerRequestID))
+}
+
+func TestPoisonRequestIsQuarantined(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	deadLetters := _consumeDeadLetters(t)
+	ack := &_testAcknowledger{}
+	processRequestDelivery(&Delivery{
+		Message: Message{
+			Body:    []byte("poison"),
+			Headers: map[string]interface{}{headerRedeliveries: int32(maxRedeliveries)},
+		},
+		Redelivered:  true,
+		Acknowledger: ack,
+	})
+	assert.True(t, ack.acked)
+	d := _waitForDeadLetter(t, deadLetters)
+	assert.Equal(t, DeadLetterPoison, getHeaderString(d.Headers, headerDeadLetterReason))
+	assert.Equal(t, "poison", string(d.Body))
+}
+
+func TestRedeliveredRequestIsRequeued(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	_createQueue("postman.req.service1")
+	ServiceName = "service1"
+	defer func() {
+		ServiceName = "test-service"
+	}()
+	msgs, _ := transport.Consume("postman.req.service1", ConsumeOptions{AutoAck: true})
+	ack := &_testAcknowledger{}
+	processRequestDelivery(&Delivery{
+		Message:      Message{Body: []byte("test"), Headers: map[string]interface{}{}},
+		Redelivered:  true,
+		Acknowledger: ack,
+	})
+	assert.True(t, ack.acked)
+	d := <-msgs
+	assert.Equal(t, 1, getHeaderInt(d.Headers, headerRedeliveries))
+	assert.False(t, d.Redelivered)
+	assert.Equal(t, "test", string(d.Body))
+}
+
+func TestDeadLetterQueueUnavailable(t *testing.T) {
+	_connect()
+	_close_connection()
+	ack := &_testAcknowledger{}
+	processRequestDelivery(&Delivery{
+		Message: Message{
+			Body:    []byte("not protobuf"),
+			Headers: map[string]interface{}{headerVersion: int32(MessageVersion)},
+		},
+		Acknowledger: ack,
+	})
+	// The broker takes care of it.
+	assert.True(t, ack.nacked)
+}
+
+func TestFailedRequeueKeepsRequest(t *testing.T) {
+	_connect()
+	_close_connection()
+	ack := &_testAcknowledger{}
+	processRequestDelivery(&Delivery{
+		Message:      Message{Body: []byte("test"), Headers: map[string]interface{}{}},
+		Redelivered:  true,
+		Acknowledger: ack,
+	})
+	assert.False(t, ack.acked)
+	assert.True(t, ack.nacked)
+	assert.True(t, ack.requeued)
+}
+
+func TestMissingResponseQueueDoesntRepeatRequest(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	defer func() {
+		ResponseMiddleware = nil
+	}()
+	calls := 0
+	ResponseMiddleware = func(ctx context.Context, req *protobuf.Request) (*protobuf.Response, error) {
+		calls++
+		return &protobuf.Response{RequestId: req.Id, StatusCode: 201}, nil
+	}
+	// The requester went away along with its response queue.
+	body, _ := encodeRequest(&protobuf.Request{Id: "no-response-queue", ResponseQueue: "postman.resp.gone"}, MessageVersion)
+	ack := &_testAcknowledger{}
+	processRequestDelivery(&Delivery{
+		Message: Message{Body: body, Headers: map[string]interface{}{
+			headerVersion:       int32(MessageVersion),
+			headerResponseQueue: "postman.resp.gone",
+		}},
+		Acknowledger: ack,
+	})
+	assert.Equal(t, 1, calls)
+	assert.True(t, ack.acked)
+	assert.False(t, ack.nacked)
+}
+
+func TestSetMaxRedeliveries(t *testing.T) {
+	defer SetMaxRedeliveries(3)
+	SetMaxRedeliveries(-1)
+	assert.Equal(t, 0, maxRedeliveries)
+}
+
+type _testAcknowledger struct {
+	acked    bool
+	nacked   bool
+	requeued bool
+}
+
+func (a *_testAcknowledger) Ack() error {
+	a.acked = true
+	return nil
+}
+
+func (a *_testAcknowledger) Nack(requeue bool) error {
+	a.nacked = true
+	a.requeued = requeue
+	return nil
+}
+
+func _consumeDeadLetters(t *testing.T) <-chan *Delivery {
+	msgs, err := transport.Consume(getDeadLetterQueueName(), ConsumeOptions{AutoAck: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return msgs
+}
+
+func _waitForDeadLetter(t *testing.T, deadLetters <-chan *Delivery) *Delivery {
+	select {
+	case d := <-deadLetters:
+		return d
+	case <-time.After(time.Second):
+		t.Fatal("Nothing in the dead letter queue")
+	}
+	return nil
+}
+
+func TestAfterAckRunsOnceAcked(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	defer func() {
+		ResponseMiddleware = nil
+	}()
+	ack := &_testAcknowledger{}
+	acked := false
+	ResponseMiddleware = func(ctx context.Context, req *protobuf.Request) (*protobuf.Response, error) {
+		AfterAck(ctx, func() {
+			acked = ack.acked
+		})
+		return &protobuf.Response{RequestId: req.Id}, nil
+	}
+	body, _ := encodeRequest(&protobuf.Request{Id: "after-ack"}, MessageVersion)
+	processRequestDelivery(&Delivery{
+		Message:      Message{Body: body, Headers: map[string]interface{}{headerVersion: int32(MessageVersion)}},
+		Acknowledger: ack,
+	})
+	assert.True(t, acked)
+}
+
+func TestAfterAckDoesntRunForDeadLetters(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	defer func() {
+		ResponseMiddleware = nil
+	}()
+	ran := false
+	ResponseMiddleware = func(ctx context.Context, req *protobuf.Request) (*protobuf.Response, error) {
+		AfterAck(ctx, func() {
+			ran = true
+		})
+		return nil, NewError(ErrorCodeUpstreamUnavailable, "connection refused", nil)
+	}
+	body, _ := encodeRequest(&protobuf.Request{Id: "dead-letter"}, MessageVersion)
+	ack := &_testAcknowledger{}
+	processRequestDelivery(&Delivery{
+		Message:      Message{Body: body, Headers: map[string]interface{}{headerVersion: int32(MessageVersion)}},
+		Acknowledger: ack,
+	})
+	assert.True(t, ack.acked)
+	assert.False(t, ran)
+}
+
+func TestAfterAckOutsideDelivery(t *testing.T) {
+	ran := false
+	assert.False(t, AfterAck(context.Background(), func() {
+		ran = true
+	}))
+	assert.False(t, ran)
+}
@@ -0,0 +1,74 @@
+package async
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rgamba/postman/async/protobuf"
+)
+
+// TimeoutHeader is the HTTP header used to let a service know how much
+// time it has left to respond. The local service should pass it along
+// on any nested request so the whole call chain inherits the budget.
+const TimeoutHeader = "Postman-Timeout"
+
+// The header that carries the absolute deadline of the request
+// as milliseconds since the unix epoch.
+const headerDeadline = "deadline"
+
+// Add the deadline header. A zero deadline means no deadline at all.
+func setDeadlineHeader(headers map[string]interface{}, deadline time.Time) {
+	if deadline.IsZero() {
+		return
+	}
+	headers[headerDeadline] = deadline.UnixNano() / int64(time.Millisecond)
+}
+
+// Get the deadline of the message, if any.
+func getMessageDeadline(msg *Message) (time.Time, bool) {
+	if _, ok := msg.Headers[headerDeadline]; !ok {
+		return time.Time{}, false
+	}
+	ms := getHeaderInt(msg.Headers, headerDeadline)
+	return time.Unix(0, int64(ms)*int64(time.Millisecond)), true
+}
+
+// Messages with a deadline expire on the broker once the deadline
+// is reached, nobody will be waiting for the response by then.
+func setMessageExpiration(msg *Message) {
+	deadline, ok := getMessageDeadline(msg)
+	if !ok {
+		return
+	}
+	expiration := deadline.Sub(time.Now())
+	// The broker takes zero as "expire right away unless it can be
+	// delivered immediately", we'd rather let the consumer drop it.
+	if expiration < time.Millisecond {
+		expiration = time.Millisecond
+	}
+	msg.Expiration = expiration
+}
+
+// Check if the caller already gave up on the request.
+func isMessageExpired(msg *Message) bool {
+	deadline, ok := getMessageDeadline(msg)
+	return ok && !time.Now().Before(deadline)
+}
+
+// Let the local service know the time it has left to respond. Any
+// timeout header sent by the caller is replaced, the deadline already
+// takes it into account.
+func setRequestTimeoutHeader(request *protobuf.Request, deadline time.Time) {
+	headers := []*protobuf.Header{}
+	for _, header := range request.Headers {
+		if http.CanonicalHeaderKey(header.Name) != TimeoutHeader {
+			headers = append(headers, header)
+		}
+	}
+	remaining := deadline.Sub(time.Now())
+	request.Headers = append(headers, &protobuf.Header{
+		Name:   TimeoutHeader,
+		Values: []string{fmt.Sprintf("%.3f", remaining.Seconds())},
+	})
+}
@@ -0,0 +1,106 @@
+package async
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/rgamba/postman/async/protobuf"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendRequestMessageWithDeadline(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	_createQueue("postman.req.service1")
+	msgs, _ := transport.Consume("postman.req.service1", ConsumeOptions{AutoAck: true})
+	deadline := time.Now().Add(5 * time.Second)
+	req := &protobuf.Request{Method: "GET", ResponseQueue: ResponseQueueName}
+	SendRequestMessageWithDeadline("service1", req, deadline, func(resp *protobuf.Response, err *Error) {})
+	defer removeRequest(req.Id)
+	d := <-msgs
+	msgDeadline, ok := getMessageDeadline(&d.Message)
+	assert.True(t, ok)
+	assert.Equal(t, deadline.UnixNano()/int64(time.Millisecond), msgDeadline.UnixNano()/int64(time.Millisecond))
+}
+
+func TestSendRequestMessageWithoutDeadline(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	_createQueue("postman.req.service1")
+	msgs, _ := transport.Consume("postman.req.service1", ConsumeOptions{AutoAck: true})
+	SendMessageAndDiscardResponse("service1", &protobuf.Request{Method: "GET"})
+	d := <-msgs
+	_, ok := getMessageDeadline(&d.Message)
+	assert.False(t, ok)
+}
+
+func TestSetMessageExpiration(t *testing.T) {
+	msg := &Message{Headers: map[string]interface{}{}}
+	setMessageExpiration(msg)
+	assert.Equal(t, time.Duration(0), msg.Expiration)
+	setDeadlineHeader(msg.Headers, time.Now().Add(time.Minute))
+	setMessageExpiration(msg)
+	assert.True(t, msg.Expiration > 59*time.Second && msg.Expiration <= time.Minute)
+	// Already expired messages still get a positive expiration.
+	setDeadlineHeader(msg.Headers, time.Now().Add(-time.Minute))
+	setMessageExpiration(msg)
+	assert.Equal(t, time.Millisecond, msg.Expiration)
+}
+
+func TestProcessMessageRequestExpired(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	defer func() {
+		ResponseMiddleware = nil
+	}()
+	called := false
+	ResponseMiddleware = func(ctx context.Context, req *protobuf.Request) (*protobuf.Response, error) {
+		called = true
+		return &protobuf.Response{StatusCode: 200, RequestId: req.Id}, nil
+	}
+	req := &protobuf.Request{Id: "expired", Method: "GET", ResponseQueue: ResponseQueueName}
+	body, _ := encodeRequest(req, MessageVersion)
+	headers := createRequestHeaders(req, MessageVersion)
+	setDeadlineHeader(headers, time.Now().Add(-time.Second))
+	assert.Nil(t, processMessageRequest(&Message{Body: body, Headers: headers}))
+	assert.False(t, called)
+}
+
+func TestProcessMessageRequestRemainingTimeout(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	defer func() {
+		ResponseMiddleware = nil
+	}()
+	timeouts := make(chan []string, 1)
+	ResponseMiddleware = func(ctx context.Context, req *protobuf.Request) (*protobuf.Response, error) {
+		values := []string{}
+		for _, header := range req.Headers {
+			if header.Name == TimeoutHeader || header.Name == "postman-timeout" {
+				values = append(values, header.Values...)
+			}
+		}
+		timeouts <- values
+		return &protobuf.Response{StatusCode: 200, RequestId: req.Id}, nil
+	}
+	c := make(chan bool)
+	// The caller's own timeout header gets replaced by the remaining time.
+	req := &protobuf.Request{
+		Method:        "GET",
+		ResponseQueue: ResponseQueueName,
+		Headers:       []*protobuf.Header{{Name: "postman-timeout", Values: []string{"60"}}},
+	}
+	SendRequestMessageWithDeadline("test-service", req, time.Now().Add(5*time.Second), func(resp *protobuf.Response, err *Error) {
+		assert.Nil(t, err)
+		c <- true
+	})
+	<-c
+	values := <-timeouts
+	if assert.Len(t, values, 1) {
+		remaining, err := strconv.ParseFloat(values[0], 64)
+		assert.NoError(t, err)
+		assert.True(t, remaining > 4 && remaining <= 5)
+	}
+}
@@ -0,0 +1,65 @@
+package async
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ErrDrainTimeout is returned when the drain doesn't finish
+// within the grace period.
+var ErrDrainTimeout = errors.New("drain grace period expired")
+
+// The consumer tag of the request queue consumer.
+const requestConsumerTag = "postman.requests"
+
+var (
+	draining      bool
+	drainingMutex sync.RWMutex
+)
+
+// Drain gets the instance ready to be shut down. We stop consuming request
+// messages, wait for the workers to finish the requests they already got
+// and publish their responses, then wait for the responses to our own
+// outgoing requests. It returns ErrDrainTimeout when that doesn't happen
+// within the grace period. Once drained, the instance won't consume request
+// messages anymore, but it can still send requests.
+func Drain(gracePeriod time.Duration) error {
+	expired := time.After(gracePeriod)
+	drainingMutex.Lock()
+	draining = true
+	drainingMutex.Unlock()
+	log.Info("Draining")
+	if transport != nil {
+		if err := transport.Cancel(requestConsumerTag); err != nil {
+			// The consumer is already gone, for example
+			// because we lost the connection to the broker.
+			log.WithFields(log.Fields{
+				"error": err,
+			}).Debug("Unable to cancel the request consumer")
+		}
+	}
+	select {
+	case <-getWorkersDone():
+	case <-expired:
+		return ErrDrainTimeout
+	}
+	for CountPendingRequests() > 0 {
+		select {
+		case <-time.After(50 * time.Millisecond):
+		case <-expired:
+			return ErrDrainTimeout
+		}
+	}
+	log.Info("Drained")
+	return nil
+}
+
+// IsDraining returns true once the instance started draining.
+func IsDraining() bool {
+	drainingMutex.RLock()
+	defer drainingMutex.RUnlock()
+	return draining
+}
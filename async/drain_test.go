@@ -0,0 +1,65 @@
+package async
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rgamba/postman/async/protobuf"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDrain(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	defer _stopDraining()
+	defer func() {
+		ResponseMiddleware = nil
+	}()
+	started := make(chan bool)
+	release := make(chan bool)
+	ResponseMiddleware = func(ctx context.Context, req *protobuf.Request) (*protobuf.Response, error) {
+		started <- true
+		<-release
+		return &protobuf.Response{StatusCode: 200, RequestId: req.Id}, nil
+	}
+	responded := make(chan bool, 1)
+	req := &protobuf.Request{Method: "GET", ResponseQueue: ResponseQueueName}
+	SendRequestMessage("test-service", req, func(resp *protobuf.Response, err *Error) {
+		assert.Nil(t, err)
+		responded <- true
+	})
+	<-started
+	drained := make(chan error)
+	go func() {
+		drained <- Drain(5 * time.Second)
+	}()
+	// The request being processed must finish before we are drained.
+	select {
+	case <-drained:
+		t.Fatal("Drained before the worker finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	assert.Nil(t, <-drained)
+	assert.True(t, <-responded)
+	assert.True(t, IsDraining())
+	// We don't consume the request queue anymore.
+	assert.Equal(t, 0, GetServiceInstances("test-service"))
+}
+
+func TestDrainTimeout(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	defer _stopDraining()
+	req := &protobuf.Request{Id: "never-answered"}
+	_appendRequest("service1", req, time.Time{}, func(resp *protobuf.Response, err *Error) {})
+	defer removeRequest(req.Id)
+	assert.Equal(t, ErrDrainTimeout, Drain(50*time.Millisecond))
+}
+
+func _stopDraining() {
+	drainingMutex.Lock()
+	draining = false
+	drainingMutex.Unlock()
+}
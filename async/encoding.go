@@ -0,0 +1,172 @@
+package async
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/golang/protobuf/proto"
+
+	"github.com/rgamba/postman/async/protobuf"
+)
+
+// The header the responders use to let the requester know
+// the highest message version they are able to process.
+const headerMaxVersion = "max_version"
+
+// We'll keep track of the highest message version each service is able
+// to process. Until we know, we'll talk to the service using version 1
+// which every instance is able to process.
+var peerVersions = map[string]int{}
+var peerVersionsMutex sync.RWMutex
+
+// Get the message version we should use to send requests to the service.
+func getPeerVersion(serviceName string) int {
+	peerVersionsMutex.RLock()
+	defer peerVersionsMutex.RUnlock()
+	version, ok := peerVersions[serviceName]
+	if !ok || version > MessageVersion {
+		return 1
+	}
+	return version
+}
+
+func setPeerVersion(serviceName string, version int) {
+	if version < 1 {
+		version = 1
+	}
+	if version > MessageVersion {
+		version = MessageVersion
+	}
+	peerVersionsMutex.Lock()
+	peerVersions[serviceName] = version
+	peerVersionsMutex.Unlock()
+}
+
+// Encode the request using the given message version.
+func encodeRequest(request *protobuf.Request, version int) ([]byte, error) {
+	if version == 1 {
+		return proto.Marshal(convertRequestToV1(request))
+	}
+	return proto.Marshal(request)
+}
+
+// Decode the request using the given message version.
+func decodeRequest(msg []byte, version int) (*protobuf.Request, error) {
+	if version == 1 {
+		requestV1 := &protobuf.RequestV1{}
+		if err := proto.Unmarshal(msg, requestV1); err != nil {
+			return nil, err
+		}
+		return convertRequestFromV1(requestV1), nil
+	}
+	request := &protobuf.Request{}
+	if err := proto.Unmarshal(msg, request); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
+
+// Encode the response using the given message version.
+func encodeResponse(response *protobuf.Response, version int) ([]byte, error) {
+	if version == 1 {
+		return proto.Marshal(convertResponseToV1(response))
+	}
+	return proto.Marshal(response)
+}
+
+// Decode the response using the given message version.
+func decodeResponse(msg []byte, version int) (*protobuf.Response, error) {
+	if version == 1 {
+		responseV1 := &protobuf.ResponseV1{}
+		if err := proto.Unmarshal(msg, responseV1); err != nil {
+			return nil, err
+		}
+		return convertResponseFromV1(responseV1), nil
+	}
+	response := &protobuf.Response{}
+	if err := proto.Unmarshal(msg, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// Version 1 has no query string field, so we send it as
+// part of the endpoint. Host and protocol are lost.
+func convertRequestToV1(request *protobuf.Request) *protobuf.RequestV1 {
+	endpoint := request.Endpoint
+	if request.Query != "" {
+		endpoint += "?" + request.Query
+	}
+	return &protobuf.RequestV1{
+		Id:            request.Id,
+		Method:        request.Method,
+		Endpoint:      endpoint,
+		Headers:       convertHeadersToV1(request.Headers),
+		ResponseQueue: request.ResponseQueue,
+		Body:          string(request.Body),
+		Service:       request.Service,
+	}
+}
+
+func convertRequestFromV1(request *protobuf.RequestV1) *protobuf.Request {
+	endpoint, query := request.Endpoint, ""
+	if i := strings.Index(endpoint, "?"); i >= 0 {
+		endpoint, query = endpoint[:i], endpoint[i+1:]
+	}
+	return &protobuf.Request{
+		Id:            request.Id,
+		Method:        request.Method,
+		Endpoint:      endpoint,
+		Query:         query,
+		Headers:       convertHeadersFromV1(request.Headers),
+		ResponseQueue: request.ResponseQueue,
+		Body:          []byte(request.Body),
+		Service:       request.Service,
+	}
+}
+
+func convertResponseToV1(response *protobuf.Response) *protobuf.ResponseV1 {
+	return &protobuf.ResponseV1{
+		RequestId:  response.RequestId,
+		StatusCode: response.StatusCode,
+		Headers:    convertHeadersToV1(response.Headers),
+		Body:       string(response.Body),
+	}
+}
+
+func convertResponseFromV1(response *protobuf.ResponseV1) *protobuf.Response {
+	return &protobuf.Response{
+		RequestId:  response.RequestId,
+		StatusCode: response.StatusCode,
+		Headers:    convertHeadersFromV1(response.Headers),
+		Body:       []byte(response.Body),
+	}
+}
+
+// Version 1 headers are encoded as "Name: value1; value2".
+func convertHeadersToV1(headers []*protobuf.Header) []string {
+	result := []string{}
+	for _, header := range headers {
+		result = append(result, header.Name+": "+strings.Join(header.Values, "; "))
+	}
+	return result
+}
+
+// We can't tell apart multiple values from a single value that contains
+// "; " (cookies for example), so the value is kept as is. Only the first
+// colon separates the name from the value.
+func convertHeadersFromV1(headers []string) []*protobuf.Header {
+	result := []*protobuf.Header{}
+	for _, header := range headers {
+		parts := strings.SplitN(header, ":", 2)
+		value := ""
+		if len(parts) > 1 {
+			value = strings.TrimSpace(parts[1])
+		}
+		result = append(result, &protobuf.Header{
+			Name:   strings.TrimSpace(parts[0]),
+			Values: []string{value},
+		})
+	}
+	return result
+}
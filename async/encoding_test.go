@@ -0,0 +1,116 @@
+package async
+
+import (
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/rgamba/postman/async/protobuf"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeAndDecodeRequest(t *testing.T) {
+	request := &protobuf.Request{
+		Id:       "1",
+		Method:   "POST",
+		Endpoint: "/path",
+		Query:    "a=1&b=2",
+		Host:     "localhost:8130",
+		Protocol: "HTTP/1.1",
+		Body:     []byte{0xff, 0x00},
+		Headers: []*protobuf.Header{
+			{Name: "Referer", Values: []string{"http://localhost:8000/"}},
+			{Name: "Accept", Values: []string{"text/html", "application/json"}},
+		},
+	}
+	msg, err := encodeRequest(request, 2)
+	assert.NoError(t, err)
+	decoded, err := decodeRequest(msg, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, request, decoded)
+}
+
+func TestEncodeAndDecodeRequestV1(t *testing.T) {
+	request := &protobuf.Request{
+		Id:       "1",
+		Method:   "GET",
+		Endpoint: "/path",
+		Query:    "a=1",
+		Headers: []*protobuf.Header{
+			{Name: "Referer", Values: []string{"http://localhost:8000/"}},
+		},
+	}
+	msg, err := encodeRequest(request, 1)
+	assert.NoError(t, err)
+	// Make sure it is readable by a version 1 peer.
+	requestV1 := &protobuf.RequestV1{}
+	assert.NoError(t, proto.Unmarshal(msg, requestV1))
+	assert.Equal(t, "/path?a=1", requestV1.Endpoint)
+	assert.Equal(t, []string{"Referer: http://localhost:8000/"}, requestV1.Headers)
+	decoded, err := decodeRequest(msg, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, "/path", decoded.Endpoint)
+	assert.Equal(t, "a=1", decoded.Query)
+	assert.Equal(t, "Referer", decoded.Headers[0].Name)
+	assert.Equal(t, []string{"http://localhost:8000/"}, decoded.Headers[0].Values)
+}
+
+func TestEncodeAndDecodeResponse(t *testing.T) {
+	response := &protobuf.Response{
+		RequestId:  "1",
+		StatusCode: 200,
+		Body:       []byte("body"),
+		Headers: []*protobuf.Header{
+			{Name: "Set-Cookie", Values: []string{"a=1", "b=2"}},
+		},
+	}
+	for _, version := range []int{1, 2} {
+		msg, err := encodeResponse(response, version)
+		assert.NoError(t, err)
+		decoded, err := decodeResponse(msg, version)
+		assert.NoError(t, err)
+		assert.Equal(t, response.RequestId, decoded.RequestId)
+		assert.Equal(t, response.StatusCode, decoded.StatusCode)
+		assert.Equal(t, response.Body, decoded.Body)
+		assert.Equal(t, "Set-Cookie", decoded.Headers[0].Name)
+	}
+}
+
+func TestConvertHeadersFromV1(t *testing.T) {
+	headers := convertHeadersFromV1([]string{"Date: Mon, 02 Jan 2006 15:04:05 GMT", "Invalid"})
+	assert.Equal(t, "Date", headers[0].Name)
+	assert.Equal(t, []string{"Mon, 02 Jan 2006 15:04:05 GMT"}, headers[0].Values)
+	assert.Equal(t, "Invalid", headers[1].Name)
+	assert.Equal(t, []string{""}, headers[1].Values)
+}
+
+func TestPeerVersion(t *testing.T) {
+	assert.Equal(t, 1, getPeerVersion("unknown-service"))
+	setPeerVersion("peer-service", 2)
+	assert.Equal(t, 2, getPeerVersion("peer-service"))
+	setPeerVersion("peer-service", 99)
+	assert.Equal(t, MessageVersion, getPeerVersion("peer-service"))
+	setPeerVersion("peer-service", 0)
+	assert.Equal(t, 1, getPeerVersion("peer-service"))
+}
+
+func TestPeerVersionNegotiation(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	setPeerVersion("negotiation", 1)
+	_createQueue("postman.req.negotiation")
+	msgs, _ := transport.Consume("postman.req.negotiation", ConsumeOptions{AutoAck: true})
+	for _, expectedVersion := range []int{1, 2} {
+		c := make(chan bool)
+		req := &protobuf.Request{Method: "GET", ResponseQueue: ResponseQueueName}
+		SendRequestMessage("negotiation", req, func(resp *protobuf.Response, err *Error) {
+			assert.Nil(t, err)
+			c <- true
+		})
+		d := <-msgs
+		assert.Equal(t, expectedVersion, getMessageVersion(&d.Message))
+		// Respond as a version 2 service.
+		sendResponseMessage(req, &protobuf.Response{RequestId: req.Id}, expectedVersion, "")
+		<-c
+	}
+}
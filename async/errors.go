@@ -5,6 +5,27 @@ import (
 	"fmt"
 )
 
+// Error codes. These are the codes that can be sent back
+// to the requester on the `error` message header.
+const (
+	ErrorCodeInvalidVersion       = "invalid_version"
+	ErrorCodeInvalidFormat        = "invalid_format"
+	ErrorCodeInvalidRequest       = "invalid_request"
+	ErrorCodeNoAvailableInstances = "no_available_instances"
+	ErrorCodeUpstreamUnavailable  = "upstream_unavailable"
+	ErrorCodeUpstreamTimeout      = "upstream_timeout"
+	ErrorCodeUpstreamError        = "upstream_error"
+	// Used locally when there is no response in time.
+	ErrorCodeTimeout = "timeout"
+	// Used locally when too many requests are waiting for a response.
+	ErrorCodeTooManyPendingRequests = "too_many_pending_requests"
+	// Used locally when the destination service has no request queue.
+	ErrorCodeQueueNotFound = "queue_not_found"
+	// Used locally when the request can't be sent because
+	// there is no connection to the broker.
+	ErrorCodeBrokerUnavailable = "broker_unavailable"
+)
+
 // Error is the async specific error
 // representation.
 type Error struct {
@@ -34,6 +55,11 @@ func (err Error) ToMap() map[string]interface{} {
 	}
 }
 
+// NewError creates a new async error with the given code.
+func NewError(code string, message string, meta interface{}) *Error {
+	return createError(code, message, meta)
+}
+
 func createError(code string, message string, meta interface{}) *Error {
 	return &Error{
 		Code:    code,
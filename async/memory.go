@@ -0,0 +1,386 @@
+package async
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// The in-memory transport is an in-process broker. Messages never
+// leave the process, so it is only useful when both ends of the
+// communication live in the same process, for example in tests.
+type memoryTransport struct {
+	mutex     sync.Mutex
+	queues    map[string]*memoryQueue
+	exchanges map[string]map[string]bool
+	consumers map[string]*memoryConsumer
+	connected bool
+	done      chan struct{}
+	closed    []chan error
+}
+
+type memoryQueue struct {
+	mutex     sync.Mutex
+	cond      *sync.Cond
+	messages  []*memoryMessage
+	consumers int
+	exclusive bool
+	closed    bool
+	// Arguments the queue was declared with, they can't change.
+	args map[string]interface{}
+}
+
+type memoryMessage struct {
+	message     Message
+	redelivered bool
+	expires     time.Time
+}
+
+// The consumer stops once canceled.
+type memoryConsumer struct {
+	queue    *memoryQueue
+	canceled bool
+	stop     chan struct{}
+}
+
+func (m *memoryMessage) expired() bool {
+	return !m.expires.IsZero() && !time.Now().Before(m.expires)
+}
+
+// NewMemoryTransport creates a new in-memory transport.
+func NewMemoryTransport() Transport {
+	return &memoryTransport{
+		queues:    map[string]*memoryQueue{},
+		exchanges: map[string]map[string]bool{},
+		consumers: map[string]*memoryConsumer{},
+	}
+}
+
+func (t *memoryTransport) Connect() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.connected {
+		return nil
+	}
+	t.connected = true
+	t.done = make(chan struct{})
+	return nil
+}
+
+func (t *memoryTransport) NotifyClose() <-chan error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	closed := make(chan error, 1)
+	if !t.connected {
+		closed <- ErrNotConnected
+		return closed
+	}
+	t.closed = append(t.closed, closed)
+	return closed
+}
+
+func (t *memoryTransport) DeclareQueue(name string, options QueueOptions) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !t.connected {
+		return ErrNotConnected
+	}
+	queue, ok := t.queues[name]
+	if !ok {
+		queue = newMemoryQueue()
+		queue.args = options.Args
+		t.queues[name] = queue
+		return nil
+	}
+	// Same as AMQP, the arguments must be the ones the queue has.
+	if (len(queue.args) > 0 || len(options.Args) > 0) && !reflect.DeepEqual(queue.args, options.Args) {
+		return ErrPreconditionFailed
+	}
+	return nil
+}
+
+func (t *memoryTransport) Publish(queueName string, message *Message) error {
+	t.mutex.Lock()
+	if !t.connected {
+		t.mutex.Unlock()
+		return ErrNotConnected
+	}
+	queue, ok := t.queues[queueName]
+	t.mutex.Unlock()
+	// Same as mandatory publishing in AMQP, messages sent
+	// to a queue that doesn't exist are returned.
+	if !ok {
+		return ErrUnroutable
+	}
+	// Messages are copied so the publisher can't
+	// modify them once they are in the queue.
+	msg := &memoryMessage{message: *message.Clone()}
+	if message.Expiration > 0 {
+		msg.expires = time.Now().Add(message.Expiration)
+	}
+	queue.push(msg, false)
+	return nil
+}
+
+func (t *memoryTransport) BindQueue(queueName string, exchange string) error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !t.connected {
+		return ErrNotConnected
+	}
+	if _, ok := t.queues[queueName]; !ok {
+		return fmt.Errorf("queue '%s' not found", queueName)
+	}
+	if _, ok := t.exchanges[exchange]; !ok {
+		t.exchanges[exchange] = map[string]bool{}
+	}
+	t.exchanges[exchange][queueName] = true
+	return nil
+}
+
+func (t *memoryTransport) Broadcast(exchange string, message *Message) error {
+	t.mutex.Lock()
+	if !t.connected {
+		t.mutex.Unlock()
+		return ErrNotConnected
+	}
+	queueNames := []string{}
+	for queueName := range t.exchanges[exchange] {
+		queueNames = append(queueNames, queueName)
+	}
+	t.mutex.Unlock()
+	for _, queueName := range queueNames {
+		// The queue may be gone already.
+		if err := t.Publish(queueName, message); err != nil && err != ErrUnroutable {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *memoryTransport) Consume(queueName string, options ConsumeOptions) (<-chan *Delivery, error) {
+	t.mutex.Lock()
+	if !t.connected {
+		t.mutex.Unlock()
+		return nil, ErrNotConnected
+	}
+	queue, ok := t.queues[queueName]
+	done := t.done
+	t.mutex.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("queue '%s' not found", queueName)
+	}
+	if err := queue.addConsumer(options.Exclusive); err != nil {
+		return nil, err
+	}
+	consumer := &memoryConsumer{queue: queue, stop: make(chan struct{})}
+	if options.Consumer != "" {
+		t.mutex.Lock()
+		t.consumers[options.Consumer] = consumer
+		t.mutex.Unlock()
+	}
+	// Unacked deliveries hold a slot until they get acked or rejected.
+	var slots chan struct{}
+	if !options.AutoAck && options.Prefetch > 0 {
+		slots = make(chan struct{}, options.Prefetch)
+	}
+	deliveries := make(chan *Delivery)
+	go func() {
+		defer close(deliveries)
+		defer queue.removeConsumer()
+		for {
+			if slots != nil {
+				select {
+				case slots <- struct{}{}:
+				case <-consumer.stop:
+					return
+				case <-done:
+					return
+				}
+			}
+			msg, ok := queue.pop(consumer)
+			if !ok {
+				return
+			}
+			delivery := &Delivery{
+				Message:     msg.message,
+				Redelivered: msg.redelivered,
+			}
+			if !options.AutoAck {
+				delivery.Acknowledger = &memoryAcknowledger{queue: queue, message: msg, slots: slots}
+			}
+			select {
+			case deliveries <- delivery:
+			case <-consumer.stop:
+				// Nobody got the message, it goes back to the queue.
+				queue.push(msg, true)
+				return
+			case <-done:
+				return
+			}
+		}
+	}()
+	return deliveries, nil
+}
+
+func (t *memoryTransport) Cancel(consumer string) error {
+	t.mutex.Lock()
+	c, ok := t.consumers[consumer]
+	delete(t.consumers, consumer)
+	t.mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("consumer '%s' not found", consumer)
+	}
+	close(c.stop)
+	// Wake up the consumer in case it is waiting for a message.
+	c.queue.cancel(c)
+	return nil
+}
+
+func (t *memoryTransport) Consumers(queueName string) (int, error) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !t.connected {
+		return 0, ErrNotConnected
+	}
+	queue, ok := t.queues[queueName]
+	if !ok {
+		return 0, fmt.Errorf("queue '%s' not found", queueName)
+	}
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+	return queue.consumers, nil
+}
+
+// Close will stop all the consumers and drop all the queues.
+func (t *memoryTransport) Close() error {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if !t.connected {
+		return nil
+	}
+	t.connected = false
+	close(t.done)
+	for _, queue := range t.queues {
+		queue.close()
+	}
+	t.queues = map[string]*memoryQueue{}
+	t.exchanges = map[string]map[string]bool{}
+	t.consumers = map[string]*memoryConsumer{}
+	for _, closed := range t.closed {
+		closed <- nil
+	}
+	t.closed = nil
+	return nil
+}
+
+func newMemoryQueue() *memoryQueue {
+	queue := &memoryQueue{}
+	queue.cond = sync.NewCond(&queue.mutex)
+	return queue
+}
+
+func (q *memoryQueue) addConsumer(exclusive bool) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.exclusive || (exclusive && q.consumers > 0) {
+		return errors.New("queue is being consumed exclusively")
+	}
+	q.consumers++
+	q.exclusive = exclusive
+	return nil
+}
+
+func (q *memoryQueue) removeConsumer() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.consumers--
+	q.exclusive = false
+}
+
+// Push a new message to the queue. Requeued messages go to the
+// front of the queue.
+func (q *memoryQueue) push(msg *memoryMessage, front bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if q.closed {
+		return
+	}
+	if front {
+		q.messages = append([]*memoryMessage{msg}, q.messages...)
+	} else {
+		q.messages = append(q.messages, msg)
+	}
+	q.cond.Signal()
+}
+
+// Pop blocks until there is a message available in the queue.
+// Expired messages are dropped along the way.
+// It will return false when the queue gets closed or
+// the consumer gets canceled.
+func (q *memoryQueue) pop(consumer *memoryConsumer) (*memoryMessage, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for {
+		for len(q.messages) == 0 && !q.closed && !consumer.canceled {
+			q.cond.Wait()
+		}
+		if q.closed || consumer.canceled {
+			return nil, false
+		}
+		msg := q.messages[0]
+		q.messages = q.messages[1:]
+		if !msg.expired() {
+			return msg, true
+		}
+	}
+}
+
+func (q *memoryQueue) cancel(consumer *memoryConsumer) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	consumer.canceled = true
+	q.cond.Broadcast()
+}
+
+func (q *memoryQueue) close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+type memoryAcknowledger struct {
+	queue   *memoryQueue
+	message *memoryMessage
+	slots   chan struct{}
+	once    sync.Once
+}
+
+func (a *memoryAcknowledger) Ack() error {
+	a.release()
+	return nil
+}
+
+func (a *memoryAcknowledger) Nack(requeue bool) error {
+	if requeue {
+		a.queue.push(&memoryMessage{
+			message:     a.message.message,
+			redelivered: true,
+			expires:     a.message.expires,
+		}, true)
+	}
+	a.release()
+	return nil
+}
+
+// Free the prefetch slot held by the delivery.
+func (a *memoryAcknowledger) release() {
+	a.once.Do(func() {
+		if a.slots != nil {
+			<-a.slots
+		}
+	})
+}
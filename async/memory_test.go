@@ -0,0 +1,154 @@
+package async
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryTransportNotConnected(t *testing.T) {
+	tr := NewMemoryTransport()
+	assert.Equal(t, ErrNotConnected, tr.DeclareQueue("test", QueueOptions{}))
+	assert.Equal(t, ErrNotConnected, tr.Publish("test", &Message{}))
+	_, err := tr.Consume("test", ConsumeOptions{})
+	assert.Equal(t, ErrNotConnected, err)
+	assert.Equal(t, ErrNotConnected, <-tr.NotifyClose())
+}
+
+func TestMemoryTransportPublishAndConsume(t *testing.T) {
+	tr := NewMemoryTransport()
+	tr.Connect()
+	defer tr.Close()
+	tr.DeclareQueue("test", QueueOptions{})
+	tr.Publish("test", &Message{Body: []byte("one"), Headers: map[string]interface{}{"version": "1"}})
+	tr.Publish("test", &Message{Body: []byte("two")})
+	msgs, err := tr.Consume("test", ConsumeOptions{AutoAck: true})
+	assert.NoError(t, err)
+	d := <-msgs
+	assert.Equal(t, "one", string(d.Body))
+	assert.Equal(t, "1", d.Headers["version"])
+	d = <-msgs
+	assert.Equal(t, "two", string(d.Body))
+}
+
+func TestMemoryTransportDeclareQueueWithOtherArgs(t *testing.T) {
+	tr := NewMemoryTransport()
+	tr.Connect()
+	defer tr.Close()
+	args := map[string]interface{}{"x-dead-letter-exchange": "dlx"}
+	assert.Nil(t, tr.DeclareQueue("test", QueueOptions{Args: args}))
+	assert.Nil(t, tr.DeclareQueue("test", QueueOptions{Args: args}))
+	assert.Equal(t, ErrPreconditionFailed, tr.DeclareQueue("test", QueueOptions{}))
+}
+
+func TestMemoryTransportPublishToUnknownQueue(t *testing.T) {
+	tr := NewMemoryTransport()
+	tr.Connect()
+	defer tr.Close()
+	assert.Equal(t, ErrUnroutable, tr.Publish("unknown", &Message{Body: []byte("test")}))
+}
+
+func TestMemoryTransportNackRequeue(t *testing.T) {
+	tr := NewMemoryTransport()
+	tr.Connect()
+	defer tr.Close()
+	tr.DeclareQueue("test", QueueOptions{})
+	tr.Publish("test", &Message{Body: []byte("one")})
+	msgs, _ := tr.Consume("test", ConsumeOptions{})
+	d := <-msgs
+	assert.False(t, d.Redelivered)
+	d.Nack(true)
+	d = <-msgs
+	assert.True(t, d.Redelivered)
+	assert.Equal(t, "one", string(d.Body))
+	assert.NoError(t, d.Ack())
+}
+
+func TestMemoryTransportConsumers(t *testing.T) {
+	tr := NewMemoryTransport()
+	tr.Connect()
+	defer tr.Close()
+	_, err := tr.Consumers("test")
+	assert.Error(t, err)
+	tr.DeclareQueue("test", QueueOptions{})
+	tr.Consume("test", ConsumeOptions{})
+	tr.Consume("test", ConsumeOptions{})
+	consumers, err := tr.Consumers("test")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, consumers)
+}
+
+func TestMemoryTransportExclusiveConsumer(t *testing.T) {
+	tr := NewMemoryTransport()
+	tr.Connect()
+	defer tr.Close()
+	tr.DeclareQueue("test", QueueOptions{})
+	_, err := tr.Consume("test", ConsumeOptions{Exclusive: true})
+	assert.NoError(t, err)
+	_, err = tr.Consume("test", ConsumeOptions{})
+	assert.Error(t, err)
+}
+
+func TestMemoryTransportClose(t *testing.T) {
+	tr := NewMemoryTransport()
+	tr.Connect()
+	closed := tr.NotifyClose()
+	tr.DeclareQueue("test", QueueOptions{})
+	msgs, _ := tr.Consume("test", ConsumeOptions{})
+	tr.Close()
+	assert.Nil(t, <-closed)
+	_, ok := <-msgs
+	assert.False(t, ok)
+}
+
+func TestMemoryTransportExpiration(t *testing.T) {
+	tr := NewMemoryTransport()
+	tr.Connect()
+	defer tr.Close()
+	tr.DeclareQueue("test", QueueOptions{})
+	tr.Publish("test", &Message{Body: []byte("one"), Expiration: time.Millisecond})
+	tr.Publish("test", &Message{Body: []byte("two"), Expiration: time.Minute})
+	time.Sleep(10 * time.Millisecond)
+	msgs, _ := tr.Consume("test", ConsumeOptions{AutoAck: true})
+	d := <-msgs
+	assert.Equal(t, "two", string(d.Body))
+}
+
+func TestMemoryTransportBroadcast(t *testing.T) {
+	tr := NewMemoryTransport()
+	tr.Connect()
+	defer tr.Close()
+	tr.DeclareQueue("one", QueueOptions{})
+	tr.DeclareQueue("two", QueueOptions{})
+	assert.NoError(t, tr.BindQueue("one", "exchange"))
+	assert.NoError(t, tr.BindQueue("two", "exchange"))
+	assert.Error(t, tr.BindQueue("unknown", "exchange"))
+	assert.NoError(t, tr.Broadcast("exchange", &Message{Body: []byte("test")}))
+	assert.NoError(t, tr.Broadcast("unknown", &Message{Body: []byte("test")}))
+	for _, name := range []string{"one", "two"} {
+		msgs, _ := tr.Consume(name, ConsumeOptions{AutoAck: true})
+		d := <-msgs
+		assert.Equal(t, "test", string(d.Body))
+	}
+}
+
+func TestMemoryTransportCancel(t *testing.T) {
+	tr := NewMemoryTransport()
+	tr.Connect()
+	defer tr.Close()
+	tr.DeclareQueue("test", QueueOptions{})
+	msgs, _ := tr.Consume("test", ConsumeOptions{Consumer: "consumer"})
+	tr.Publish("test", &Message{Body: []byte("one")})
+	d := <-msgs
+	assert.NoError(t, tr.Cancel("consumer"))
+	assert.Error(t, tr.Cancel("consumer"))
+	_, ok := <-msgs
+	assert.False(t, ok)
+	// Deliveries can still be acked once canceled.
+	assert.NoError(t, d.Ack())
+	tr.Publish("test", &Message{Body: []byte("two")})
+	msgs, _ = tr.Consume("test", ConsumeOptions{AutoAck: true})
+	d = <-msgs
+	assert.Equal(t, "two", string(d.Body))
+}
@@ -1,11 +1,11 @@
 package async
 
 import (
+	"context"
 	"fmt"
-	"sync"
+	"time"
 
-	"github.com/golang/protobuf/proto"
-	"github.com/streadway/amqp"
+	log "github.com/sirupsen/logrus"
 	"github.com/twinj/uuid"
 
 	"github.com/rgamba/postman/async/protobuf"
@@ -16,66 +16,95 @@ import (
 // ResponseMiddleware is the function that needs to be injected
 // from an outside module.
 // This will be passed a request and must respond a response.
-var ResponseMiddleware func(*protobuf.Request) (*protobuf.Response, error)
+// The context is done once the requester cancels the request
+// or the request deadline is reached.
+var ResponseMiddleware func(context.Context, *protobuf.Request) (*protobuf.Response, error)
 
-// All requests we send out to AMQP server will be stored here so we
-// can make a match when the message comes back.
-// The hash key will be the request ID and the value will be the queue
-// name where we need to send the response to.
-var requests = map[string]*requestRecord{}
-var mutex = &sync.Mutex{}
+// Headers sent along with the messages.
+const (
+	headerError         = "error"
+	headerErrorMessage  = "error_message"
+	headerRequestID     = "request_id"
+	headerResponseQueue = "response_queue"
+)
 
-type requestRecord struct {
-	request    *protobuf.Request
-	onResponse func(*protobuf.Response, *Error)
+// SendRequestMessage sends a new request message through
+// the broker to the appropriate
+func SendRequestMessage(serviceName string, request *protobuf.Request, onResponse func(*protobuf.Response, *Error)) {
+	SendRequestMessageWithDeadline(serviceName, request, time.Time{}, onResponse)
 }
 
-// SendRequestMessage sends a new request message through
-// the AMQP server to the appropriate
-func SendRequestMessage(ch *amqp.Channel, serviceName string, request *protobuf.Request, onResponse func(*protobuf.Response, *Error)) {
+// SendRequestMessageWithDeadline does the same as SendRequestMessage but
+// the request will be dropped, instead of processed, if it isn't picked up
+// by the destination service before the deadline. If there is no response
+// by the deadline, onResponse will get a timeout error.
+// A zero deadline means no deadline at all.
+func SendRequestMessageWithDeadline(serviceName string, request *protobuf.Request, deadline time.Time, onResponse func(*protobuf.Response, *Error)) {
+	sendRequestMessage(serviceName, request, deadline, &requestRecord{onResponse: onResponse})
+}
+
+// Send the request, the record gets the callbacks for the response.
+func sendRequestMessage(serviceName string, request *protobuf.Request, deadline time.Time, requestRecord *requestRecord) {
+	onResponse := requestRecord.onResponse
 	queueName := buildRequestQueueName(serviceName)
 	setRequestIDIfEmpty(request)
-	if !queueExists(ch, queueName) {
-		go onResponse(nil, createInvalidQueueNameError(queueName))
-		return
-	}
 	// Apply middleware
 	middleware.ProcessOutgoingRequestMiddlewares(request)
 	// Encode message.
-	message, _err := proto.Marshal(request)
+	version := getPeerVersion(serviceName)
+	message, _err := encodeRequest(request, version)
 	if _err != nil {
 		go onResponse(nil, createError("unexpected", _err.Error(), nil))
 		return
 	}
+	// Save the request in the request queue before sending it,
+	// the response could arrive before we get to save it otherwise.
+	requestRecord.serviceName = serviceName
+	requestRecord.request = request
+	requestRecord.deadline = deadline
+	if err := appendRequestRecord(requestRecord); err != nil {
+		go onResponse(nil, err)
+		return
+	}
 	// Send it!
-	err := publishMessage(ch, message, queueName)
+	headers := createRequestHeaders(request, version)
+	setDeadlineHeader(headers, deadline)
+	setAcceptStreamHeader(headers, requestRecord)
+	setTunnelHeader(headers, requestRecord)
+	message = compressMessage(message, headers, getPeerEncodings(serviceName))
+	err := publishRequestMessage(queueName, request.Id, message, headers, true)
 	if err != nil {
+		removeRequest(request.Id)
 		go onResponse(nil, err)
 		return
 	}
-	// Save the request in the request queue.
-	appendRequest(request, onResponse)
 	go stats.RecordRequest(serviceName, stats.Outgoing)
 }
 
 // SendMessageAndDiscardResponse does exactly the same as SendMessage but
 // it doesn't expect to get a response in any way.
-func SendMessageAndDiscardResponse(ch *amqp.Channel, serviceName string, request *protobuf.Request) *Error {
+func SendMessageAndDiscardResponse(serviceName string, request *protobuf.Request) *Error {
 	request.ResponseQueue = "" // No response queue when we don't need response.
 	queueName := buildRequestQueueName(serviceName)
 	setRequestIDIfEmpty(request)
-	if !queueExists(ch, queueName) {
-		return createInvalidQueueNameError(queueName)
-	}
 	// Apply middleware
 	middleware.ProcessOutgoingRequestMiddlewares(request)
 	// Encode message.
-	message, _err := proto.Marshal(request)
+	version := getPeerVersion(serviceName)
+	message, _err := encodeRequest(request, version)
 	if _err != nil {
 		return createError("unexpected", _err.Error(), nil)
 	}
-	// Send it!
-	err := publishMessage(ch, message, queueName)
+	// Send it! With the outbox enabled, the request is safe
+	// once it is on disk, even if the broker can't take it yet.
+	headers := createRequestHeaders(request, version)
+	message = compressMessage(message, headers, getPeerEncodings(serviceName))
+	var err *Error
+	if isOutboxEnabled() {
+		err = publishThroughOutbox(queueName, request.Id, version, message, getHeaderString(headers, headerContentEncoding))
+	} else {
+		err = publishRequestMessage(queueName, request.Id, message, headers, false)
+	}
 	if err != nil {
 		return err
 	}
@@ -89,6 +118,20 @@ func buildRequestQueueName(serviceName string) string {
 	return fmt.Sprintf("postman.req.%s", serviceName)
 }
 
+// The request id and response queue are sent as headers too, that way
+// we are able to send an error message back even if the receiver is
+// unable to decode the message.
+func createRequestHeaders(request *protobuf.Request, version int) map[string]interface{} {
+	headers := map[string]interface{}{
+		headerVersion:   int32(version),
+		headerRequestID: request.Id,
+	}
+	if request.ResponseQueue != "" {
+		headers[headerResponseQueue] = request.ResponseQueue
+	}
+	return headers
+}
+
 func setRequestIDIfEmpty(request *protobuf.Request) {
 	if request.Id == "" {
 		uniqid := uuid.NewV4()
@@ -100,12 +143,43 @@ func setRequestIDIfEmpty(request *protobuf.Request) {
 // out of the response queue. That's when the other end service
 // processed our request and sent a response. We will try and match
 // the response to the original request and execute the callback function.
-func processMessageResponse(msg []byte) error {
-	response := &protobuf.Response{}
-	if err := proto.Unmarshal(msg, response); err != nil {
+func processMessageResponse(msg *Message) error {
+	// Control messages are broadcasted to the response
+	// queues of all the instances of the service.
+	if _, ok := msg.Headers[headerControl]; ok {
+		return processControlMessage(msg)
+	}
+	// Chunks of a streamed response.
+	if _, ok := msg.Headers[headerStreamSeq]; ok {
+		return processStreamChunk(msg)
+	}
+	// Error messages have no payload, the error
+	// code comes in the message headers.
+	if code := getHeaderString(msg.Headers, headerError); code != "" {
+		requestID := getHeaderString(msg.Headers, headerRequestID)
+		updatePeerVersion(requestID, msg)
+		updatePeerEncodings(requestID, msg)
+		err := createError(code, getHeaderString(msg.Headers, headerErrorMessage), nil)
+		return matchErrorAndSendCallback(requestID, err)
+	}
+	if err := decompressMessage(msg); err != nil {
 		return err
 	}
+	response, err := decodeResponse(msg.Body, getMessageVersion(msg))
+	if err != nil {
+		return err
+	}
+	updatePeerVersion(response.RequestId, msg)
+	updatePeerEncodings(response.RequestId, msg)
 	middleware.ProcessOutgoingResponseMiddlewares(response)
+	// The head of a streamed response, the body comes in chunks.
+	if queue := getHeaderString(msg.Headers, headerStream); queue != "" {
+		return matchStreamAndSendCallback(response, queue)
+	}
+	// The responder opened a tunnel along with the response.
+	if queue := getHeaderString(msg.Headers, headerTunnel); queue != "" {
+		return matchTunnelAndSendCallback(response, queue)
+	}
 	return matchResponseAndSendCallback(response)
 }
 
@@ -113,21 +187,77 @@ func processMessageResponse(msg []byte) error {
 // and our service instance gets to process it.
 // We rely on ResponseMiddleware being injected with the appropriate logic
 // to process the request and get a response.
-func processMessageRequest(msg []byte) error {
-	request := &protobuf.Request{}
-	if err := proto.Unmarshal(msg, request); err != nil {
-		return err
+func processMessageRequest(msg *Message) error {
+	// Nobody is waiting for the response anymore.
+	if isMessageExpired(msg) {
+		log.WithFields(log.Fields{
+			"request_id": getHeaderString(msg.Headers, headerRequestID),
+		}).Warn("Dropping expired request")
+		return nil
+	}
+	if !isSupportedVersion(msg) {
+		return requeueInvalidVersion(msg)
+	}
+	version := getMessageVersion(msg)
+	// The response is compressed only if the requester is able to decode it.
+	acceptedEncodings := getHeaderString(msg.Headers, headerAcceptEncoding)
+	err := decompressMessage(msg)
+	var request *protobuf.Request
+	if err == nil {
+		request, err = decodeRequest(msg.Body, version)
+	}
+	if err != nil {
+		sendErrorMessage(
+			getHeaderString(msg.Headers, headerResponseQueue),
+			getHeaderString(msg.Headers, headerRequestID),
+			createError(ErrorCodeInvalidFormat, err.Error(), nil),
+		)
+		return newRequestError(ErrorCodeInvalidFormat, err)
+	}
+
+	// Let the local service know how much time it has left.
+	deadline, hasDeadline := getMessageDeadline(msg)
+	if hasDeadline {
+		setRequestTimeoutHeader(request, deadline)
 	}
 
+	// The requester may have canceled the request while it was queued.
+	ctx, done, ok := startRequest(request.Id, deadline)
+	if !ok {
+		log.WithFields(log.Fields{
+			"request_id": request.Id,
+		}).Warn("Skipping canceled request")
+		return nil
+	}
+	defer done()
+	if msg.ackHooks != nil {
+		ctx = context.WithValue(ctx, ackHooksKey{}, msg.ackHooks)
+	}
+	ctx = withStreamState(ctx, msg, request, version, acceptedEncodings)
+	ctx = withTunnelState(ctx, msg, request, version, acceptedEncodings)
+
 	// Apply middleware
 	middleware.ProcessIncomingRequestMiddlewares(request)
 
 	var response *protobuf.Response
 	if ResponseMiddleware != nil {
-		var err error
-		response, err = ResponseMiddleware(request)
+		response, err = ResponseMiddleware(ctx, request)
+		// The response, or the error, was sent along with the stream
+		// or the tunnel.
+		if IsResponseStreamed(ctx) || IsTunnelOpened(ctx) {
+			return nil
+		}
 		if err != nil {
-			return err
+			// Nobody is waiting for the response anymore.
+			if ctx.Err() == context.Canceled {
+				log.WithFields(log.Fields{
+					"request_id": request.Id,
+				}).Warn("Request canceled by the requester")
+				return nil
+			}
+			asyncErr := convertToError(err)
+			sendErrorMessage(request.ResponseQueue, request.Id, asyncErr)
+			return newRequestError(asyncErr.Code, err)
 		}
 	} else {
 		response = &protobuf.Response{StatusCode: 501, RequestId: request.Id}
@@ -139,75 +269,115 @@ func processMessageRequest(msg []byte) error {
 	// We'll send a response only if we have a response queue name
 	// if we don't have a queue, then it means we don't need to send a response back.
 	if request.ResponseQueue != "" {
-		err := sendResponseMessage(request, response)
-		return err
+		return sendResponseMessage(request, response, version, acceptedEncodings)
 	}
 	return nil
 }
 
 // When we're done processing the message and we already got a Response object
 // we just marshall and send the message through the appropriate response queue.
-func sendResponseMessage(request *protobuf.Request, response *protobuf.Response) error {
-	// TODO: should we reuse a channel or create a new one?
-	ch, _err := CreateNewChannel()
-	if _err != nil {
-		return _err
-	}
-	defer ch.Close()
+// The response is encoded using the same message version as the request, that's
+// the version we know the requester is able to process.
+// It is compressed using one of the encodings the requester accepts.
+func sendResponseMessage(request *protobuf.Request, response *protobuf.Response, version int, acceptedEncodings string) error {
 	// Encode response struct.
-	message, err := proto.Marshal(response)
+	message, err := encodeResponse(response, version)
 	if err != nil {
 		return err
 	}
 	// Send through the response queue.
-	_err = publishMessage(ch, message, request.ResponseQueue)
+	headers := map[string]interface{}{
+		headerVersion:    int32(version),
+		headerMaxVersion: int32(MessageVersion),
+		headerRequestID:  request.Id,
+	}
+	message = compressMessage(message, headers, acceptedEncodings)
+	_err := publishMessage(message, headers, request.ResponseQueue)
 	if _err != nil {
 		return _err
 	}
 	return nil
 }
 
+// Send an error message with no payload through the response queue.
+// If there is no response queue, the requester doesn't expect a
+// response so we won't send anything.
+func sendErrorMessage(responseQueue string, requestID string, err *Error) error {
+	if responseQueue == "" {
+		return nil
+	}
+	headers := map[string]interface{}{
+		headerError:        err.Code,
+		headerErrorMessage: err.Message,
+		headerRequestID:    requestID,
+		headerMaxVersion:   int32(MessageVersion),
+	}
+	if _err := publishMessage(nil, headers, responseQueue); _err != nil {
+		return _err
+	}
+	return nil
+}
+
+// Errors returned by the ResponseMiddleware are expected to be
+// *Error, any other error will be treated as an upstream error.
+func convertToError(err error) *Error {
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+	return createError(ErrorCodeUpstreamError, err.Error(), nil)
+}
+
+// Get a header value as a string.
+func getHeaderString(headers map[string]interface{}, name string) string {
+	switch value := headers[name].(type) {
+	case string:
+		return value
+	case []byte:
+		return string(value)
+	}
+	return ""
+}
+
 // Try to match the response back to the original request that we issued.
 // If a match is found (normally this will be the case), we'll call the callback
 // function that was passed along with the original request.
+// Responses to requests that already timed out or were canceled won't
+// find a match, those are counted as late responses.
 func matchResponseAndSendCallback(response *protobuf.Response) error {
-	requestRecord := getResponseRequest(response.RequestId)
+	requestRecord := takeRequest(response.RequestId)
 	if requestRecord == nil {
+		go stats.RecordLateResponse()
 		return fmt.Errorf("Unable to find matching request for '%s'", response.RequestId)
 	}
 	requestRecord.onResponse(response, nil)
-	removeRequest(response.RequestId)
 	return nil
 }
 
-// Append a new request to the requests queue.
-func appendRequest(request *protobuf.Request, onResponse func(*protobuf.Response, *Error)) {
-	req := &requestRecord{
-		request:    request,
-		onResponse: onResponse,
+// Responders let us know the highest message version they are able to
+// process, from now on we'll use that version to talk to that service.
+// If the service was unable to process the message version we'll
+// go back to version 1.
+func updatePeerVersion(requestID string, msg *Message) {
+	requestRecord := getResponseRequest(requestID)
+	if requestRecord == nil {
+		return
+	}
+	if getHeaderString(msg.Headers, headerError) == ErrorCodeInvalidVersion {
+		setPeerVersion(requestRecord.serviceName, 1)
+		return
+	}
+	if _, ok := msg.Headers[headerMaxVersion]; ok {
+		setPeerVersion(requestRecord.serviceName, getHeaderInt(msg.Headers, headerMaxVersion))
 	}
-	mutex.Lock()
-	requests[req.request.Id] = req
-	mutex.Unlock()
-}
-
-// Remove a request from the requests queue.
-// This is a thread-safe operation.
-func removeRequest(requestID string) {
-	mutex.Lock()
-	delete(requests, requestID)
-	mutex.Unlock()
 }
 
-// Try to find the request on the requests queue
-// given the requestID.
-// This is a thread-safe operation.
-func getResponseRequest(requestID string) *requestRecord {
-	mutex.Lock()
-	val, ok := requests[requestID]
-	mutex.Unlock()
-	if !ok {
-		return nil
+// Same as matchResponseAndSendCallback but for error messages.
+func matchErrorAndSendCallback(requestID string, err *Error) error {
+	requestRecord := takeRequest(requestID)
+	if requestRecord == nil {
+		go stats.RecordLateResponse()
+		return fmt.Errorf("Unable to find matching request for '%s'", requestID)
 	}
-	return val
+	requestRecord.onResponse(nil, err)
+	return nil
 }
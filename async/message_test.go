@@ -0,0 +1,304 @@
+package async
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/rgamba/postman/async/protobuf"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSendMessage(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	_createQueue("postman.req.service1")
+	_consumeQueue("postman.req.service1", func(msg []byte) {
+		req := &protobuf.Request{}
+		proto.Unmarshal(msg, req)
+		response := &protobuf.Response{Body: []byte("testresponse"), RequestId: req.Id}
+		respMsg, _ := proto.Marshal(response)
+		_publishMessage(respMsg, req.ResponseQueue)
+	})
+	c := make(chan bool)
+	req := &protobuf.Request{Body: []byte("test"), Method: "GET", ResponseQueue: ResponseQueueName}
+	SendRequestMessage("service1", req, func(resp *protobuf.Response, err *Error) {
+		assert.Nil(t, err)
+		assert.Equal(t, "testresponse", string(resp.Body))
+		c <- true
+	})
+	<-c
+}
+
+func TestSendMessageToUnknownService(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	c := make(chan *Error)
+	req := &protobuf.Request{Method: "GET", ResponseQueue: ResponseQueueName}
+	SendRequestMessage("unknown", req, func(resp *protobuf.Response, err *Error) {
+		c <- err
+	})
+	err := <-c
+	if assert.NotNil(t, err) {
+		assert.Equal(t, "queue_not_found", err.Code)
+	}
+	assert.Nil(t, getResponseRequest(req.Id))
+}
+
+func TestSendMessageParallelCalls(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	_createQueue("postman.req.service1")
+	_consumeQueue("postman.req.service1", func(msg []byte) {
+		req := &protobuf.Request{}
+		proto.Unmarshal(msg, req)
+		response := &protobuf.Response{Body: req.Body, RequestId: req.Id}
+		respMsg, _ := proto.Marshal(response)
+		_publishMessage(respMsg, req.ResponseQueue)
+	})
+	var wait sync.WaitGroup
+	for i := 0; i <= 100; i++ {
+		wait.Add(1)
+		go func(i int) {
+			req := &protobuf.Request{Body: []byte(fmt.Sprintf("%d", i)), Method: "GET", ResponseQueue: ResponseQueueName}
+			SendRequestMessage("service1", req, func(resp *protobuf.Response, err *Error) {
+				expectedBody := fmt.Sprintf("%d", i)
+				assert.Nil(t, err)
+				assert.Equal(t, expectedBody, string(resp.Body))
+				wait.Done()
+			})
+		}(i)
+	}
+	wait.Wait()
+}
+
+func TestSendMessageWhenQueueDoesntExist(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	c := make(chan bool)
+	req := &protobuf.Request{Body: []byte("test"), Method: "GET", ResponseQueue: ResponseQueueName}
+	SendRequestMessage("service1", req, func(resp *protobuf.Response, err *Error) {
+		assert.NotNil(t, err)
+		c <- true
+	})
+	<-c
+}
+
+func TestSendMessageWhenClosedConnection(t *testing.T) {
+	_connect()
+	_close_connection()
+	c := make(chan bool)
+	req := &protobuf.Request{Body: []byte("test"), Method: "GET", ResponseQueue: ResponseQueueName}
+	SendRequestMessage("service1", req, func(resp *protobuf.Response, err *Error) {
+		assert.NotNil(t, err)
+		c <- true
+	})
+	<-c
+}
+
+func TestSendMessageAndDiscardResponse(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	_createQueue("postman.req.service1")
+	req := &protobuf.Request{Body: []byte("test"), Method: "GET", ResponseQueue: "responsequeue"}
+	err := SendMessageAndDiscardResponse("service1", req)
+	assert.Nil(t, err)
+	assert.Equal(t, "", req.ResponseQueue)
+}
+
+func TestProcessMessageRequest(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	defer func() {
+		ResponseMiddleware = nil
+	}()
+	ResponseMiddleware = func(ctx context.Context, req *protobuf.Request) (*protobuf.Response, error) {
+		return &protobuf.Response{StatusCode: 200, Body: req.Body, RequestId: req.Id}, nil
+	}
+	c := make(chan bool)
+	req := &protobuf.Request{Body: []byte("echo"), Method: "GET", ResponseQueue: ResponseQueueName}
+	SendRequestMessage("test-service", req, func(resp *protobuf.Response, err *Error) {
+		assert.Nil(t, err)
+		assert.Equal(t, int32(200), resp.StatusCode)
+		assert.Equal(t, "echo", string(resp.Body))
+		c <- true
+	})
+	<-c
+}
+
+func TestProcessMessageRequestConcurrently(t *testing.T) {
+	SetConcurrency(2, 0)
+	defer SetConcurrency(1, 0)
+	_connect()
+	defer _close_connection()
+	defer func() {
+		ResponseMiddleware = nil
+	}()
+	started := make(chan bool)
+	release := make(chan bool)
+	ResponseMiddleware = func(ctx context.Context, req *protobuf.Request) (*protobuf.Response, error) {
+		started <- true
+		<-release
+		return &protobuf.Response{StatusCode: 200, RequestId: req.Id}, nil
+	}
+	var wait sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wait.Add(1)
+		req := &protobuf.Request{Method: "GET", ResponseQueue: ResponseQueueName}
+		SendRequestMessage("test-service", req, func(resp *protobuf.Response, err *Error) {
+			assert.Nil(t, err)
+			wait.Done()
+		})
+	}
+	// Both requests must be in flight at the same time.
+	<-started
+	<-started
+	close(release)
+	wait.Wait()
+}
+
+func TestProcessMessageRequestError(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	defer func() {
+		ResponseMiddleware = nil
+	}()
+	ResponseMiddleware = func(ctx context.Context, req *protobuf.Request) (*protobuf.Response, error) {
+		return nil, NewError(ErrorCodeUpstreamUnavailable, "connection refused", nil)
+	}
+	c := make(chan bool)
+	req := &protobuf.Request{Method: "GET", ResponseQueue: ResponseQueueName}
+	SendRequestMessage("test-service", req, func(resp *protobuf.Response, err *Error) {
+		assert.Nil(t, resp)
+		if assert.NotNil(t, err) {
+			assert.Equal(t, ErrorCodeUpstreamUnavailable, err.Code)
+			assert.Equal(t, "connection refused", err.Message)
+		}
+		c <- true
+	})
+	<-c
+}
+
+func TestProcessMessageRequestUnknownError(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	defer func() {
+		ResponseMiddleware = nil
+	}()
+	ResponseMiddleware = func(ctx context.Context, req *protobuf.Request) (*protobuf.Response, error) {
+		return nil, fmt.Errorf("unknown")
+	}
+	c := make(chan bool)
+	req := &protobuf.Request{Method: "GET", ResponseQueue: ResponseQueueName}
+	SendRequestMessage("test-service", req, func(resp *protobuf.Response, err *Error) {
+		if assert.NotNil(t, err) {
+			assert.Equal(t, ErrorCodeUpstreamError, err.Code)
+		}
+		c <- true
+	})
+	<-c
+}
+
+func TestProcessMessageRequestInvalidFormat(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	c := make(chan bool)
+	_appendRequest("test-service", &protobuf.Request{Id: "invalid-format"}, time.Time{}, func(resp *protobuf.Response, err *Error) {
+		if assert.NotNil(t, err) {
+			assert.Equal(t, ErrorCodeInvalidFormat, err.Code)
+		}
+		c <- true
+	})
+	transport.Publish(getRequestQueueName(), &Message{
+		Body: []byte("invalid message"),
+		Headers: map[string]interface{}{
+			headerRequestID:     "invalid-format",
+			headerResponseQueue: ResponseQueueName,
+		},
+	})
+	<-c
+}
+
+func TestPublishedMessagesIncludeVersion(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	_createQueue("postman.req.service1")
+	msgs, _ := transport.Consume("postman.req.service1", ConsumeOptions{AutoAck: true})
+	req := &protobuf.Request{Method: "GET"}
+	SendMessageAndDiscardResponse("service1", req)
+	d := <-msgs
+	assert.Equal(t, getPeerVersion("service1"), getMessageVersion(&d.Message))
+	assert.Equal(t, req.Id, getHeaderString(d.Headers, headerRequestID))
+}
+
+func TestProcessMessageRequestWithoutVersion(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	c := make(chan bool)
+	req := &protobuf.Request{Id: "without-version", ResponseQueue: ResponseQueueName}
+	_appendRequest("test-service", req, time.Time{}, func(resp *protobuf.Response, err *Error) {
+		assert.Nil(t, err)
+		assert.Equal(t, int32(501), resp.StatusCode)
+		c <- true
+	})
+	msg, _ := proto.Marshal(req)
+	transport.Publish(getRequestQueueName(), &Message{Body: msg})
+	<-c
+}
+
+func TestProcessMessageRequestInvalidVersion(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	c := make(chan bool)
+	req := &protobuf.Request{Id: "invalid-version", ResponseQueue: ResponseQueueName}
+	_appendRequest("test-service", req, time.Time{}, func(resp *protobuf.Response, err *Error) {
+		if assert.NotNil(t, err) {
+			assert.Equal(t, ErrorCodeInvalidVersion, err.Code)
+		}
+		c <- true
+	})
+	msg, _ := proto.Marshal(req)
+	headers := createRequestHeaders(req, 1)
+	headers[headerVersion] = int32(99)
+	transport.Publish(getRequestQueueName(), &Message{Body: msg, Headers: headers})
+	<-c
+}
+
+func TestRequeueInvalidVersion(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	_createQueue("postman.req.service1")
+	ServiceName = "service1"
+	defer func() {
+		ServiceName = "test-service"
+	}()
+	msgs, _ := transport.Consume("postman.req.service1", ConsumeOptions{AutoAck: true})
+	msg := &Message{Body: []byte("test"), Headers: map[string]interface{}{headerVersion: int32(99)}}
+	assert.NoError(t, requeueInvalidVersion(msg))
+	d := <-msgs
+	assert.Equal(t, 1, getHeaderInt(d.Headers, headerRetry))
+	assert.Equal(t, 99, getMessageVersion(&d.Message))
+	assert.Equal(t, "test", string(d.Body))
+	// The original message must be left untouched.
+	assert.Equal(t, 0, getHeaderInt(msg.Headers, headerRetry))
+}
+
+func TestGetHeaderInt(t *testing.T) {
+	headers := map[string]interface{}{
+		"int":     1,
+		"int32":   int32(2),
+		"int64":   int64(3),
+		"string":  "4",
+		"invalid": "invalid",
+	}
+	assert.Equal(t, 1, getHeaderInt(headers, "int"))
+	assert.Equal(t, 2, getHeaderInt(headers, "int32"))
+	assert.Equal(t, 3, getHeaderInt(headers, "int64"))
+	assert.Equal(t, 4, getHeaderInt(headers, "string"))
+	assert.Equal(t, 0, getHeaderInt(headers, "invalid"))
+	assert.Equal(t, 0, getHeaderInt(headers, "missing"))
+}
@@ -0,0 +1,336 @@
+package async
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// The outbox keeps the requests that discard the response on disk until
+// the broker confirms them. The caller gets its response as soon as the
+// request is on disk, the request is sent later on if the broker can't
+// take it right away.
+var (
+	outboxMutex = &sync.Mutex{}
+	// Directory where the outbox entries are stored, empty when disabled.
+	outboxDir string
+	// Entries being sent at the moment, the replay must leave them alone.
+	outboxSending = map[string]bool{}
+	// Only one replay runs at a time.
+	replayMutex = &sync.Mutex{}
+	// Replays started once connected, Close waits for them. No replay
+	// is started once Close begins, that's when outboxClosing is set.
+	outboxReplays      sync.WaitGroup
+	outboxReplaysMutex = &sync.Mutex{}
+	outboxClosing      bool
+	// Set while a replay is scheduled after a failed publish.
+	outboxRetryScheduled bool
+	// Time to wait before replaying the outbox again when the
+	// broker fails to take a request and the connection stays up.
+	outboxRetryInterval = 5 * time.Second
+)
+
+const outboxExtension = ".json"
+
+// Replay the outbox in the background, unless the connection is being closed.
+func startOutboxReplay() {
+	outboxReplaysMutex.Lock()
+	defer outboxReplaysMutex.Unlock()
+	if outboxClosing {
+		return
+	}
+	outboxReplays.Add(1)
+	go func() {
+		defer outboxReplays.Done()
+		replayOutbox()
+	}()
+}
+
+// Replay the outbox again in a while. Without it, requests the broker
+// failed to take while we are connected would wait until we reconnect.
+func scheduleOutboxReplay() {
+	outboxReplaysMutex.Lock()
+	defer outboxReplaysMutex.Unlock()
+	if outboxClosing || outboxRetryScheduled {
+		return
+	}
+	outboxRetryScheduled = true
+	time.AfterFunc(outboxRetryInterval, func() {
+		outboxReplaysMutex.Lock()
+		outboxRetryScheduled = false
+		outboxReplaysMutex.Unlock()
+		// Otherwise the replay starts once we connect again.
+		if GetConnectionState() == ConnectionConnected {
+			startOutboxReplay()
+		}
+	})
+}
+
+// Wait for the running replays, no new ones are started until we connect again.
+// The replay stops as soon as it fails to publish.
+func waitForOutboxReplays() {
+	outboxReplaysMutex.Lock()
+	outboxClosing = true
+	outboxReplaysMutex.Unlock()
+	outboxReplays.Wait()
+}
+
+func resumeOutboxReplays() {
+	outboxReplaysMutex.Lock()
+	outboxClosing = false
+	outboxReplaysMutex.Unlock()
+}
+
+// A request waiting to be confirmed by the broker.
+type outboxEntry struct {
+	Queue     string `json:"queue"`
+	RequestID string `json:"request_id"`
+	Version   int    `json:"version"`
+	Encoding  string `json:"encoding,omitempty"`
+	Body      []byte `json:"body"`
+}
+
+// SetOutbox enables the outbox for the requests that discard the
+// response, entries are stored in the given directory. Entries left
+// from a previous run are sent once we connect to the broker.
+// An empty dir disables the outbox.
+func SetOutbox(dir string) error {
+	if dir != "" {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		// Entries that didn't make it to disk completely.
+		tmpFiles, _ := filepath.Glob(filepath.Join(dir, ".tmp-*"))
+		for _, file := range tmpFiles {
+			os.Remove(file)
+		}
+	}
+	outboxMutex.Lock()
+	defer outboxMutex.Unlock()
+	outboxDir = dir
+	return nil
+}
+
+// CountOutboxMessages returns the number of requests in
+// the outbox waiting to be confirmed by the broker.
+func CountOutboxMessages() int {
+	names, _ := listOutboxEntries()
+	return len(names)
+}
+
+func isOutboxEnabled() bool {
+	outboxMutex.Lock()
+	defer outboxMutex.Unlock()
+	return outboxDir != ""
+}
+
+// Save the request in the outbox before trying to send it. The request
+// stays in the outbox if the broker is down or doesn't confirm it.
+func publishThroughOutbox(queueName string, requestID string, version int, message []byte, encoding string) *Error {
+	entry := &outboxEntry{
+		Queue:     queueName,
+		RequestID: requestID,
+		Version:   version,
+		Encoding:  encoding,
+		Body:      message,
+	}
+	name, err := writeOutboxEntry(entry)
+	if err != nil {
+		return createError("unexpected", fmt.Sprintf("Unable to save the request in the outbox: %s", err), nil)
+	}
+	defer releaseOutboxEntry(name)
+	if GetConnectionState() != ConnectionConnected {
+		return nil
+	}
+	publishErr := publishOutboxEntry(name, entry)
+	if publishErr != nil && publishErr.Code != ErrorCodeQueueNotFound {
+		log.WithFields(log.Fields{
+			"error":      publishErr,
+			"request_id": requestID,
+		}).Warn("Request kept in the outbox")
+		scheduleOutboxReplay()
+		return nil
+	}
+	return publishErr
+}
+
+// Send the entry and remove it from the outbox once the broker confirms it.
+// Entries for a queue that doesn't exist are dropped, they would never
+// get to it.
+func publishOutboxEntry(name string, entry *outboxEntry) *Error {
+	headers := map[string]interface{}{
+		headerVersion:   int32(entry.Version),
+		headerRequestID: entry.RequestID,
+	}
+	if entry.Encoding != "" {
+		headers[headerContentEncoding] = entry.Encoding
+	}
+	err := publishMessage(entry.Body, headers, entry.Queue)
+	if err == nil || err.Code == ErrorCodeQueueNotFound {
+		if removeErr := os.Remove(filepath.Join(getOutboxDir(), name)); removeErr != nil {
+			log.WithFields(log.Fields{
+				"error": removeErr,
+				"entry": name,
+			}).Error("Unable to remove the entry from the outbox")
+		}
+	}
+	return err
+}
+
+// Send every request left in the outbox, in the order they were saved.
+// We stop as soon as the broker fails to take one of them.
+func replayOutbox() {
+	if !isOutboxEnabled() {
+		return
+	}
+	replayMutex.Lock()
+	defer replayMutex.Unlock()
+	names, err := listOutboxEntries()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+		}).Error("Unable to read the outbox")
+		return
+	}
+	for _, name := range names {
+		if !acquireOutboxEntry(name) {
+			continue
+		}
+		entry, err := readOutboxEntry(name)
+		if err != nil {
+			releaseOutboxEntry(name)
+			log.WithFields(log.Fields{
+				"error": err,
+				"entry": name,
+			}).Error("Unable to read the outbox entry")
+			continue
+		}
+		publishErr := publishOutboxEntry(name, entry)
+		releaseOutboxEntry(name)
+		if publishErr == nil {
+			continue
+		}
+		if publishErr.Code == ErrorCodeQueueNotFound {
+			log.WithFields(log.Fields{
+				"error":      publishErr,
+				"request_id": entry.RequestID,
+			}).Warn("Dropping request from the outbox")
+			continue
+		}
+		log.WithFields(log.Fields{
+			"error": publishErr,
+		}).Warn("Unable to replay the outbox")
+		scheduleOutboxReplay()
+		return
+	}
+}
+
+// Write the entry to a temp file first, that way a crash can't
+// leave a half written entry in the outbox.
+func writeOutboxEntry(entry *outboxEntry) (string, error) {
+	dir := getOutboxDir()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return "", err
+	}
+	file, err := ioutil.TempFile(dir, ".tmp-")
+	if err != nil {
+		return "", err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	// Names sort in the order the entries were saved.
+	name := fmt.Sprintf("%020d-%s%s", time.Now().UnixNano(), entry.RequestID, outboxExtension)
+	outboxMutex.Lock()
+	outboxSending[name] = true
+	outboxMutex.Unlock()
+	if err := os.Rename(file.Name(), filepath.Join(dir, name)); err != nil {
+		releaseOutboxEntry(name)
+		os.Remove(file.Name())
+		return "", err
+	}
+	syncDir(dir)
+	return name, nil
+}
+
+func readOutboxEntry(name string) (*outboxEntry, error) {
+	data, err := ioutil.ReadFile(filepath.Join(getOutboxDir(), name))
+	if err != nil {
+		return nil, err
+	}
+	entry := &outboxEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// Get the names of the entries in the outbox, oldest first.
+func listOutboxEntries() ([]string, error) {
+	dir := getOutboxDir()
+	if dir == "" {
+		return nil, nil
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, file := range files {
+		if !file.IsDir() && strings.HasSuffix(file.Name(), outboxExtension) {
+			names = append(names, file.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Mark the entry as being sent, false if someone else is sending it.
+func acquireOutboxEntry(name string) bool {
+	outboxMutex.Lock()
+	defer outboxMutex.Unlock()
+	if outboxSending[name] {
+		return false
+	}
+	outboxSending[name] = true
+	return true
+}
+
+func releaseOutboxEntry(name string) {
+	outboxMutex.Lock()
+	defer outboxMutex.Unlock()
+	delete(outboxSending, name)
+}
+
+func getOutboxDir() string {
+	outboxMutex.Lock()
+	defer outboxMutex.Unlock()
+	return outboxDir
+}
+
+// Make the rename durable.
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
@@ -0,0 +1,191 @@
+package async
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rgamba/postman/async/protobuf"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOutboxSendsRequest(t *testing.T) {
+	dir := _enableOutbox(t)
+	defer _disableOutbox(dir)
+	received := _receiveRequests()
+	defer func() {
+		ResponseMiddleware = nil
+	}()
+	_connect()
+	defer _close_connection()
+	err := SendMessageAndDiscardResponse("test-service", &protobuf.Request{Id: "outbox-1"})
+	assert.Nil(t, err)
+	assert.Equal(t, "outbox-1", _waitForRequest(t, received))
+	assert.Equal(t, 0, CountOutboxMessages())
+}
+
+func TestOutboxKeepsRequestWhileBrokerIsDown(t *testing.T) {
+	dir := _enableOutbox(t)
+	defer _disableOutbox(dir)
+	received := _receiveRequests()
+	defer func() {
+		ResponseMiddleware = nil
+	}()
+	_connect()
+	defer _close_connection()
+	setConnectionState(ConnectionReconnecting)
+	err := SendMessageAndDiscardResponse("test-service", &protobuf.Request{Id: "outbox-2"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, CountOutboxMessages())
+	setConnectionState(ConnectionConnected)
+	replayOutbox()
+	assert.Equal(t, "outbox-2", _waitForRequest(t, received))
+	assert.Equal(t, 0, CountOutboxMessages())
+}
+
+func TestOutboxReplayOnStartup(t *testing.T) {
+	dir := _enableOutbox(t)
+	defer _disableOutbox(dir)
+	_, err := writeOutboxEntry(&outboxEntry{
+		Queue:     buildRequestQueueName("test-service"),
+		RequestID: "outbox-3",
+		Version:   MessageVersion,
+		Body:      _encodeTestRequest(t, &protobuf.Request{Id: "outbox-3"}),
+	})
+	assert.Nil(t, err)
+	releaseOutboxEntry(_outboxEntryNames(t)[0])
+	received := _receiveRequests()
+	defer func() {
+		ResponseMiddleware = nil
+	}()
+	_connect()
+	defer _close_connection()
+	assert.Equal(t, "outbox-3", _waitForRequest(t, received))
+	for i := 0; i < 100 && CountOutboxMessages() > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, 0, CountOutboxMessages())
+}
+
+func TestOutboxRetriesWhileConnected(t *testing.T) {
+	dir := _enableOutbox(t)
+	defer _disableOutbox(dir)
+	defer func(interval time.Duration) {
+		outboxRetryInterval = interval
+	}(outboxRetryInterval)
+	outboxRetryInterval = 10 * time.Millisecond
+	received := _receiveRequests()
+	defer func() {
+		ResponseMiddleware = nil
+	}()
+	ConnectTransport(&_failingTransport{Transport: NewMemoryTransport(), queue: buildRequestQueueName("test-service"), failures: 2}, "test-service")
+	defer _close_connection()
+	err := SendMessageAndDiscardResponse("test-service", &protobuf.Request{Id: "outbox-4"})
+	assert.Nil(t, err)
+	// The request and the first replay fail, the next replay
+	// sends it without reconnecting.
+	assert.Equal(t, "outbox-4", _waitForRequest(t, received))
+	for i := 0; i < 100 && CountOutboxMessages() > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, 0, CountOutboxMessages())
+	assert.Equal(t, ConnectionConnected, GetConnectionState())
+}
+
+func TestOutboxUnknownQueue(t *testing.T) {
+	dir := _enableOutbox(t)
+	defer _disableOutbox(dir)
+	_connect()
+	defer _close_connection()
+	err := SendMessageAndDiscardResponse("unknown-service", &protobuf.Request{})
+	assert.NotNil(t, err)
+	assert.Equal(t, ErrorCodeQueueNotFound, err.Code)
+	assert.Equal(t, 0, CountOutboxMessages())
+}
+
+func TestSetOutboxRemovesTempFiles(t *testing.T) {
+	dir := _enableOutbox(t)
+	defer _disableOutbox(dir)
+	ioutil.WriteFile(filepath.Join(dir, ".tmp-123"), []byte("{"), 0644)
+	assert.Nil(t, SetOutbox(dir))
+	files, _ := ioutil.ReadDir(dir)
+	assert.Equal(t, 0, len(files))
+}
+
+// Fails the first publishes to the queue, the connection stays up.
+type _failingTransport struct {
+	Transport
+	queue    string
+	failures int
+	mutex    sync.Mutex
+}
+
+func (t *_failingTransport) Publish(queueName string, message *Message) error {
+	t.mutex.Lock()
+	fail := queueName == t.queue && t.failures > 0
+	if fail {
+		t.failures--
+	}
+	t.mutex.Unlock()
+	if fail {
+		return errors.New("publish not confirmed")
+	}
+	return t.Transport.Publish(queueName, message)
+}
+
+func _enableOutbox(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "postman-outbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := SetOutbox(dir); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func _disableOutbox(dir string) {
+	SetOutbox("")
+	os.RemoveAll(dir)
+}
+
+// Get the id of the requests that get to this service.
+func _receiveRequests() chan string {
+	received := make(chan string, 10)
+	ResponseMiddleware = func(ctx context.Context, req *protobuf.Request) (*protobuf.Response, error) {
+		received <- req.Id
+		return &protobuf.Response{StatusCode: 200, RequestId: req.Id}, nil
+	}
+	return received
+}
+
+func _waitForRequest(t *testing.T, received chan string) string {
+	select {
+	case id := <-received:
+		return id
+	case <-time.After(time.Second):
+		t.Fatal("Request not received")
+	}
+	return ""
+}
+
+func _encodeTestRequest(t *testing.T, req *protobuf.Request) []byte {
+	body, err := encodeRequest(req, MessageVersion)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func _outboxEntryNames(t *testing.T) []string {
+	names, err := listOutboxEntries()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
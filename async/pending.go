@@ -0,0 +1,148 @@
+package async
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/rgamba/postman/async/protobuf"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// All requests we send out to AMQP server will be stored here so we
+// can make a match when the message comes back.
+// The hash key will be the request ID and the value will be the queue
+// name where we need to send the response to.
+var requests = map[string]*requestRecord{}
+var mutex = &sync.Mutex{}
+
+// Max number of requests waiting for a response at the same time.
+// Zero means no limit.
+var maxPendingRequests = 0
+
+type requestRecord struct {
+	serviceName string
+	request     *protobuf.Request
+	onResponse  func(*protobuf.Response, *Error)
+	// Called instead of onResponse for streamed responses,
+	// nil if we don't accept them.
+	onStream func(*protobuf.Response, *ResponseStream)
+	// The tunnel the responder can open along with the
+	// response, nil if we don't ask for one.
+	tunnel   *Tunnel
+	deadline time.Time
+	// Fires once the deadline is reached, nil if there is no deadline.
+	timer *time.Timer
+}
+
+// SetMaxPendingRequests sets the max number of requests that can wait
+// for a response at the same time. New requests will fail right away
+// with a too_many_pending_requests error once the limit is reached.
+// Zero means no limit.
+func SetMaxPendingRequests(max int) {
+	if max < 0 {
+		max = 0
+	}
+	maxPendingRequests = max
+}
+
+// CountPendingRequests returns the number of requests
+// waiting for a response at the moment.
+func CountPendingRequests() int {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return len(requests)
+}
+
+// CancelRequest stops waiting for the response of the request, the
+// onResponse callback won't be called. The destination service is
+// asked to stop processing the request too. It returns false when the
+// request is not pending anymore, which means the callback already
+// got called or is about to.
+func CancelRequest(requestID string) bool {
+	requestRecord := takeRequest(requestID)
+	if requestRecord == nil {
+		return false
+	}
+	discardResponseStream(requestID)
+	if requestRecord.tunnel != nil {
+		requestRecord.tunnel.Close()
+	}
+	if err := sendCancelMessage(requestRecord); err != nil {
+		log.WithFields(log.Fields{
+			"error":      err,
+			"request_id": requestID,
+		}).Warn("Unable to send the cancel message")
+	}
+	return true
+}
+
+// Append a new request to the requests queue. Once the deadline is
+// reached the request gets removed and the callback is called
+// with a timeout error.
+func appendRequestRecord(req *requestRecord) *Error {
+	request := req.request
+	mutex.Lock()
+	defer mutex.Unlock()
+	if maxPendingRequests > 0 && len(requests) >= maxPendingRequests {
+		return createError(
+			ErrorCodeTooManyPendingRequests,
+			fmt.Sprintf("There are already %d requests waiting for a response", len(requests)),
+			nil,
+		)
+	}
+	if !req.deadline.IsZero() {
+		req.timer = time.AfterFunc(req.deadline.Sub(time.Now()), func() {
+			expireRequest(request.Id)
+		})
+	}
+	requests[request.Id] = req
+	return nil
+}
+
+// Remove the request and let the caller know there was no response in time.
+func expireRequest(requestID string) {
+	requestRecord := takeRequest(requestID)
+	if requestRecord == nil {
+		return
+	}
+	discardResponseStream(requestID)
+	requestRecord.onResponse(nil, createError(ErrorCodeTimeout, "No response received before the deadline", nil))
+}
+
+// Remove a request from the requests queue.
+// This is a thread-safe operation.
+func removeRequest(requestID string) {
+	takeRequest(requestID)
+}
+
+// Remove the request from the requests queue and return it. Only one
+// caller will get the request, that way the callback gets called once.
+// This is a thread-safe operation.
+func takeRequest(requestID string) *requestRecord {
+	mutex.Lock()
+	defer mutex.Unlock()
+	val, ok := requests[requestID]
+	if !ok {
+		return nil
+	}
+	delete(requests, requestID)
+	if val.timer != nil {
+		val.timer.Stop()
+	}
+	return val
+}
+
+// Try to find the request on the requests queue
+// given the requestID.
+// This is a thread-safe operation.
+func getResponseRequest(requestID string) *requestRecord {
+	mutex.Lock()
+	val, ok := requests[requestID]
+	mutex.Unlock()
+	if !ok {
+		return nil
+	}
+	return val
+}
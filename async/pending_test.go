@@ -0,0 +1,94 @@
+package async
+
+import (
+	"testing"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/rgamba/postman/async/protobuf"
+	"github.com/rgamba/postman/stats"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPendingRequestExpires(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	_createQueue("postman.req.service1")
+	c := make(chan *Error)
+	req := &protobuf.Request{Method: "GET", ResponseQueue: ResponseQueueName}
+	SendRequestMessageWithDeadline("service1", req, time.Now().Add(20*time.Millisecond), func(resp *protobuf.Response, err *Error) {
+		assert.Nil(t, resp)
+		c <- err
+	})
+	err := <-c
+	if assert.NotNil(t, err) {
+		assert.Equal(t, ErrorCodeTimeout, err.Code)
+	}
+	assert.Nil(t, getResponseRequest(req.Id))
+}
+
+func TestCancelRequest(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	called := make(chan bool, 1)
+	req := &protobuf.Request{Id: "cancel"}
+	_appendRequest("service1", req, time.Now().Add(20*time.Millisecond), func(resp *protobuf.Response, err *Error) {
+		called <- true
+	})
+	assert.True(t, CancelRequest(req.Id))
+	assert.False(t, CancelRequest(req.Id))
+	assert.Nil(t, getResponseRequest(req.Id))
+	select {
+	case <-called:
+		t.Error("Canceled request callback was called")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestMaxPendingRequests(t *testing.T) {
+	SetMaxPendingRequests(1)
+	defer SetMaxPendingRequests(0)
+	_connect()
+	defer _close_connection()
+	_createQueue("postman.req.service1")
+	first := &protobuf.Request{Method: "GET", ResponseQueue: ResponseQueueName}
+	SendRequestMessage("service1", first, func(resp *protobuf.Response, err *Error) {})
+	defer removeRequest(first.Id)
+	c := make(chan *Error)
+	SendRequestMessage("service1", &protobuf.Request{Method: "GET"}, func(resp *protobuf.Response, err *Error) {
+		c <- err
+	})
+	err := <-c
+	if assert.NotNil(t, err) {
+		assert.Equal(t, ErrorCodeTooManyPendingRequests, err.Code)
+	}
+	assert.Equal(t, 1, CountPendingRequests())
+}
+
+func TestLateResponseIsCounted(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	before := stats.CountLateResponses()
+	body, _ := proto.Marshal(&protobuf.Response{RequestId: "late", StatusCode: 200})
+	err := processMessageResponse(&Message{Body: body, Headers: map[string]interface{}{headerVersion: int32(MessageVersion)}})
+	assert.NotNil(t, err)
+	err = processMessageResponse(&Message{Headers: map[string]interface{}{
+		headerError:     ErrorCodeUpstreamError,
+		headerRequestID: "late",
+	}})
+	assert.NotNil(t, err)
+	// Stats are recorded asynchronously.
+	for i := 0; i < 100 && stats.CountLateResponses() < before+2; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, before+2, stats.CountLateResponses())
+}
+
+func _appendRequest(serviceName string, request *protobuf.Request, deadline time.Time, onResponse func(*protobuf.Response, *Error)) *Error {
+	return appendRequestRecord(&requestRecord{
+		serviceName: serviceName,
+		request:     request,
+		onResponse:  onResponse,
+		deadline:    deadline,
+	})
+}
@@ -0,0 +1,147 @@
+package async
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// URL of the RabbitMQ management API, no policies are set without it.
+	managementURL   = ""
+	managementMutex sync.RWMutex
+	// Set once the dead letter policy is in place.
+	deadLetterPolicySet   bool
+	deadLetterPolicyMutex sync.Mutex
+)
+
+// Transports able to set policies on the queues.
+type policyTransport interface {
+	SetDeadLetterExchange(queueName string, exchange string) error
+}
+
+// SetManagementURL sets the URL of the RabbitMQ management API, used to
+// set the dead letter policy of request queues declared without the dead
+// letter exchange. Credentials can go in the URL, otherwise the ones of the
+// broker uri are used. Empty means no policy is set.
+func SetManagementURL(url string) {
+	managementMutex.Lock()
+	defer managementMutex.Unlock()
+	managementURL = strings.TrimRight(url, "/")
+}
+
+func getManagementURL() string {
+	managementMutex.RLock()
+	defer managementMutex.RUnlock()
+	return managementURL
+}
+
+// Set the dead letter policy in the background, if we have the management
+// API to do it. It's done once, it's tried again on the next connection
+// if it fails.
+func applyDeadLetterPolicy(queueName string, exchange string) {
+	pt, ok := transport.(policyTransport)
+	if !ok || getManagementURL() == "" {
+		return
+	}
+	go func() {
+		deadLetterPolicyMutex.Lock()
+		defer deadLetterPolicyMutex.Unlock()
+		if deadLetterPolicySet {
+			return
+		}
+		if err := pt.SetDeadLetterExchange(queueName, exchange); err != nil {
+			log.WithFields(log.Fields{
+				"error": err,
+				"queue": queueName,
+			}).Warn("Unable to set the dead letter policy of the request queue")
+			return
+		}
+		deadLetterPolicySet = true
+	}()
+}
+
+// Queue arguments can't be changed once the queue is declared, policies
+// can. Only one policy applies to each queue though, the one with the
+// highest priority, so ours may replace the policies of the operator.
+func (t *amqpTransport) SetDeadLetterExchange(queueName string, exchange string) error {
+	t.mutex.RLock()
+	uri := t.uri
+	connected := t.conn != nil
+	t.mutex.RUnlock()
+	if !connected {
+		return ErrNotConnected
+	}
+	policyURL, user, password, err := getPolicyURL(uri, "postman-dlx-"+queueName)
+	if err != nil {
+		return err
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"pattern":  "^" + regexp.QuoteMeta(queueName) + "$",
+		"apply-to": "queues",
+		"definition": map[string]interface{}{
+			"dead-letter-exchange": exchange,
+		},
+	})
+	request, err := http.NewRequest("PUT", policyURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.SetBasicAuth(user, password)
+	request.Header.Set("Content-Type", "application/json")
+	response, err := getManagementClient().Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode/100 != 2 {
+		reason, _ := ioutil.ReadAll(response.Body)
+		return fmt.Errorf("unable to set the policy %s: %d %s", queueName, response.StatusCode, reason)
+	}
+	return nil
+}
+
+// Get the management API URL of the policy along with the credentials.
+func getPolicyURL(uri string, name string) (string, string, string, error) {
+	parsed, err := amqp.ParseURI(uri)
+	if err != nil {
+		return "", "", "", err
+	}
+	user, password := parsed.Username, parsed.Password
+	base := getManagementURL()
+	if base == "" {
+		return "", "", "", errors.New("no management API url given")
+	}
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", "", "", err
+	}
+	if u.User != nil {
+		user = u.User.Username()
+		password, _ = u.User.Password()
+		u.User = nil
+	}
+	policyURL := fmt.Sprintf("%s/api/policies/%s/%s", strings.TrimRight(u.String(), "/"), url.PathEscape(parsed.Vhost), url.PathEscape(name))
+	return policyURL, user, password, nil
+}
+
+// The management API gets the same TLS settings as the broker.
+func getManagementClient() *http.Client {
+	client := &http.Client{Timeout: 5 * time.Second}
+	if config := getDialConfig().TLSClientConfig; config != nil {
+		client.Transport = &http.Transport{TLSClientConfig: config}
+	}
+	return client
+}
@@ -0,0 +1,138 @@
+package async
+
+import (
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Max number of channels the AMQP transport keeps open for publishing
+// and other short lived operations. Consumers get their own channel.
+var channelPoolSize = 16
+
+// SetChannelPoolSize sets the max number of channels the AMQP transport
+// will use at the same time for publishing messages and declaring
+// queues. This must be called before Connect.
+func SetChannelPoolSize(size int) {
+	if size < 1 {
+		size = 1
+	}
+	channelPoolSize = size
+}
+
+// Time we'll wait for the broker to confirm a published message.
+var confirmTimeout = 5 * time.Second
+
+// SetConfirmTimeout sets the time we'll wait for the broker to confirm
+// a published message before giving up on it.
+func SetConfirmTimeout(timeout time.Duration) {
+	if timeout > 0 {
+		confirmTimeout = timeout
+	}
+}
+
+// The part of *amqp.Channel the pool needs to know about.
+type poolChannel interface {
+	Close() error
+	NotifyClose(chan *amqp.Error) chan *amqp.Error
+}
+
+// A bounded pool of channels. Opening a channel is a round trip to the
+// server, so we'd rather reuse them. Channels get closed by the server on
+// any channel exception and they all die with the connection, so the pool
+// checks them before handing them out.
+type channelPool struct {
+	mutex sync.Mutex
+	// Opens a new channel on the current connection,
+	// nil when there is no connection.
+	open func() (poolChannel, error)
+	idle []*pooledChannel
+	// Holds a slot for each channel in use.
+	slots chan struct{}
+	// Changes every time the connection changes, channels
+	// from a previous connection are not reused.
+	generation int
+}
+
+type pooledChannel struct {
+	poolChannel
+	closed     chan *amqp.Error
+	generation int
+}
+
+func newChannelPool(size int) *channelPool {
+	return &channelPool{
+		slots: make(chan struct{}, size),
+	}
+}
+
+// Get a channel from the pool, opening a new one if there are no idle
+// channels. It blocks while all the channels are in use.
+// Every channel must be put back once we're done with it.
+func (p *channelPool) get() (*pooledChannel, error) {
+	p.slots <- struct{}{}
+	p.mutex.Lock()
+	for len(p.idle) > 0 {
+		pc := p.idle[len(p.idle)-1]
+		p.idle = p.idle[:len(p.idle)-1]
+		if pc.healthy() {
+			p.mutex.Unlock()
+			return pc, nil
+		}
+		pc.Close()
+	}
+	open, generation := p.open, p.generation
+	p.mutex.Unlock()
+	if open == nil {
+		<-p.slots
+		return nil, ErrNotConnected
+	}
+	ch, err := open()
+	if err != nil {
+		<-p.slots
+		return nil, err
+	}
+	return &pooledChannel{
+		poolChannel: ch,
+		closed:      ch.NotifyClose(make(chan *amqp.Error, 1)),
+		generation:  generation,
+	}, nil
+}
+
+// Put the channel back in the pool. Broken channels are closed instead.
+func (p *channelPool) put(pc *pooledChannel, broken bool) {
+	defer func() { <-p.slots }()
+	p.mutex.Lock()
+	if broken || !pc.healthy() || pc.generation != p.generation {
+		p.mutex.Unlock()
+		pc.Close()
+		return
+	}
+	p.idle = append(p.idle, pc)
+	p.mutex.Unlock()
+}
+
+// Start using a new connection, nil when there is no connection at all.
+// Idle channels are closed, the ones in use will be closed once put back.
+func (p *channelPool) reset(open func() (poolChannel, error)) {
+	p.mutex.Lock()
+	idle := p.idle
+	p.idle = nil
+	p.open = open
+	p.generation++
+	p.mutex.Unlock()
+	for _, pc := range idle {
+		pc.Close()
+	}
+}
+
+// The channel is closed as soon as the server or the client closes it.
+func (pc *pooledChannel) healthy() bool {
+	select {
+	case <-pc.closed:
+		return false
+	default:
+		return true
+	}
+}
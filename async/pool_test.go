@@ -0,0 +1,132 @@
+package async
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChannelPoolReusesChannels(t *testing.T) {
+	pool, opened := _newTestPool(2)
+	pc, err := pool.get()
+	assert.NoError(t, err)
+	pool.put(pc, false)
+	pc2, err := pool.get()
+	assert.NoError(t, err)
+	assert.True(t, pc == pc2)
+	pool.put(pc2, false)
+	assert.Equal(t, 1, *opened)
+}
+
+func TestChannelPoolDiscardsBrokenChannels(t *testing.T) {
+	pool, opened := _newTestPool(2)
+	pc, _ := pool.get()
+	pool.put(pc, true)
+	assert.True(t, pc.poolChannel.(*testChannel).isClosed())
+	// Closed by the server while idle.
+	pc, _ = pool.get()
+	pool.put(pc, false)
+	pc.poolChannel.(*testChannel).Close()
+	pc2, _ := pool.get()
+	assert.False(t, pc == pc2)
+	pool.put(pc2, false)
+	assert.Equal(t, 3, *opened)
+}
+
+func TestChannelPoolIsBounded(t *testing.T) {
+	pool, _ := _newTestPool(1)
+	pc, _ := pool.get()
+	got := make(chan *pooledChannel)
+	go func() {
+		pc, _ := pool.get()
+		got <- pc
+	}()
+	select {
+	case <-got:
+		t.Fatal("Got more channels than the pool size")
+	case <-time.After(20 * time.Millisecond):
+	}
+	pool.put(pc, false)
+	pool.put(<-got, false)
+}
+
+func TestChannelPoolReset(t *testing.T) {
+	pool, _ := _newTestPool(2)
+	idle, _ := pool.get()
+	inUse, _ := pool.get()
+	pool.put(idle, false)
+	pool.reset(nil)
+	assert.True(t, idle.poolChannel.(*testChannel).isClosed())
+	// Channels from the previous connection are not reused.
+	pool.put(inUse, false)
+	assert.True(t, inUse.poolChannel.(*testChannel).isClosed())
+	_, err := pool.get()
+	assert.Equal(t, ErrNotConnected, err)
+}
+
+func TestChannelPoolOpenError(t *testing.T) {
+	pool := newChannelPool(1)
+	pool.reset(func() (poolChannel, error) {
+		return nil, errors.New("unable to open channel")
+	})
+	_, err := pool.get()
+	assert.Error(t, err)
+	// The slot is released.
+	_, err = pool.get()
+	assert.Error(t, err)
+}
+
+func BenchmarkChannelPool(b *testing.B) {
+	pool, _ := _newTestPool(16)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			pc, _ := pool.get()
+			pool.put(pc, false)
+		}
+	})
+}
+
+type testChannel struct {
+	mutex  sync.Mutex
+	closed bool
+	notify []chan *amqp.Error
+}
+
+func (c *testChannel) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.closed {
+		c.closed = true
+		for _, n := range c.notify {
+			close(n)
+		}
+	}
+	return nil
+}
+
+func (c *testChannel) NotifyClose(n chan *amqp.Error) chan *amqp.Error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.notify = append(c.notify, n)
+	return n
+}
+
+func (c *testChannel) isClosed() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.closed
+}
+
+func _newTestPool(size int) (*channelPool, *int) {
+	opened := 0
+	pool := newChannelPool(size)
+	pool.reset(func() (poolChannel, error) {
+		opened++
+		return &testChannel{}, nil
+	})
+	return pool, &opened
+}
@@ -0,0 +1,78 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: header.proto
+
+/*
+Package protobuf is a generated protocol buffer package.
+
+It is generated from these files:
+
+	header.proto
+	request.proto
+	response.proto
+	request_v1.proto
+	response_v1.proto
+
+It has these top-level messages:
+
+	Header
+	Request
+	Response
+	RequestV1
+	ResponseV1
+*/
+package protobuf
+
+import proto "github.com/golang/protobuf/proto"
+import fmt "fmt"
+import math "math"
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the proto package it is being compiled against.
+// A compilation error at this line likely means your copy of the
+// proto package needs to be updated.
+const _ = proto.ProtoPackageIsVersion2 // please upgrade the proto package
+
+type Header struct {
+	Name   string   `protobuf:"bytes,1,opt,name=name" json:"name,omitempty"`
+	Values []string `protobuf:"bytes,2,rep,name=values" json:"values,omitempty"`
+}
+
+func (m *Header) Reset()                    { *m = Header{} }
+func (m *Header) String() string            { return proto.CompactTextString(m) }
+func (*Header) ProtoMessage()               {}
+func (*Header) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{0} }
+
+func (m *Header) GetName() string {
+	if m != nil {
+		return m.Name
+	}
+	return ""
+}
+
+func (m *Header) GetValues() []string {
+	if m != nil {
+		return m.Values
+	}
+	return nil
+}
+
+func init() {
+	proto.RegisterType((*Header)(nil), "protobuf.Header")
+}
+
+func init() { proto.RegisterFile("header.proto", fileDescriptor0) }
+
+var fileDescriptor0 = []byte{
+	// 89 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0xe2, 0xc9, 0x48, 0x4d, 0x4c,
+	0x49, 0x2d, 0xd2, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0xe2, 0x00, 0x53, 0x49, 0xa5, 0x69, 0x4a,
+	0x26, 0x5c, 0x6c, 0x1e, 0x60, 0x19, 0x21, 0x21, 0x2e, 0x96, 0xbc, 0xc4, 0xdc, 0x54, 0x09, 0x46,
+	0x05, 0x46, 0x0d, 0xce, 0x20, 0x30, 0x5b, 0x48, 0x8c, 0x8b, 0xad, 0x2c, 0x31, 0xa7, 0x34, 0xb5,
+	0x58, 0x82, 0x49, 0x81, 0x59, 0x83, 0x33, 0x08, 0xca, 0x4b, 0x62, 0x03, 0xeb, 0x37, 0x06, 0x0c,
+	0x00, 0x3c, 0x08, 0xe5, 0x9f, 0x56, 0x00, 0x00, 0x00,
+}
@@ -1,18 +1,6 @@
-// Code generated by protoc-gen-go.
+// Code generated by protoc-gen-go. DO NOT EDIT.
 // source: request.proto
-// DO NOT EDIT!
 
-/*
-Package protobuf is a generated protocol buffer package.
-
-It is generated from these files:
-	request.proto
-	response.proto
-
-It has these top-level messages:
-	Request
-	Response
-*/
 package protobuf
 
 import proto "github.com/golang/protobuf/proto"
@@ -24,41 +12,115 @@ var _ = proto.Marshal
 var _ = fmt.Errorf
 var _ = math.Inf
 
-// This is a compile-time assertion to ensure that this generated file
-// is compatible with the proto package it is being compiled against.
-const _ = proto.ProtoPackageIsVersion1
-
 type Request struct {
-	Id            string   `protobuf:"bytes,1,opt,name=id" json:"id,omitempty"`
-	Method        string   `protobuf:"bytes,2,opt,name=method" json:"method,omitempty"`
-	Endpoint      string   `protobuf:"bytes,3,opt,name=endpoint" json:"endpoint,omitempty"`
-	Headers       []string `protobuf:"bytes,4,rep,name=headers" json:"headers,omitempty"`
-	ResponseQueue string   `protobuf:"bytes,5,opt,name=response_queue,json=responseQueue" json:"response_queue,omitempty"`
-	Body          string   `protobuf:"bytes,6,opt,name=body" json:"body,omitempty"`
-	Service       string   `protobuf:"bytes,7,opt,name=service" json:"service,omitempty"`
+	Id            string    `protobuf:"bytes,1,opt,name=id" json:"id,omitempty"`
+	Method        string    `protobuf:"bytes,2,opt,name=method" json:"method,omitempty"`
+	Endpoint      string    `protobuf:"bytes,3,opt,name=endpoint" json:"endpoint,omitempty"`
+	ResponseQueue string    `protobuf:"bytes,5,opt,name=response_queue,json=responseQueue" json:"response_queue,omitempty"`
+	Body          []byte    `protobuf:"bytes,6,opt,name=body,proto3" json:"body,omitempty"`
+	Service       string    `protobuf:"bytes,7,opt,name=service" json:"service,omitempty"`
+	Headers       []*Header `protobuf:"bytes,8,rep,name=headers" json:"headers,omitempty"`
+	Query         string    `protobuf:"bytes,9,opt,name=query" json:"query,omitempty"`
+	Host          string    `protobuf:"bytes,10,opt,name=host" json:"host,omitempty"`
+	Protocol      string    `protobuf:"bytes,11,opt,name=protocol" json:"protocol,omitempty"`
 }
 
 func (m *Request) Reset()                    { *m = Request{} }
 func (m *Request) String() string            { return proto.CompactTextString(m) }
 func (*Request) ProtoMessage()               {}
-func (*Request) Descriptor() ([]byte, []int) { return fileDescriptor0, []int{0} }
+func (*Request) Descriptor() ([]byte, []int) { return fileDescriptor1, []int{0} }
+
+func (m *Request) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+func (m *Request) GetMethod() string {
+	if m != nil {
+		return m.Method
+	}
+	return ""
+}
+
+func (m *Request) GetEndpoint() string {
+	if m != nil {
+		return m.Endpoint
+	}
+	return ""
+}
+
+func (m *Request) GetResponseQueue() string {
+	if m != nil {
+		return m.ResponseQueue
+	}
+	return ""
+}
+
+func (m *Request) GetBody() []byte {
+	if m != nil {
+		return m.Body
+	}
+	return nil
+}
+
+func (m *Request) GetService() string {
+	if m != nil {
+		return m.Service
+	}
+	return ""
+}
+
+func (m *Request) GetHeaders() []*Header {
+	if m != nil {
+		return m.Headers
+	}
+	return nil
+}
+
+func (m *Request) GetQuery() string {
+	if m != nil {
+		return m.Query
+	}
+	return ""
+}
+
+func (m *Request) GetHost() string {
+	if m != nil {
+		return m.Host
+	}
+	return ""
+}
+
+func (m *Request) GetProtocol() string {
+	if m != nil {
+		return m.Protocol
+	}
+	return ""
+}
 
 func init() {
 	proto.RegisterType((*Request)(nil), "protobuf.Request")
 }
 
-var fileDescriptor0 = []byte{
-	// 177 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x3c, 0x8f, 0x4b, 0x0a, 0xc2, 0x40,
-	0x0c, 0x40, 0xe9, 0xc7, 0x7e, 0x02, 0xed, 0x22, 0x0b, 0x09, 0xae, 0x8a, 0x20, 0x74, 0xe5, 0xc6,
-	0x93, 0xd8, 0x0b, 0x88, 0x75, 0x22, 0x9d, 0x85, 0x9d, 0x76, 0x3e, 0x82, 0x77, 0xf3, 0x70, 0xd2,
-	0x68, 0x5d, 0xcd, 0xbc, 0xf7, 0x48, 0x20, 0x50, 0x59, 0x9e, 0x03, 0x3b, 0x7f, 0x9c, 0xac, 0xf1,
-	0x06, 0x0b, 0x79, 0xfa, 0x70, 0xdf, 0xbf, 0x23, 0xc8, 0xbb, 0x6f, 0xc3, 0x1a, 0x62, 0xad, 0x28,
-	0x6a, 0xa2, 0xb6, 0xec, 0x62, 0xad, 0x70, 0x0b, 0xd9, 0x83, 0xfd, 0x60, 0x14, 0xc5, 0xe2, 0x7e,
-	0x84, 0x3b, 0x28, 0x78, 0x54, 0x93, 0xd1, 0xa3, 0xa7, 0x44, 0xca, 0x9f, 0x91, 0x20, 0x1f, 0xf8,
-	0xaa, 0xd8, 0x3a, 0x4a, 0x9b, 0xa4, 0x2d, 0xbb, 0x15, 0xf1, 0x00, 0xb5, 0x65, 0x37, 0x99, 0xd1,
-	0xf1, 0x65, 0x0e, 0x1c, 0x98, 0x36, 0x32, 0x5b, 0xad, 0xf6, 0xbc, 0x48, 0x44, 0x48, 0x7b, 0xa3,
-	0x5e, 0x94, 0x49, 0x94, 0xff, 0xb2, 0xd4, 0xb1, 0x7d, 0xea, 0x1b, 0x53, 0x2e, 0x7a, 0xc5, 0x3e,
-	0x93, 0x43, 0x4e, 0x9f, 0x00, 0x00, 0x00, 0xff, 0xff, 0x3a, 0xc4, 0xfc, 0x6a, 0xe0, 0x00, 0x00,
-	0x00,
+func init() { proto.RegisterFile("request.proto", fileDescriptor1) }
+
+var fileDescriptor1 = []byte{
+	// 232 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x3c, 0x8f, 0xdb, 0x4a, 0xc4, 0x30,
+	0x10, 0x86, 0x69, 0xb7, 0xa7, 0x9d, 0x3d, 0xb0, 0x0c, 0x22, 0xc3, 0x5e, 0x15, 0x41, 0x28, 0x5e,
+	0xf4, 0x42, 0x5f, 0x42, 0xbc, 0xb3, 0x2f, 0x20, 0x76, 0x33, 0xd2, 0x82, 0x36, 0x6d, 0x0e, 0xc2,
+	0xbe, 0x8a, 0x4f, 0x2b, 0x9d, 0x18, 0xaf, 0x32, 0xdf, 0x37, 0x93, 0x49, 0x7e, 0x38, 0x18, 0x5e,
+	0x3c, 0x5b, 0xd7, 0xce, 0x46, 0x3b, 0x8d, 0x95, 0x1c, 0xbd, 0xff, 0x38, 0xef, 0x07, 0x7e, 0x57,
+	0x6c, 0x82, 0xbf, 0xfb, 0x49, 0xa1, 0xec, 0xc2, 0x24, 0x1e, 0x21, 0x1d, 0x15, 0x25, 0x75, 0xd2,
+	0x6c, 0xbb, 0x74, 0x54, 0x78, 0x0b, 0xc5, 0x17, 0xbb, 0x41, 0x2b, 0x4a, 0xc5, 0xfd, 0x11, 0x9e,
+	0xa1, 0xe2, 0x49, 0xcd, 0x7a, 0x9c, 0x1c, 0x6d, 0xa4, 0xf3, 0xcf, 0x78, 0x0f, 0x47, 0xc3, 0x76,
+	0xd6, 0x93, 0xe5, 0xb7, 0xc5, 0xb3, 0x67, 0xca, 0x65, 0xe2, 0x10, 0xed, 0xeb, 0x2a, 0x11, 0x21,
+	0xeb, 0xb5, 0xba, 0x52, 0x51, 0x27, 0xcd, 0xbe, 0x93, 0x1a, 0x09, 0x4a, 0xcb, 0xe6, 0x7b, 0xbc,
+	0x30, 0x95, 0x72, 0x27, 0x22, 0x3e, 0x40, 0x19, 0x3e, 0x6d, 0xa9, 0xaa, 0x37, 0xcd, 0xee, 0xf1,
+	0xd4, 0xc6, 0x38, 0xed, 0xb3, 0x34, 0xba, 0x38, 0x80, 0x37, 0x90, 0x2f, 0x9e, 0xcd, 0x95, 0xb6,
+	0xb2, 0x23, 0xc0, 0xfa, 0xde, 0xa0, 0xad, 0x23, 0x10, 0x29, 0xf5, 0x1a, 0x43, 0xb6, 0x5c, 0xf4,
+	0x27, 0xed, 0x42, 0x8c, 0xc8, 0x2f, 0x59, 0x95, 0x9d, 0xf2, 0xbe, 0x10, 0x7e, 0xfa, 0x1d, 0x00,
+	0x43, 0xe1, 0x0b, 0xcd, 0x4c, 0x01, 0x00, 0x00,
 }
@@ -0,0 +1,99 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: request_v1.proto
+
+package protobuf
+
+import proto "github.com/golang/protobuf/proto"
+import fmt "fmt"
+import math "math"
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+type RequestV1 struct {
+	Id            string   `protobuf:"bytes,1,opt,name=id" json:"id,omitempty"`
+	Method        string   `protobuf:"bytes,2,opt,name=method" json:"method,omitempty"`
+	Endpoint      string   `protobuf:"bytes,3,opt,name=endpoint" json:"endpoint,omitempty"`
+	Headers       []string `protobuf:"bytes,4,rep,name=headers" json:"headers,omitempty"`
+	ResponseQueue string   `protobuf:"bytes,5,opt,name=response_queue,json=responseQueue" json:"response_queue,omitempty"`
+	Body          string   `protobuf:"bytes,6,opt,name=body" json:"body,omitempty"`
+	Service       string   `protobuf:"bytes,7,opt,name=service" json:"service,omitempty"`
+}
+
+func (m *RequestV1) Reset()                    { *m = RequestV1{} }
+func (m *RequestV1) String() string            { return proto.CompactTextString(m) }
+func (*RequestV1) ProtoMessage()               {}
+func (*RequestV1) Descriptor() ([]byte, []int) { return fileDescriptor3, []int{0} }
+
+func (m *RequestV1) GetId() string {
+	if m != nil {
+		return m.Id
+	}
+	return ""
+}
+
+func (m *RequestV1) GetMethod() string {
+	if m != nil {
+		return m.Method
+	}
+	return ""
+}
+
+func (m *RequestV1) GetEndpoint() string {
+	if m != nil {
+		return m.Endpoint
+	}
+	return ""
+}
+
+func (m *RequestV1) GetHeaders() []string {
+	if m != nil {
+		return m.Headers
+	}
+	return nil
+}
+
+func (m *RequestV1) GetResponseQueue() string {
+	if m != nil {
+		return m.ResponseQueue
+	}
+	return ""
+}
+
+func (m *RequestV1) GetBody() string {
+	if m != nil {
+		return m.Body
+	}
+	return ""
+}
+
+func (m *RequestV1) GetService() string {
+	if m != nil {
+		return m.Service
+	}
+	return ""
+}
+
+func init() {
+	proto.RegisterType((*RequestV1)(nil), "protobuf.RequestV1")
+}
+
+func init() { proto.RegisterFile("request_v1.proto", fileDescriptor3) }
+
+var fileDescriptor3 = []byte{
+	// 182 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x3c, 0x8f, 0x4b, 0x6a, 0xc3, 0x40,
+	0x0c, 0x40, 0xf1, 0xa7, 0xfe, 0x08, 0x6a, 0x8a, 0x16, 0x45, 0x74, 0x65, 0x0a, 0x05, 0xaf, 0x0a,
+	0xa6, 0x27, 0xa9, 0x17, 0xd9, 0x9a, 0x38, 0xa3, 0xe0, 0x59, 0xc4, 0x63, 0xcf, 0xc7, 0x90, 0xcb,
+	0xe5, 0x6c, 0xc1, 0x4a, 0x9c, 0xd5, 0xcc, 0x7b, 0x0f, 0x09, 0x04, 0x1f, 0x96, 0x97, 0xc0, 0xce,
+	0xf7, 0x6b, 0xfb, 0x3b, 0x5b, 0xe3, 0x0d, 0x16, 0xf2, 0x0c, 0xe1, 0xfc, 0x7d, 0x8b, 0xa0, 0xec,
+	0x1e, 0xf9, 0xd0, 0x62, 0x05, 0xb1, 0x56, 0x14, 0xd5, 0x51, 0x53, 0x76, 0xb1, 0x56, 0xf8, 0x09,
+	0xd9, 0x85, 0xfd, 0x68, 0x14, 0xc5, 0xe2, 0x9e, 0x84, 0x5f, 0x50, 0xf0, 0xa4, 0x66, 0xa3, 0x27,
+	0x4f, 0x89, 0x94, 0x17, 0x23, 0x41, 0x3e, 0xf2, 0x51, 0xb1, 0x75, 0x94, 0xd6, 0x49, 0x53, 0x76,
+	0x3b, 0xe2, 0x0f, 0x54, 0x96, 0xdd, 0x6c, 0x26, 0xc7, 0xfd, 0x12, 0x38, 0x30, 0xbd, 0xc9, 0xec,
+	0xfb, 0x6e, 0xff, 0x37, 0x89, 0x08, 0xe9, 0x60, 0xd4, 0x95, 0x32, 0x89, 0xf2, 0xdf, 0x96, 0x3a,
+	0xb6, 0xab, 0x3e, 0x31, 0xe5, 0xa2, 0x77, 0x1c, 0x32, 0x39, 0xe5, 0xef, 0x3e, 0x00, 0x8b, 0x85,
+	0xef, 0x15, 0xe5, 0x00, 0x00, 0x00,
+}
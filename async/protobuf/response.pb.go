@@ -1,6 +1,5 @@
-// Code generated by protoc-gen-go.
+// Code generated by protoc-gen-go. DO NOT EDIT.
 // source: response.proto
-// DO NOT EDIT!
 
 package protobuf
 
@@ -14,31 +13,62 @@ var _ = fmt.Errorf
 var _ = math.Inf
 
 type Response struct {
-	RequestId  string   `protobuf:"bytes,1,opt,name=request_id,json=requestId" json:"request_id,omitempty"`
-	StatusCode int32    `protobuf:"varint,2,opt,name=status_code,json=statusCode" json:"status_code,omitempty"`
-	Headers    []string `protobuf:"bytes,3,rep,name=headers" json:"headers,omitempty"`
-	Body       string   `protobuf:"bytes,4,opt,name=body" json:"body,omitempty"`
+	RequestId  string    `protobuf:"bytes,1,opt,name=request_id,json=requestId" json:"request_id,omitempty"`
+	StatusCode int32     `protobuf:"varint,2,opt,name=status_code,json=statusCode" json:"status_code,omitempty"`
+	Body       []byte    `protobuf:"bytes,4,opt,name=body,proto3" json:"body,omitempty"`
+	Headers    []*Header `protobuf:"bytes,5,rep,name=headers" json:"headers,omitempty"`
 }
 
 func (m *Response) Reset()                    { *m = Response{} }
 func (m *Response) String() string            { return proto.CompactTextString(m) }
 func (*Response) ProtoMessage()               {}
-func (*Response) Descriptor() ([]byte, []int) { return fileDescriptor1, []int{0} }
+func (*Response) Descriptor() ([]byte, []int) { return fileDescriptor2, []int{0} }
+
+func (m *Response) GetRequestId() string {
+	if m != nil {
+		return m.RequestId
+	}
+	return ""
+}
+
+func (m *Response) GetStatusCode() int32 {
+	if m != nil {
+		return m.StatusCode
+	}
+	return 0
+}
+
+func (m *Response) GetBody() []byte {
+	if m != nil {
+		return m.Body
+	}
+	return nil
+}
+
+func (m *Response) GetHeaders() []*Header {
+	if m != nil {
+		return m.Headers
+	}
+	return nil
+}
 
 func init() {
 	proto.RegisterType((*Response)(nil), "protobuf.Response")
 }
 
-var fileDescriptor1 = []byte{
-	// 147 bytes of a gzipped FileDescriptorProto
+func init() { proto.RegisterFile("response.proto", fileDescriptor2) }
+
+var fileDescriptor2 = []byte{
+	// 169 bytes of a gzipped FileDescriptorProto
 	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0xe2, 0x2b, 0x4a, 0x2d, 0x2e,
 	0xc8, 0xcf, 0x2b, 0x4e, 0xd5, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0xe2, 0x00, 0x53, 0x49, 0xa5,
-	0x69, 0x4a, 0x15, 0x5c, 0x1c, 0x41, 0x50, 0x39, 0x21, 0x59, 0x2e, 0xae, 0xa2, 0xd4, 0xc2, 0xd2,
-	0xd4, 0xe2, 0x92, 0xf8, 0xcc, 0x14, 0x09, 0x46, 0x05, 0x46, 0x0d, 0xce, 0x20, 0x4e, 0xa8, 0x88,
-	0x67, 0x8a, 0x90, 0x3c, 0x17, 0x77, 0x71, 0x49, 0x62, 0x49, 0x69, 0x71, 0x7c, 0x72, 0x7e, 0x4a,
-	0xaa, 0x04, 0x93, 0x02, 0xa3, 0x06, 0x6b, 0x10, 0x17, 0x44, 0xc8, 0x39, 0x3f, 0x25, 0x55, 0x48,
-	0x82, 0x8b, 0x3d, 0x23, 0x35, 0x31, 0x25, 0xb5, 0xa8, 0x58, 0x82, 0x59, 0x81, 0x59, 0x83, 0x33,
-	0x08, 0xc6, 0x15, 0x12, 0xe2, 0x62, 0x49, 0xca, 0x4f, 0xa9, 0x94, 0x60, 0x01, 0x9b, 0x09, 0x66,
-	0x27, 0xb1, 0x81, 0xdd, 0x60, 0x0c, 0x08, 0x00, 0x00, 0xff, 0xff, 0x92, 0xb2, 0xa1, 0xd5, 0x9c,
-	0x00, 0x00, 0x00,
+	0x69, 0x52, 0x3c, 0x19, 0xa9, 0x89, 0x29, 0xa9, 0x45, 0x10, 0x71, 0xa5, 0x09, 0x8c, 0x5c, 0x1c,
+	0x41, 0x50, 0xa5, 0x42, 0xb2, 0x5c, 0x5c, 0x45, 0xa9, 0x85, 0xa5, 0xa9, 0xc5, 0x25, 0xf1, 0x99,
+	0x29, 0x12, 0x8c, 0x0a, 0x8c, 0x1a, 0x9c, 0x41, 0x9c, 0x50, 0x11, 0xcf, 0x14, 0x21, 0x79, 0x2e,
+	0xee, 0xe2, 0x92, 0xc4, 0x92, 0xd2, 0xe2, 0xf8, 0xe4, 0xfc, 0x94, 0x54, 0x09, 0x26, 0x05, 0x46,
+	0x0d, 0xd6, 0x20, 0x2e, 0x88, 0x90, 0x73, 0x7e, 0x4a, 0xaa, 0x90, 0x10, 0x17, 0x4b, 0x52, 0x7e,
+	0x4a, 0xa5, 0x04, 0x8b, 0x02, 0xa3, 0x06, 0x4f, 0x10, 0x98, 0x2d, 0xa4, 0xc5, 0xc5, 0x0e, 0xb1,
+	0xb0, 0x58, 0x82, 0x55, 0x81, 0x59, 0x83, 0xdb, 0x48, 0x40, 0x0f, 0xe6, 0x14, 0x3d, 0x0f, 0xb0,
+	0x44, 0x10, 0x4c, 0x81, 0x17, 0x0b, 0x07, 0xb3, 0x00, 0x4b, 0x12, 0x1b, 0x58, 0xde, 0x18, 0x30,
+	0x00, 0x10, 0x56, 0x36, 0x8d, 0xc3, 0x00, 0x00, 0x00,
 }
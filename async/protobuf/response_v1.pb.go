@@ -0,0 +1,73 @@
+// Code generated by protoc-gen-go. DO NOT EDIT.
+// source: response_v1.proto
+
+package protobuf
+
+import proto "github.com/golang/protobuf/proto"
+import fmt "fmt"
+import math "math"
+
+// Reference imports to suppress errors if they are not otherwise used.
+var _ = proto.Marshal
+var _ = fmt.Errorf
+var _ = math.Inf
+
+type ResponseV1 struct {
+	RequestId  string   `protobuf:"bytes,1,opt,name=request_id,json=requestId" json:"request_id,omitempty"`
+	StatusCode int32    `protobuf:"varint,2,opt,name=status_code,json=statusCode" json:"status_code,omitempty"`
+	Headers    []string `protobuf:"bytes,3,rep,name=headers" json:"headers,omitempty"`
+	Body       string   `protobuf:"bytes,4,opt,name=body" json:"body,omitempty"`
+}
+
+func (m *ResponseV1) Reset()                    { *m = ResponseV1{} }
+func (m *ResponseV1) String() string            { return proto.CompactTextString(m) }
+func (*ResponseV1) ProtoMessage()               {}
+func (*ResponseV1) Descriptor() ([]byte, []int) { return fileDescriptor4, []int{0} }
+
+func (m *ResponseV1) GetRequestId() string {
+	if m != nil {
+		return m.RequestId
+	}
+	return ""
+}
+
+func (m *ResponseV1) GetStatusCode() int32 {
+	if m != nil {
+		return m.StatusCode
+	}
+	return 0
+}
+
+func (m *ResponseV1) GetHeaders() []string {
+	if m != nil {
+		return m.Headers
+	}
+	return nil
+}
+
+func (m *ResponseV1) GetBody() string {
+	if m != nil {
+		return m.Body
+	}
+	return ""
+}
+
+func init() {
+	proto.RegisterType((*ResponseV1)(nil), "protobuf.ResponseV1")
+}
+
+func init() { proto.RegisterFile("response_v1.proto", fileDescriptor4) }
+
+var fileDescriptor4 = []byte{
+	// 149 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0xe2, 0x12, 0x2c, 0x4a, 0x2d, 0x2e,
+	0xc8, 0xcf, 0x2b, 0x4e, 0x8d, 0x2f, 0x33, 0xd4, 0x2b, 0x28, 0xca, 0x2f, 0xc9, 0x17, 0xe2, 0x00,
+	0x53, 0x49, 0xa5, 0x69, 0x4a, 0x55, 0x5c, 0x5c, 0x41, 0x50, 0xe9, 0x30, 0x43, 0x21, 0x59, 0x2e,
+	0xae, 0xa2, 0xd4, 0xc2, 0xd2, 0xd4, 0xe2, 0x92, 0xf8, 0xcc, 0x14, 0x09, 0x46, 0x05, 0x46, 0x0d,
+	0xce, 0x20, 0x4e, 0xa8, 0x88, 0x67, 0x8a, 0x90, 0x3c, 0x17, 0x77, 0x71, 0x49, 0x62, 0x49, 0x69,
+	0x71, 0x7c, 0x72, 0x7e, 0x4a, 0xaa, 0x04, 0x93, 0x02, 0xa3, 0x06, 0x6b, 0x10, 0x17, 0x44, 0xc8,
+	0x39, 0x3f, 0x25, 0x55, 0x48, 0x82, 0x8b, 0x3d, 0x23, 0x35, 0x31, 0x25, 0xb5, 0xa8, 0x58, 0x82,
+	0x59, 0x81, 0x59, 0x83, 0x33, 0x08, 0xc6, 0x15, 0x12, 0xe2, 0x62, 0x49, 0xca, 0x4f, 0xa9, 0x94,
+	0x60, 0x01, 0x9b, 0x09, 0x66, 0x27, 0xb1, 0x81, 0x5d, 0x61, 0x0c, 0x18, 0x00, 0xed, 0x67, 0xa6,
+	0x53, 0xa1, 0x00, 0x00, 0x00,
+}
@@ -0,0 +1,94 @@
+package async
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// How to pick the broker node we connect to when there is more than one.
+const (
+	// FailoverPriority always tries the nodes in the given order.
+	FailoverPriority = "priority"
+	// FailoverRoundRobin starts with the node after the last one we
+	// connected to, that way the instances spread across the cluster.
+	FailoverRoundRobin = "round_robin"
+)
+
+var (
+	failoverStrategy = FailoverPriority
+	// Time we wait before the second reconnection attempt,
+	// it doubles on every failed attempt up to the max.
+	reconnectInterval    = time.Second
+	maxReconnectInterval = 30 * time.Second
+)
+
+var (
+	// Number of failed reconnection attempts and when we'll try again.
+	reconnectAttempts int
+	nextReconnect     time.Time
+	reconnectMutex    sync.Mutex
+)
+
+// SetFailoverStrategy sets how to pick the broker node we connect to,
+// either FailoverPriority or FailoverRoundRobin.
+func SetFailoverStrategy(strategy string) error {
+	if strategy != FailoverPriority && strategy != FailoverRoundRobin {
+		return fmt.Errorf("invalid failover strategy '%s'", strategy)
+	}
+	failoverStrategy = strategy
+	return nil
+}
+
+// SetReconnectBackoff sets the time we wait between reconnection attempts.
+// It starts with interval and doubles on every failed attempt up to max.
+func SetReconnectBackoff(interval time.Duration, max time.Duration) {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	if max < interval {
+		max = interval
+	}
+	reconnectInterval = interval
+	maxReconnectInterval = max
+}
+
+// Get the time to wait after the given failed attempt, starting from zero.
+// Half of it is random so that instances that lost the connection at
+// the same time don't retry in lockstep.
+func getReconnectDelay(attempt int) time.Duration {
+	half := getBackoff(attempt) / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// Max time to wait after the given failed attempt.
+func getBackoff(attempt int) time.Duration {
+	delay := reconnectInterval
+	for i := 0; i < attempt && delay < maxReconnectInterval; i++ {
+		delay *= 2
+	}
+	if delay > maxReconnectInterval {
+		delay = maxReconnectInterval
+	}
+	return delay
+}
+
+// Remember when the next reconnection attempt is, after the given failed attempts.
+func scheduleReconnect(attempts int, delay time.Duration) {
+	reconnectMutex.Lock()
+	defer reconnectMutex.Unlock()
+	reconnectAttempts = attempts
+	nextReconnect = time.Now().Add(delay)
+}
+
+// TimeUntilReconnect returns the time until the next reconnection attempt.
+// While we are trying to reconnect, it's the time we'll wait if it fails.
+func TimeUntilReconnect() time.Duration {
+	reconnectMutex.Lock()
+	defer reconnectMutex.Unlock()
+	if wait := nextReconnect.Sub(time.Now()); wait > 0 {
+		return wait
+	}
+	return getBackoff(reconnectAttempts)
+}
@@ -0,0 +1,46 @@
+package async
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetReconnectDelay(t *testing.T) {
+	SetReconnectBackoff(100*time.Millisecond, time.Second)
+	defer SetReconnectBackoff(time.Second, 30*time.Second)
+	cases := map[int]time.Duration{
+		0:  100 * time.Millisecond,
+		1:  200 * time.Millisecond,
+		3:  800 * time.Millisecond,
+		4:  time.Second,
+		50: time.Second,
+	}
+	for attempt, max := range cases {
+		for i := 0; i < 20; i++ {
+			delay := getReconnectDelay(attempt)
+			assert.True(t, delay >= max/2, "attempt %d: %s", attempt, delay)
+			assert.True(t, delay <= max, "attempt %d: %s", attempt, delay)
+		}
+	}
+}
+
+func TestTimeUntilReconnect(t *testing.T) {
+	SetReconnectBackoff(100*time.Millisecond, time.Second)
+	defer SetReconnectBackoff(time.Second, 30*time.Second)
+	defer scheduleReconnect(0, 0)
+	scheduleReconnect(2, 300*time.Millisecond)
+	wait := TimeUntilReconnect()
+	assert.True(t, wait > 200*time.Millisecond && wait <= 300*time.Millisecond, wait.String())
+	// Reconnecting right now, we'll wait the backoff if it fails.
+	scheduleReconnect(2, 0)
+	assert.Equal(t, 400*time.Millisecond, TimeUntilReconnect())
+}
+
+func TestSetFailoverStrategy(t *testing.T) {
+	defer SetFailoverStrategy(FailoverPriority)
+	assert.Nil(t, SetFailoverStrategy(FailoverRoundRobin))
+	assert.NotNil(t, SetFailoverStrategy("random"))
+	assert.Equal(t, FailoverRoundRobin, failoverStrategy)
+}
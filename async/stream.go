@@ -0,0 +1,525 @@
+package async
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/rgamba/postman/async/protobuf"
+	"github.com/rgamba/postman/middleware"
+	"github.com/rgamba/postman/stats"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Headers used by the streamed responses.
+const (
+	// Sent along with the request, the max number of chunks the requester
+	// buffers. The responder can't have more chunks than that not acked.
+	headerAcceptStream = "accept_stream"
+	// Set on the response head, the queue where the acks are sent to.
+	headerStream = "stream"
+	// Sequence number of the chunk, starting from 1.
+	headerStreamSeq = "stream_seq"
+	// Set on the last chunk, which has no body.
+	headerStreamEnd = "stream_end"
+)
+
+// Control message sent by the requester with the
+// sequence number of the last chunk it read.
+const controlStreamAck = "stream_ack"
+
+// ErrStreamNotAccepted is returned when the response can't be
+// streamed because the requester didn't ask for it.
+var ErrStreamNotAccepted = errors.New("The requester doesn't accept streamed responses")
+
+// ErrStreamIdle is returned when the requester doesn't ack
+// the chunks we sent within the idle timeout.
+var ErrStreamIdle = errors.New("The requester stopped reading the stream")
+
+var (
+	// Max number of chunks we buffer for each streamed
+	// response, zero means we don't accept streams.
+	streamWindow = 0
+	// Max time to wait for the next chunk, or the next ack.
+	streamIdleTimeout = 30 * time.Second
+)
+
+var (
+	// Streamed responses we are reading.
+	responseStreams = map[string]*ResponseStream{}
+	// Streamed responses we are sending.
+	streamWriters = map[string]*StreamWriter{}
+	streamsMutex  sync.Mutex
+)
+
+// SetStreaming sets the max number of chunks buffered for each streamed
+// response and for how long we wait for the next chunk, on the requester
+// side, or for the next ack, on the responder side. A window of zero
+// means the responses to our requests are never streamed.
+func SetStreaming(window int, idleTimeout time.Duration) {
+	if window < 0 {
+		window = 0
+	}
+	streamsMutex.Lock()
+	defer streamsMutex.Unlock()
+	streamWindow = window
+	streamIdleTimeout = idleTimeout
+}
+
+func getStreamSettings() (int, time.Duration) {
+	streamsMutex.Lock()
+	defer streamsMutex.Unlock()
+	return streamWindow, streamIdleTimeout
+}
+
+// SendStreamingRequestMessage does the same as SendRequestMessageWithDeadline
+// but the responder can send the response body in chunks as it gets it.
+// In that case onResponse gets the response head along with the stream
+// the body is read from, the deadline doesn't apply to the stream. The
+// stream is nil for the responses sent as a whole. The stream must be
+// read until it fails or ends, or closed.
+func SendStreamingRequestMessage(serviceName string, request *protobuf.Request, deadline time.Time, onResponse func(*protobuf.Response, *ResponseStream, *Error)) {
+	sendRequestMessage(serviceName, request, deadline, &requestRecord{
+		onResponse: func(resp *protobuf.Response, err *Error) {
+			onResponse(resp, nil, err)
+		},
+		onStream: func(resp *protobuf.Response, stream *ResponseStream) {
+			onResponse(resp, stream, nil)
+		},
+	})
+}
+
+// Let the responder know how many chunks we are able to buffer.
+func setAcceptStreamHeader(headers map[string]interface{}, requestRecord *requestRecord) {
+	if window, _ := getStreamSettings(); requestRecord.onStream != nil && window > 0 {
+		headers[headerAcceptStream] = int32(window)
+	}
+}
+
+// ResponseStream is the body of a streamed response. Chunks
+// are read in order, whatever the order they arrive in.
+type ResponseStream struct {
+	requestID string
+	// Response queue of the responder.
+	queue       string
+	window      int
+	idleTimeout time.Duration
+	// Chunks ready to be read, in order.
+	chunks chan *streamChunk
+	mutex  sync.Mutex
+	// Chunks that arrived before the previous ones.
+	early map[int]*streamChunk
+	// Sequence number of the next chunk to be read.
+	next int
+	// Chunks read since the last ack.
+	unacked int
+	// Closed once we stop reading the stream.
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+type streamChunk struct {
+	seq  int
+	body []byte
+	end  bool
+	err  *Error
+}
+
+// Get the stream of a pending streaming request, chunks may arrive
+// before the response head does.
+func getResponseStream(requestID string, create bool) *ResponseStream {
+	streamsMutex.Lock()
+	defer streamsMutex.Unlock()
+	stream, ok := responseStreams[requestID]
+	if !ok && create {
+		stream = &ResponseStream{
+			requestID:   requestID,
+			window:      streamWindow,
+			idleTimeout: streamIdleTimeout,
+			chunks:      make(chan *streamChunk, streamWindow+1),
+			early:       map[int]*streamChunk{},
+			next:        1,
+			done:        make(chan struct{}),
+		}
+		responseStreams[requestID] = stream
+	}
+	return stream
+}
+
+// Next returns the next chunk of the body, io.EOF once there are no more
+// chunks. It fails if the responder fails or we don't get the next chunk
+// within the idle timeout, as well as once the context is done.
+func (s *ResponseStream) Next(ctx context.Context) ([]byte, error) {
+	timer := time.NewTimer(s.idleTimeout)
+	defer timer.Stop()
+	select {
+	case chunk := <-s.chunks:
+		if chunk.end {
+			s.finish()
+			if chunk.err != nil {
+				return nil, chunk.err
+			}
+			return nil, io.EOF
+		}
+		s.ack(chunk.seq)
+		return chunk.body, nil
+	case <-s.done:
+		return nil, createError(ErrorCodeUpstreamError, "The stream was closed", nil)
+	case <-timer.C:
+		s.Close()
+		return nil, createError(ErrorCodeTimeout, fmt.Sprintf("No chunk received in %s", s.idleTimeout), nil)
+	case <-ctx.Done():
+		s.Close()
+		return nil, ctx.Err()
+	}
+}
+
+// Close stops reading the stream, the responder is asked to stop
+// sending chunks if it didn't send the last one yet.
+func (s *ResponseStream) Close() {
+	if !s.finish() {
+		return
+	}
+	headers := map[string]interface{}{
+		headerControl:   controlCancel,
+		headerRequestID: s.requestID,
+	}
+	if err := publishMessage(nil, headers, s.getQueue()); err != nil {
+		log.WithFields(log.Fields{
+			"error":      err,
+			"request_id": s.requestID,
+		}).Warn("Unable to cancel the stream")
+	}
+}
+
+// Forget about the stream, it returns false if it was already done.
+func (s *ResponseStream) finish() bool {
+	finished := false
+	s.closeOnce.Do(func() {
+		finished = true
+		close(s.done)
+		streamsMutex.Lock()
+		delete(responseStreams, s.requestID)
+		streamsMutex.Unlock()
+	})
+	return finished
+}
+
+func (s *ResponseStream) setQueue(queue string) {
+	s.mutex.Lock()
+	s.queue = queue
+	s.mutex.Unlock()
+}
+
+func (s *ResponseStream) getQueue() string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.queue
+}
+
+// Make the chunk ready to be read once the previous ones are. The
+// responder never sends more chunks than we can buffer, the stream
+// fails if it does.
+func (s *ResponseStream) push(chunk *streamChunk) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if chunk.seq < s.next {
+		return
+	}
+	s.early[chunk.seq] = chunk
+	for next, ok := s.early[s.next]; ok; next, ok = s.early[s.next] {
+		delete(s.early, s.next)
+		select {
+		case s.chunks <- next:
+			s.next++
+		default:
+			log.WithFields(log.Fields{
+				"request_id": s.requestID,
+			}).Warn("Stream window exceeded, closing the stream")
+			go s.Close()
+			return
+		}
+	}
+}
+
+// Let the responder know it can send more chunks. We ack every half
+// window, that way the responder doesn't need to wait for each ack.
+func (s *ResponseStream) ack(seq int) {
+	s.mutex.Lock()
+	s.unacked++
+	if s.unacked < (s.window+1)/2 {
+		s.mutex.Unlock()
+		return
+	}
+	s.unacked = 0
+	queue := s.queue
+	s.mutex.Unlock()
+	headers := map[string]interface{}{
+		headerControl:   controlStreamAck,
+		headerRequestID: s.requestID,
+		headerStreamSeq: int32(seq),
+	}
+	if err := publishMessage(nil, headers, queue); err != nil {
+		log.WithFields(log.Fields{
+			"error":      err,
+			"request_id": s.requestID,
+		}).Warn("Unable to ack the stream chunks")
+	}
+}
+
+// The response head of a streamed response arrived, the
+// requester gets the stream to read the body from.
+func matchStreamAndSendCallback(response *protobuf.Response, queue string) error {
+	requestRecord := takeRequest(response.RequestId)
+	if requestRecord == nil || requestRecord.onStream == nil {
+		stream := getResponseStream(response.RequestId, true)
+		stream.setQueue(queue)
+		stream.Close()
+		if requestRecord != nil {
+			requestRecord.onResponse(nil, createError(ErrorCodeUpstreamError, "Unexpected streamed response", nil))
+			return nil
+		}
+		go stats.RecordLateResponse()
+		return fmt.Errorf("Unable to find matching request for '%s'", response.RequestId)
+	}
+	stream := getResponseStream(response.RequestId, true)
+	stream.setQueue(queue)
+	// The stream is fed from this goroutine, the callback may read it.
+	go requestRecord.onStream(response, stream)
+	return nil
+}
+
+// Forget about the chunks that arrived for a request
+// that is not pending anymore.
+func discardResponseStream(requestID string) {
+	if stream := getResponseStream(requestID, false); stream != nil {
+		stream.finish()
+	}
+}
+
+// Chunks of the streams we are not reading are dropped.
+func processStreamChunk(msg *Message) error {
+	requestID := getHeaderString(msg.Headers, headerRequestID)
+	stream := getResponseStream(requestID, false)
+	if stream == nil {
+		// The response head may still be on its way.
+		requestRecord := getResponseRequest(requestID)
+		if requestRecord == nil || requestRecord.onStream == nil {
+			return fmt.Errorf("Unable to find matching stream for '%s'", requestID)
+		}
+		stream = getResponseStream(requestID, true)
+	}
+	if err := decompressMessage(msg); err != nil {
+		return err
+	}
+	chunk := &streamChunk{
+		seq:  getHeaderInt(msg.Headers, headerStreamSeq),
+		body: msg.Body,
+	}
+	if _, ok := msg.Headers[headerStreamEnd]; ok {
+		chunk.end = true
+		if code := getHeaderString(msg.Headers, headerError); code != "" {
+			chunk.err = createError(code, getHeaderString(msg.Headers, headerErrorMessage), nil)
+		}
+	}
+	stream.push(chunk)
+	return nil
+}
+
+type streamStateKey struct{}
+
+// What we need to know to stream the response of the request being processed.
+type streamState struct {
+	request *protobuf.Request
+	version int
+	// Encodings and max number of chunks the requester accepts.
+	encodings string
+	window    int
+	started   bool
+}
+
+// Keep what we need to stream the response in the context, if the requester accepts it.
+func withStreamState(ctx context.Context, msg *Message, request *protobuf.Request, version int, encodings string) context.Context {
+	window := getHeaderInt(msg.Headers, headerAcceptStream)
+	if window <= 0 || request.ResponseQueue == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, streamStateKey{}, &streamState{
+		request:   request,
+		version:   version,
+		encodings: encodings,
+		window:    window,
+	})
+}
+
+// CanStreamResponse checks if the response to the request being
+// processed with the given context can be streamed.
+func CanStreamResponse(ctx context.Context) bool {
+	state, ok := ctx.Value(streamStateKey{}).(*streamState)
+	return ok && !state.started
+}
+
+// IsResponseStreamed checks if the response to the request being
+// processed with the given context was streamed.
+func IsResponseStreamed(ctx context.Context) bool {
+	state, ok := ctx.Value(streamStateKey{}).(*streamState)
+	return ok && state.started
+}
+
+// StreamWriter sends the body of a streamed response in chunks.
+type StreamWriter struct {
+	ctx         context.Context
+	state       *streamState
+	mutex       sync.Mutex
+	idleTimeout time.Duration
+	// Sequence number of the last chunk sent and the last chunk acked.
+	seq   int
+	acked int
+	// Signaled every time we get an ack.
+	acks chan struct{}
+}
+
+// StartResponseStream sends the response head to the requester, the body
+// is sent afterwards through the returned writer. The writer must be
+// closed once the whole body is sent. The response isn't sent again once
+// the ResponseMiddleware returns.
+func StartResponseStream(ctx context.Context, response *protobuf.Response) (*StreamWriter, error) {
+	state, ok := ctx.Value(streamStateKey{}).(*streamState)
+	if !ok || state.started {
+		return nil, ErrStreamNotAccepted
+	}
+	middleware.ProcessIncomingResponseMiddlewares(response)
+	message, err := encodeResponse(response, state.version)
+	if err != nil {
+		return nil, err
+	}
+	headers := map[string]interface{}{
+		headerVersion:    int32(state.version),
+		headerMaxVersion: int32(MessageVersion),
+		headerRequestID:  state.request.Id,
+		headerStream:     ResponseQueueName,
+	}
+	message = compressMessage(message, headers, state.encodings)
+	writer := &StreamWriter{
+		// The deadline doesn't apply to the body, the idle timeout does.
+		ctx:   WithoutDeadline(ctx),
+		state: state,
+		acks:  make(chan struct{}, 1),
+	}
+	streamsMutex.Lock()
+	writer.idleTimeout = streamIdleTimeout
+	streamWriters[state.request.Id] = writer
+	streamsMutex.Unlock()
+	if err := publishMessage(message, headers, state.request.ResponseQueue); err != nil {
+		writer.unregister()
+		return nil, err
+	}
+	state.started = true
+	return writer, nil
+}
+
+// Write sends p as the next chunk. It waits for the requester to
+// ack the previous chunks if it already has as many as it buffers.
+func (w *StreamWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err := w.waitForAcks(); err != nil {
+		return 0, err
+	}
+	w.mutex.Lock()
+	w.seq++
+	seq := w.seq
+	w.mutex.Unlock()
+	if err := w.publishChunk(seq, append([]byte(nil), p...), nil); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close sends the last chunk, with the error if the body couldn't be sent completely.
+func (w *StreamWriter) Close(err *Error) error {
+	w.unregister()
+	w.mutex.Lock()
+	w.seq++
+	seq := w.seq
+	w.mutex.Unlock()
+	return w.publishChunk(seq, nil, err)
+}
+
+func (w *StreamWriter) publishChunk(seq int, body []byte, err *Error) error {
+	headers := map[string]interface{}{
+		headerVersion:   int32(w.state.version),
+		headerRequestID: w.state.request.Id,
+		headerStreamSeq: int32(seq),
+	}
+	if body == nil {
+		headers[headerStreamEnd] = int32(1)
+	}
+	if err != nil {
+		headers[headerError] = err.Code
+		headers[headerErrorMessage] = err.Message
+	}
+	body = compressMessage(body, headers, w.state.encodings)
+	if publishErr := publishMessage(body, headers, w.state.request.ResponseQueue); publishErr != nil {
+		return publishErr
+	}
+	return nil
+}
+
+func (w *StreamWriter) waitForAcks() error {
+	timer := time.NewTimer(w.idleTimeout)
+	defer timer.Stop()
+	for {
+		w.mutex.Lock()
+		waiting := w.seq-w.acked >= w.state.window
+		w.mutex.Unlock()
+		if !waiting {
+			return nil
+		}
+		select {
+		case <-w.acks:
+		case <-timer.C:
+			return ErrStreamIdle
+		case <-w.ctx.Done():
+			return w.ctx.Err()
+		}
+	}
+}
+
+func (w *StreamWriter) ack(seq int) {
+	w.mutex.Lock()
+	if seq > w.acked {
+		w.acked = seq
+	}
+	w.mutex.Unlock()
+	select {
+	case w.acks <- struct{}{}:
+	default:
+	}
+}
+
+func (w *StreamWriter) unregister() {
+	streamsMutex.Lock()
+	if streamWriters[w.state.request.Id] == w {
+		delete(streamWriters, w.state.request.Id)
+	}
+	streamsMutex.Unlock()
+}
+
+// The requester read the chunks up to the one in the ack.
+func processStreamAck(msg *Message) error {
+	requestID := getHeaderString(msg.Headers, headerRequestID)
+	streamsMutex.Lock()
+	writer := streamWriters[requestID]
+	streamsMutex.Unlock()
+	if writer == nil {
+		return nil
+	}
+	writer.ack(getHeaderInt(msg.Headers, headerStreamSeq))
+	return nil
+}
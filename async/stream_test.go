@@ -0,0 +1,175 @@
+package async
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/rgamba/postman/async/protobuf"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStreamedResponse(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	defer _resetStreaming()
+	SetStreaming(2, time.Second)
+	_setStreamingMiddleware(5, nil)
+	resp, stream := _sendStreamingRequest(t)
+	assert.Equal(t, int32(200), resp.StatusCode)
+	body := ""
+	for {
+		chunk, err := stream.Next(context.Background())
+		if err == io.EOF {
+			break
+		}
+		if !assert.Nil(t, err) {
+			return
+		}
+		body += string(chunk)
+	}
+	assert.Equal(t, "12345", body)
+}
+
+func TestStreamedResponseFailure(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	defer _resetStreaming()
+	SetStreaming(2, time.Second)
+	_setStreamingMiddleware(1, NewError(ErrorCodeUpstreamUnavailable, "connection reset", nil))
+	_, stream := _sendStreamingRequest(t)
+	chunk, err := stream.Next(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, "1", string(chunk))
+	_, err = stream.Next(context.Background())
+	if assert.NotNil(t, err) {
+		assert.Equal(t, ErrorCodeUpstreamUnavailable, err.(*Error).Code)
+	}
+}
+
+func TestStreamWriterWaitsForAcks(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	defer _resetStreaming()
+	SetStreaming(1, 50*time.Millisecond)
+	writeErr := make(chan error, 1)
+	ResponseMiddleware = func(ctx context.Context, req *protobuf.Request) (*protobuf.Response, error) {
+		resp := &protobuf.Response{RequestId: req.Id, StatusCode: 200}
+		writer, err := StartResponseStream(ctx, resp)
+		if err != nil {
+			return nil, err
+		}
+		writer.Write([]byte("1"))
+		// The requester doesn't read the first chunk.
+		_, err = writer.Write([]byte("2"))
+		writeErr <- err
+		writer.Close(nil)
+		return resp, nil
+	}
+	_, stream := _sendStreamingRequest(t)
+	defer stream.Close()
+	select {
+	case err := <-writeErr:
+		assert.Equal(t, ErrStreamIdle, err)
+	case <-time.After(time.Second):
+		t.Fatal("The writer didn't wait for the ack")
+	}
+}
+
+func TestStreamIdleTimeout(t *testing.T) {
+	defer _resetStreaming()
+	SetStreaming(2, 10*time.Millisecond)
+	stream := getResponseStream("idle", true)
+	_, err := stream.Next(context.Background())
+	if assert.NotNil(t, err) {
+		assert.Equal(t, ErrorCodeTimeout, err.(*Error).Code)
+	}
+	assert.Nil(t, getResponseStream("idle", false))
+}
+
+func TestStreamChunksOutOfOrder(t *testing.T) {
+	defer _resetStreaming()
+	SetStreaming(10, time.Second)
+	stream := getResponseStream("out-of-order", true)
+	stream.push(&streamChunk{seq: 3, end: true})
+	stream.push(&streamChunk{seq: 2, body: []byte("2")})
+	stream.push(&streamChunk{seq: 1, body: []byte("1")})
+	stream.push(&streamChunk{seq: 1, body: []byte("duplicate")})
+	for _, expected := range []string{"1", "2"} {
+		chunk, err := stream.Next(context.Background())
+		assert.Nil(t, err)
+		assert.Equal(t, expected, string(chunk))
+	}
+	_, err := stream.Next(context.Background())
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestResponseIsNotStreamedUnlessAccepted(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	defer _resetStreaming()
+	SetStreaming(2, time.Second)
+	streamErr := make(chan error, 1)
+	ResponseMiddleware = func(ctx context.Context, req *protobuf.Request) (*protobuf.Response, error) {
+		assert.False(t, CanStreamResponse(ctx))
+		_, err := StartResponseStream(ctx, &protobuf.Response{})
+		streamErr <- err
+		return &protobuf.Response{RequestId: req.Id, StatusCode: 200}, nil
+	}
+	c := make(chan bool)
+	SendRequestMessage("test-service", &protobuf.Request{ResponseQueue: ResponseQueueName}, func(resp *protobuf.Response, err *Error) {
+		assert.Nil(t, err)
+		close(c)
+	})
+	<-c
+	assert.Equal(t, ErrStreamNotAccepted, <-streamErr)
+}
+
+func _resetStreaming() {
+	ResponseMiddleware = nil
+	SetStreaming(0, 30*time.Second)
+}
+
+// The response body is sent in chunks with the numbers up to the
+// given one, the stream fails with err if it's not nil.
+func _setStreamingMiddleware(chunks int, err *Error) {
+	ResponseMiddleware = func(ctx context.Context, req *protobuf.Request) (*protobuf.Response, error) {
+		resp := &protobuf.Response{RequestId: req.Id, StatusCode: 200}
+		writer, streamErr := StartResponseStream(ctx, resp)
+		if streamErr != nil {
+			return nil, streamErr
+		}
+		for i := 1; i <= chunks; i++ {
+			if _, streamErr := writer.Write([]byte(fmt.Sprintf("%d", i))); streamErr != nil {
+				break
+			}
+		}
+		writer.Close(err)
+		return resp, nil
+	}
+}
+
+func _sendStreamingRequest(t *testing.T) (*protobuf.Response, *ResponseStream) {
+	type result struct {
+		resp   *protobuf.Response
+		stream *ResponseStream
+	}
+	c := make(chan result, 1)
+	req := &protobuf.Request{Method: "GET", ResponseQueue: ResponseQueueName}
+	SendStreamingRequestMessage("test-service", req, time.Time{}, func(resp *protobuf.Response, stream *ResponseStream, err *Error) {
+		assert.Nil(t, err)
+		c <- result{resp, stream}
+	})
+	select {
+	case r := <-c:
+		if r.stream == nil {
+			t.Fatal("The response was not streamed")
+		}
+		return r.resp, r.stream
+	case <-time.After(time.Second):
+		t.Fatal("No response")
+	}
+	return nil, nil
+}
@@ -0,0 +1,120 @@
+package async
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// TLSOptions are the options used to connect to the broker with an
+// amqps:// uri. Empty options use the system CAs and no client certificate.
+type TLSOptions struct {
+	// PEM file with the CAs used to verify the broker certificate.
+	CAFile string
+	// PEM files with the client certificate and its key.
+	CertFile string
+	KeyFile  string
+	// Name used to verify the broker certificate, the uri host by default.
+	ServerName string
+	// Min TLS version: 1.0, 1.1, 1.2 or 1.3.
+	MinVersion string
+	// Authenticate with the client certificate using the EXTERNAL SASL
+	// mechanism instead of the credentials in the uri.
+	ExternalAuth bool
+}
+
+var (
+	tlsMutex     = &sync.RWMutex{}
+	tlsConfig    *tls.Config
+	externalAuth bool
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// SetTLSOptions sets the options used to connect to the broker
+// with TLS. It fails if any of the files can't be loaded.
+func SetTLSOptions(options TLSOptions) error {
+	config, err := newTLSConfig(options)
+	if err != nil {
+		return err
+	}
+	if options.ExternalAuth && options.CertFile == "" {
+		return fmt.Errorf("the EXTERNAL auth mechanism needs a client certificate")
+	}
+	tlsMutex.Lock()
+	defer tlsMutex.Unlock()
+	tlsConfig = config
+	externalAuth = options.ExternalAuth
+	return nil
+}
+
+func newTLSConfig(options TLSOptions) (*tls.Config, error) {
+	config := &tls.Config{ServerName: options.ServerName}
+	if options.CAFile != "" {
+		pem, err := ioutil.ReadFile(options.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in '%s'", options.CAFile)
+		}
+	}
+	if options.CertFile != "" || options.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(options.CertFile, options.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if options.MinVersion != "" {
+		version, ok := tlsVersions[options.MinVersion]
+		if !ok {
+			return nil, fmt.Errorf("invalid TLS version '%s'", options.MinVersion)
+		}
+		config.MinVersion = version
+	}
+	return config, nil
+}
+
+// Get the config used to dial the broker. Every connection gets its
+// own copy of the TLS config, the amqp library sets the server name
+// on it when there is none.
+func getDialConfig() amqp.Config {
+	tlsMutex.RLock()
+	defer tlsMutex.RUnlock()
+	config := amqp.Config{
+		// Same defaults amqp.Dial uses.
+		Heartbeat: 10 * time.Second,
+		Locale:    "en_US",
+	}
+	if tlsConfig != nil {
+		config.TLSClientConfig = tlsConfig.Clone()
+	}
+	if externalAuth {
+		config.SASL = []amqp.Authentication{&externalAuthentication{}}
+	}
+	return config
+}
+
+// The EXTERNAL SASL mechanism, the broker takes the identity
+// from the client certificate.
+type externalAuthentication struct{}
+
+func (auth *externalAuthentication) Mechanism() string {
+	return "EXTERNAL"
+}
+
+func (auth *externalAuthentication) Response() string {
+	return ""
+}
@@ -0,0 +1,190 @@
+package async
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAMQPTransportConnectWithTLS(t *testing.T) {
+	certs := _createTestCertificates(t)
+	defer os.RemoveAll(certs.dir)
+	handshakes, addr := _startTLSStandIn(t, certs)
+	err := SetTLSOptions(TLSOptions{
+		CAFile:     certs.caFile,
+		CertFile:   certs.certFile,
+		KeyFile:    certs.keyFile,
+		ServerName: "localhost",
+		MinVersion: "1.2",
+	})
+	assert.Nil(t, err)
+	defer SetTLSOptions(TLSOptions{})
+	tr := NewAMQPTransport(fmt.Sprintf("amqps://%s", addr))
+	// The stand-in closes the connection once the TLS handshake is done.
+	assert.Error(t, tr.Connect())
+	state := <-handshakes
+	assert.True(t, state.HandshakeComplete)
+	assert.Equal(t, "localhost", state.ServerName)
+	assert.Equal(t, 1, len(state.PeerCertificates))
+	assert.Equal(t, "postman", state.PeerCertificates[0].Subject.CommonName)
+	assert.True(t, state.Version >= tls.VersionTLS12)
+}
+
+func TestAMQPTransportConnectWithUnknownCA(t *testing.T) {
+	certs := _createTestCertificates(t)
+	defer os.RemoveAll(certs.dir)
+	_, addr := _startTLSStandIn(t, certs)
+	assert.Nil(t, SetTLSOptions(TLSOptions{ServerName: "localhost"}))
+	defer SetTLSOptions(TLSOptions{})
+	err := NewAMQPTransport(fmt.Sprintf("amqps://%s", addr)).Connect()
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "certificate")
+}
+
+func TestSetTLSOptionsMinVersion(t *testing.T) {
+	defer SetTLSOptions(TLSOptions{})
+	assert.Nil(t, SetTLSOptions(TLSOptions{MinVersion: "1.3"}))
+	assert.Equal(t, uint16(tls.VersionTLS13), getDialConfig().TLSClientConfig.MinVersion)
+}
+
+func TestSetTLSOptionsInvalid(t *testing.T) {
+	defer SetTLSOptions(TLSOptions{})
+	assert.Error(t, SetTLSOptions(TLSOptions{CAFile: "/does/not/exist.pem"}))
+	assert.Error(t, SetTLSOptions(TLSOptions{MinVersion: "0.9"}))
+	assert.Error(t, SetTLSOptions(TLSOptions{ExternalAuth: true}))
+}
+
+func TestDialConfigWithExternalAuth(t *testing.T) {
+	certs := _createTestCertificates(t)
+	defer os.RemoveAll(certs.dir)
+	err := SetTLSOptions(TLSOptions{
+		CertFile:     certs.certFile,
+		KeyFile:      certs.keyFile,
+		ExternalAuth: true,
+	})
+	assert.Nil(t, err)
+	defer SetTLSOptions(TLSOptions{})
+	config := getDialConfig()
+	assert.Equal(t, 1, len(config.SASL))
+	assert.Equal(t, "EXTERNAL", config.SASL[0].Mechanism())
+	assert.Equal(t, "", config.SASL[0].Response())
+	// Each connection gets its own TLS config.
+	assert.False(t, config.TLSClientConfig == getDialConfig().TLSClientConfig)
+}
+
+type _testCertificates struct {
+	dir      string
+	caFile   string
+	certFile string
+	keyFile  string
+	server   tls.Certificate
+	caPool   *x509.CertPool
+}
+
+// Create a CA along with a server certificate for localhost and
+// a client certificate, both signed by the CA.
+func _createTestCertificates(t *testing.T) *_testCertificates {
+	dir, err := ioutil.TempDir("", "postman-tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	caTemplate := _certificateTemplate(1, "postman-ca")
+	caTemplate.IsCA = true
+	caTemplate.BasicConstraintsValid = true
+	caTemplate.KeyUsage = x509.KeyUsageCertSign
+	caDER, err := x509.CreateCertificate(rand.Reader, caTemplate, caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, _ := x509.ParseCertificate(caDER)
+	certs := &_testCertificates{
+		dir:      dir,
+		caFile:   filepath.Join(dir, "ca.pem"),
+		certFile: filepath.Join(dir, "client.pem"),
+		keyFile:  filepath.Join(dir, "client.key"),
+		caPool:   x509.NewCertPool(),
+	}
+	certs.caPool.AddCert(ca)
+	_writePEM(t, certs.caFile, "CERTIFICATE", caDER)
+	// Server
+	serverKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	serverTemplate := _certificateTemplate(2, "localhost")
+	serverTemplate.DNSNames = []string{"localhost"}
+	serverTemplate.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	serverDER, err := x509.CreateCertificate(rand.Reader, serverTemplate, ca, &serverKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs.server = tls.Certificate{Certificate: [][]byte{serverDER}, PrivateKey: serverKey}
+	// Client
+	clientKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	clientTemplate := _certificateTemplate(3, "postman")
+	clientTemplate.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	clientDER, err := x509.CreateCertificate(rand.Reader, clientTemplate, ca, &clientKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_writePEM(t, certs.certFile, "CERTIFICATE", clientDER)
+	keyDER, _ := x509.MarshalECPrivateKey(clientKey)
+	_writePEM(t, certs.keyFile, "EC PRIVATE KEY", keyDER)
+	return certs
+}
+
+func _certificateTemplate(serial int64, commonName string) *x509.Certificate {
+	return &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+}
+
+func _writePEM(t *testing.T, file string, blockType string, der []byte) {
+	data := pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der})
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// A TLS-terminating stand-in for the broker. It asks for a client
+// certificate, sends the state of each handshake and hangs up.
+func _startTLSStandIn(t *testing.T, certs *_testCertificates) (chan tls.ConnectionState, string) {
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{certs.server},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    certs.caPool,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	handshakes := make(chan tls.ConnectionState, 1)
+	go func() {
+		defer listener.Close()
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		tlsConn := conn.(*tls.Conn)
+		if err := tlsConn.Handshake(); err == nil {
+			handshakes <- tlsConn.ConnectionState()
+		}
+	}()
+	return handshakes, listener.Addr().(*net.TCPAddr).String()
+}
@@ -0,0 +1,144 @@
+package async
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrNotConnected is returned when trying to use a transport
+// that has no open connection to the broker.
+var ErrNotConnected = errors.New("not connected to the broker")
+
+// ErrUnroutable is returned when the message can't
+// be routed to any queue, the queue doesn't exist.
+var ErrUnroutable = errors.New("the message can't be routed to any queue")
+
+// ErrPreconditionFailed is returned when declaring a queue
+// that already exists with different arguments.
+var ErrPreconditionFailed = errors.New("the queue exists with different arguments")
+
+// ErrNotConfirmed is returned when the broker doesn't confirm
+// it took care of the message.
+var ErrNotConfirmed = errors.New("the broker didn't confirm the message")
+
+// Transport is the abstraction over the message broker.
+// The async package only talks to the broker through this interface,
+// that way we can plug in different brokers (AMQP, in-memory, etc)
+// without changing the request/response logic.
+type Transport interface {
+	// Connect opens the connection to the broker.
+	// It must return an error if the connection can't be established.
+	Connect() error
+	// NotifyClose returns a channel that will receive a single value
+	// once the connection gets closed. The value will be nil when
+	// the connection was closed gracefully via Close.
+	NotifyClose() <-chan error
+	// DeclareQueue makes sure the queue exists on the broker. It fails with
+	// ErrPreconditionFailed if it exists already with other arguments.
+	DeclareQueue(name string, options QueueOptions) error
+	// Publish sends a new message to the given queue. It returns once the
+	// broker takes care of the message, or with ErrUnroutable when the
+	// queue doesn't exist and ErrNotConfirmed when the broker rejects it.
+	Publish(queueName string, message *Message) error
+	// BindQueue binds the queue to the broadcast exchange, every
+	// message broadcasted to the exchange will get to the queue.
+	// The exchange is created if it doesn't exist.
+	BindQueue(queueName string, exchange string) error
+	// Broadcast sends a new message to every queue bound to the exchange.
+	// Messages sent to an exchange with no queues bound are dropped, that
+	// is not an error.
+	Broadcast(exchange string, message *Message) error
+	// Consume starts consuming messages from the given queue.
+	// The returned channel will be closed when the consumer stops.
+	Consume(queueName string, options ConsumeOptions) (<-chan *Delivery, error)
+	// Cancel stops the consumer with the given tag. The deliveries channel
+	// gets closed, deliveries not acked yet can still be acked.
+	Cancel(consumer string) error
+	// Consumers returns the number of consumers for a given queue.
+	// An error will be returned if the queue does not exist.
+	Consumers(queueName string) (int, error)
+	// Close the connection to the broker.
+	Close() error
+}
+
+// QueueOptions are the options used when declaring a new queue.
+type QueueOptions struct {
+	Durable    bool
+	AutoDelete bool
+	Exclusive  bool
+	Args       map[string]interface{}
+}
+
+// ConsumeOptions are the options used when consuming a queue.
+type ConsumeOptions struct {
+	AutoAck   bool
+	Exclusive bool
+	// Consumer is the tag used to cancel the consumer.
+	// Consumers without a tag can't be canceled.
+	Consumer string
+	// Prefetch is the max number of unacked messages that will
+	// be delivered to the consumer. Zero means no limit.
+	Prefetch int
+}
+
+// Message is the broker agnostic representation of a message.
+type Message struct {
+	Body    []byte
+	Headers map[string]interface{}
+	// ContentEncoding is the compression of the body, empty when
+	// it isn't compressed.
+	ContentEncoding string
+	// Expiration is the time the message can wait in the queue
+	// before the broker drops it. Zero means it never expires.
+	Expiration time.Duration
+	// Run once the delivery of the message is acked.
+	ackHooks *ackHooks
+}
+
+// Clone creates a copy of the message, headers included.
+func (m *Message) Clone() *Message {
+	msg := &Message{
+		Body:            append([]byte(nil), m.Body...),
+		ContentEncoding: m.ContentEncoding,
+		Expiration:      m.Expiration,
+	}
+	if m.Headers != nil {
+		msg.Headers = map[string]interface{}{}
+		for name, value := range m.Headers {
+			msg.Headers[name] = value
+		}
+	}
+	return msg
+}
+
+// Acknowledger is implemented by each transport to
+// ack or reject the deliveries.
+type Acknowledger interface {
+	Ack() error
+	Nack(requeue bool) error
+}
+
+// Delivery is a message received from a queue.
+type Delivery struct {
+	Message
+	Redelivered  bool
+	Acknowledger Acknowledger
+}
+
+// Ack acknowledges the delivery. When the queue is being consumed
+// with AutoAck, this is a no-op.
+func (d *Delivery) Ack() error {
+	if d.Acknowledger == nil {
+		return nil
+	}
+	return d.Acknowledger.Ack()
+}
+
+// Nack rejects the delivery and optionally puts it back
+// in the queue.
+func (d *Delivery) Nack(requeue bool) error {
+	if d.Acknowledger == nil {
+		return nil
+	}
+	return d.Acknowledger.Nack(requeue)
+}
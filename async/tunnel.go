@@ -0,0 +1,270 @@
+package async
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/rgamba/postman/async/protobuf"
+	"github.com/rgamba/postman/middleware"
+	"github.com/satori/go.uuid"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Headers used by the tunnels.
+const (
+	// Set on the request by the requester, and on the response by the
+	// responder, the session queue each end reads the tunnel data from.
+	headerTunnel = "tunnel"
+	// Set on the message that closes the tunnel, which has no body.
+	headerTunnelClose = "tunnel_close"
+)
+
+// ErrTunnelNotRequested is returned when a tunnel can't be
+// opened because the requester didn't ask for it.
+var ErrTunnelNotRequested = errors.New("The requester didn't ask for a tunnel")
+
+// Tunnel is a two way stream of bytes between two instances. Each
+// end reads from its own session queue and writes to the queue of
+// the other end, that way both ends stay pinned to each other
+// for the whole session.
+type Tunnel struct {
+	id string
+	// Session queue we read from and session queue of the other end.
+	queue      string
+	peer       string
+	deliveries <-chan *Delivery
+	// Data of the last message not read yet.
+	pending []byte
+	mutex   sync.Mutex
+	// Set once the other end closes the tunnel.
+	peerClosed bool
+	closeOnce  sync.Once
+}
+
+// Create the session queue of a new tunnel and start reading from it.
+// The queue is gone once we stop reading from it.
+func newTunnel(id string) (*Tunnel, error) {
+	if transport == nil {
+		return nil, ErrNotConnected
+	}
+	queue := fmt.Sprintf("postman.tunnel.%s", uuid.NewV4())
+	if err := transport.DeclareQueue(queue, QueueOptions{AutoDelete: true}); err != nil {
+		return nil, err
+	}
+	deliveries, err := transport.Consume(queue, ConsumeOptions{
+		AutoAck:   true,
+		Exclusive: true,
+		Consumer:  queue,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Tunnel{id: id, queue: queue, deliveries: deliveries}, nil
+}
+
+// SendTunnelRequestMessage does the same as SendRequestMessageWithDeadline
+// but the responder can open a tunnel to us along with the response. In
+// that case onResponse gets the tunnel too, the deadline doesn't apply to
+// it. The tunnel is nil if the responder didn't open it, and it must be
+// closed once we are done with it.
+func SendTunnelRequestMessage(serviceName string, request *protobuf.Request, deadline time.Time, onResponse func(*protobuf.Response, *Tunnel, *Error)) {
+	setRequestIDIfEmpty(request)
+	tunnel, err := newTunnel(request.Id)
+	if err != nil {
+		go onResponse(nil, nil, createError(ErrorCodeBrokerUnavailable, err.Error(), nil))
+		return
+	}
+	sendRequestMessage(serviceName, request, deadline, &requestRecord{
+		tunnel: tunnel,
+		onResponse: func(resp *protobuf.Response, err *Error) {
+			if err != nil || tunnel.getPeer() == "" {
+				tunnel.Close()
+				onResponse(resp, nil, err)
+				return
+			}
+			onResponse(resp, tunnel, nil)
+		},
+	})
+}
+
+// Let the responder know where to send the tunnel data to.
+func setTunnelHeader(headers map[string]interface{}, requestRecord *requestRecord) {
+	if requestRecord.tunnel != nil {
+		headers[headerTunnel] = requestRecord.tunnel.queue
+	}
+}
+
+// The responder opened the tunnel along with the response. The
+// tunnel is closed if nobody is waiting for the response anymore.
+func matchTunnelAndSendCallback(response *protobuf.Response, queue string) error {
+	requestRecord := getResponseRequest(response.RequestId)
+	if requestRecord == nil || requestRecord.tunnel == nil {
+		sendTunnelClose(response.RequestId, queue)
+		return matchResponseAndSendCallback(response)
+	}
+	requestRecord.tunnel.setPeer(queue)
+	return matchResponseAndSendCallback(response)
+}
+
+func (t *Tunnel) setPeer(queue string) {
+	t.mutex.Lock()
+	t.peer = queue
+	t.mutex.Unlock()
+}
+
+func (t *Tunnel) getPeer() string {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	return t.peer
+}
+
+// Read reads the data sent by the other end. It returns io.EOF
+// once the other end closes the tunnel or we close it.
+func (t *Tunnel) Read(p []byte) (int, error) {
+	if len(t.pending) == 0 {
+		d, ok := <-t.deliveries
+		if !ok {
+			return 0, io.EOF
+		}
+		if _, ok := d.Message.Headers[headerTunnelClose]; ok {
+			t.mutex.Lock()
+			t.peerClosed = true
+			t.mutex.Unlock()
+			return 0, io.EOF
+		}
+		t.pending = d.Message.Body
+	}
+	n := copy(p, t.pending)
+	t.pending = t.pending[n:]
+	return n, nil
+}
+
+// Write sends p to the other end. It fails once the other end is
+// gone, its session queue doesn't exist anymore by then.
+func (t *Tunnel) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	headers := map[string]interface{}{
+		headerRequestID: t.id,
+	}
+	if err := publishMessage(append([]byte(nil), p...), headers, t.getPeer()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close stops reading from the tunnel and lets the other end know,
+// unless it was the one closing the tunnel.
+func (t *Tunnel) Close() error {
+	t.closeOnce.Do(func() {
+		if err := transport.Cancel(t.queue); err != nil {
+			log.WithFields(log.Fields{
+				"error":      err,
+				"request_id": t.id,
+			}).Warn("Unable to stop reading from the tunnel")
+		}
+		t.mutex.Lock()
+		peer, peerClosed := t.peer, t.peerClosed
+		t.mutex.Unlock()
+		if peer != "" && !peerClosed {
+			sendTunnelClose(t.id, peer)
+		}
+	})
+	return nil
+}
+
+// Let the other end know the tunnel is closed. The other end may
+// be gone already, we have nothing else to do in that case.
+func sendTunnelClose(id string, queue string) {
+	headers := map[string]interface{}{
+		headerRequestID:   id,
+		headerTunnelClose: int32(1),
+	}
+	if err := publishMessage(nil, headers, queue); err != nil && err.Code != ErrorCodeQueueNotFound {
+		log.WithFields(log.Fields{
+			"error":      err,
+			"request_id": id,
+		}).Warn("Unable to close the tunnel")
+	}
+}
+
+type tunnelStateKey struct{}
+
+// What we need to know to open a tunnel along with the
+// response of the request being processed.
+type tunnelState struct {
+	request *protobuf.Request
+	version int
+	// Session queue of the requester.
+	peer      string
+	encodings string
+	opened    bool
+}
+
+// Keep what we need to open a tunnel in the context, if the requester asked for it.
+func withTunnelState(ctx context.Context, msg *Message, request *protobuf.Request, version int, encodings string) context.Context {
+	peer := getHeaderString(msg.Headers, headerTunnel)
+	if peer == "" || request.ResponseQueue == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, tunnelStateKey{}, &tunnelState{
+		request:   request,
+		version:   version,
+		peer:      peer,
+		encodings: encodings,
+	})
+}
+
+// CanOpenTunnel checks if a tunnel can be opened along with the
+// response to the request being processed with the given context.
+func CanOpenTunnel(ctx context.Context) bool {
+	state, ok := ctx.Value(tunnelStateKey{}).(*tunnelState)
+	return ok && !state.opened
+}
+
+// IsTunnelOpened checks if a tunnel was opened along with the response
+// to the request being processed with the given context.
+func IsTunnelOpened(ctx context.Context) bool {
+	state, ok := ctx.Value(tunnelStateKey{}).(*tunnelState)
+	return ok && state.opened
+}
+
+// OpenTunnel sends the response to the requester along with a new tunnel
+// to it. The tunnel outlives the context and must be closed once we are
+// done with it. The response isn't sent again once the ResponseMiddleware
+// returns.
+func OpenTunnel(ctx context.Context, response *protobuf.Response) (*Tunnel, error) {
+	state, ok := ctx.Value(tunnelStateKey{}).(*tunnelState)
+	if !ok || state.opened {
+		return nil, ErrTunnelNotRequested
+	}
+	middleware.ProcessIncomingResponseMiddlewares(response)
+	message, err := encodeResponse(response, state.version)
+	if err != nil {
+		return nil, err
+	}
+	tunnel, err := newTunnel(state.request.Id)
+	if err != nil {
+		return nil, err
+	}
+	tunnel.setPeer(state.peer)
+	headers := map[string]interface{}{
+		headerVersion:    int32(state.version),
+		headerMaxVersion: int32(MessageVersion),
+		headerRequestID:  state.request.Id,
+		headerTunnel:     tunnel.queue,
+	}
+	message = compressMessage(message, headers, state.encodings)
+	if err := publishMessage(message, headers, state.request.ResponseQueue); err != nil {
+		tunnel.Close()
+		return nil, err
+	}
+	state.opened = true
+	return tunnel, nil
+}
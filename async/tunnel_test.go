@@ -0,0 +1,140 @@
+package async
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/rgamba/postman/async/protobuf"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTunnel(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	defer func() { ResponseMiddleware = nil }()
+	closed := _setEchoTunnelMiddleware()
+	resp, tunnel := _sendTunnelRequest(t)
+	assert.Equal(t, int32(101), resp.StatusCode)
+	tunnel.Write([]byte("hello"))
+	buf := make([]byte, 3)
+	n, err := tunnel.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "hel", string(buf[:n]))
+	n, err = tunnel.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, "lo", string(buf[:n]))
+	// The other end gets to know we closed the tunnel.
+	tunnel.Close()
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("The tunnel was not closed on the other end")
+	}
+}
+
+func TestTunnelClosedByTheResponder(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	defer func() { ResponseMiddleware = nil }()
+	ResponseMiddleware = func(ctx context.Context, req *protobuf.Request) (*protobuf.Response, error) {
+		resp := &protobuf.Response{RequestId: req.Id, StatusCode: 101}
+		tunnel, err := OpenTunnel(ctx, resp)
+		if err != nil {
+			return nil, err
+		}
+		tunnel.Write([]byte("bye"))
+		tunnel.Close()
+		return resp, nil
+	}
+	_, tunnel := _sendTunnelRequest(t)
+	defer tunnel.Close()
+	data, err := ioutil.ReadAll(tunnel)
+	assert.Nil(t, err)
+	assert.Equal(t, "bye", string(data))
+}
+
+func TestTunnelNotOpened(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	defer func() { ResponseMiddleware = nil }()
+	ResponseMiddleware = func(ctx context.Context, req *protobuf.Request) (*protobuf.Response, error) {
+		return &protobuf.Response{RequestId: req.Id, StatusCode: 400}, nil
+	}
+	c := make(chan bool)
+	req := &protobuf.Request{Method: "GET", ResponseQueue: ResponseQueueName}
+	SendTunnelRequestMessage("test-service", req, time.Time{}, func(resp *protobuf.Response, tunnel *Tunnel, err *Error) {
+		assert.Nil(t, err)
+		assert.Nil(t, tunnel)
+		assert.Equal(t, int32(400), resp.StatusCode)
+		close(c)
+	})
+	<-c
+}
+
+func TestTunnelNotRequested(t *testing.T) {
+	_connect()
+	defer _close_connection()
+	defer func() { ResponseMiddleware = nil }()
+	tunnelErr := make(chan error, 1)
+	ResponseMiddleware = func(ctx context.Context, req *protobuf.Request) (*protobuf.Response, error) {
+		assert.False(t, CanOpenTunnel(ctx))
+		_, err := OpenTunnel(ctx, &protobuf.Response{RequestId: req.Id, StatusCode: 101})
+		tunnelErr <- err
+		return &protobuf.Response{RequestId: req.Id, StatusCode: 200}, nil
+	}
+	c := make(chan bool)
+	req := &protobuf.Request{Method: "GET", ResponseQueue: ResponseQueueName}
+	SendRequestMessage("test-service", req, func(resp *protobuf.Response, err *Error) {
+		assert.Nil(t, err)
+		assert.Equal(t, int32(200), resp.StatusCode)
+		close(c)
+	})
+	<-c
+	assert.Equal(t, ErrTunnelNotRequested, <-tunnelErr)
+}
+
+// Whatever is sent through the tunnel is sent back, closed
+// gets closed once the requester closes the tunnel.
+func _setEchoTunnelMiddleware() chan bool {
+	closed := make(chan bool)
+	ResponseMiddleware = func(ctx context.Context, req *protobuf.Request) (*protobuf.Response, error) {
+		resp := &protobuf.Response{RequestId: req.Id, StatusCode: 101}
+		tunnel, err := OpenTunnel(ctx, resp)
+		if err != nil {
+			return nil, err
+		}
+		go func() {
+			io.Copy(tunnel, tunnel)
+			tunnel.Close()
+			close(closed)
+		}()
+		return resp, nil
+	}
+	return closed
+}
+
+func _sendTunnelRequest(t *testing.T) (*protobuf.Response, *Tunnel) {
+	type result struct {
+		resp   *protobuf.Response
+		tunnel *Tunnel
+	}
+	c := make(chan result, 1)
+	req := &protobuf.Request{Method: "GET", ResponseQueue: ResponseQueueName}
+	SendTunnelRequestMessage("test-service", req, time.Time{}, func(resp *protobuf.Response, tunnel *Tunnel, err *Error) {
+		assert.Nil(t, err)
+		c <- result{resp, tunnel}
+	})
+	select {
+	case r := <-c:
+		if r.tunnel == nil {
+			t.Fatal("The tunnel was not opened")
+		}
+		return r.resp, r.tunnel
+	case <-time.After(time.Second):
+		t.Fatal("No response")
+	}
+	return nil, nil
+}
@@ -0,0 +1,107 @@
+package async
+
+import (
+	"fmt"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// MessageVersion is the highest message version we are able to publish.
+const MessageVersion = 2
+
+const (
+	headerVersion = "version"
+	headerRetry   = "retry"
+)
+
+var (
+	// The message versions this instance is able to process.
+	supportedVersions = map[int]bool{1: true, 2: true}
+	// Number of times a message with an unsupported version will be
+	// put back in the queue before giving up.
+	maxVersionRetries = 3
+)
+
+// SetMaxVersionRetries sets the number of times a request message with
+// an unsupported version will be put back in the request queue, so other
+// instance can process it, before sending an invalid_version error back.
+func SetMaxVersionRetries(retries int) {
+	if retries < 0 {
+		retries = 0
+	}
+	maxVersionRetries = retries
+}
+
+// Get the message version. Messages published before versioning
+// was introduced don't have the version header, those are version 1.
+func getMessageVersion(msg *Message) int {
+	if _, ok := msg.Headers[headerVersion]; !ok {
+		return 1
+	}
+	return getHeaderInt(msg.Headers, headerVersion)
+}
+
+func isSupportedVersion(msg *Message) bool {
+	return supportedVersions[getMessageVersion(msg)]
+}
+
+// We are not able to process the message, so we'll put a clone back in the
+// request queue with the retry header incremented. Once we reach the max
+// number of retries, an invalid_version error will be sent to the requester
+// and the message goes to the dead letter queue.
+func requeueInvalidVersion(msg *Message) error {
+	version := getMessageVersion(msg)
+	retries := getHeaderInt(msg.Headers, headerRetry)
+	log.WithFields(log.Fields{
+		"version": version,
+		"retry":   retries,
+	}).Warn("Unsupported message version")
+	if retries >= maxVersionRetries {
+		err := createError(ErrorCodeInvalidVersion, fmt.Sprintf("Unsupported message version %d", version), nil)
+		sendErrorMessage(
+			getHeaderString(msg.Headers, headerResponseQueue),
+			getHeaderString(msg.Headers, headerRequestID),
+			err,
+		)
+		return newRequestError(ErrorCodeInvalidVersion, err)
+	}
+	clone := msg.Clone()
+	if clone.Headers == nil {
+		clone.Headers = map[string]interface{}{}
+	}
+	clone.Headers[headerRetry] = int32(retries + 1)
+	setMessageExpiration(clone)
+	return publishRequeued(clone)
+}
+
+// Get a header value as an int. Each transport may decode
+// numbers differently so we need to take all of them into account.
+func getHeaderInt(headers map[string]interface{}, name string) int {
+	switch value := headers[name].(type) {
+	case int:
+		return value
+	case int8:
+		return int(value)
+	case int16:
+		return int(value)
+	case int32:
+		return int(value)
+	case int64:
+		return int(value)
+	case uint8:
+		return int(value)
+	case uint16:
+		return int(value)
+	case uint32:
+		return int(value)
+	case float32:
+		return int(value)
+	case float64:
+		return int(value)
+	case string:
+		i, _ := strconv.Atoi(value)
+		return i
+	}
+	return 0
+}
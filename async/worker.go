@@ -0,0 +1,77 @@
+package async
+
+import (
+	"sync"
+
+	"github.com/rgamba/postman/stats"
+
+	log "github.com/sirupsen/logrus"
+)
+
+var (
+	// Number of workers processing request messages concurrently.
+	concurrency = 1
+	// Max number of unacked request messages the broker will deliver
+	// to this instance at any given time.
+	prefetch = 1
+	// Gets closed once the current pool of workers stops.
+	workersDone      chan struct{}
+	workersDoneMutex sync.Mutex
+)
+
+// SetConcurrency sets the number of workers that will process the
+// incoming requests concurrently and the prefetch count of the request
+// queue. A prefetch count of zero will default to the number of workers.
+// This must be called before Connect.
+func SetConcurrency(workers int, prefetchCount int) {
+	if workers < 1 {
+		workers = 1
+	}
+	if prefetchCount <= 0 {
+		prefetchCount = workers
+	}
+	concurrency = workers
+	prefetch = prefetchCount
+}
+
+// Start the pool of workers that will process the request messages.
+// Each delivery gets acked by its worker as soon as it is done processing it.
+func startRequestWorkers(msgs <-chan *Delivery) {
+	done := make(chan struct{})
+	workersDoneMutex.Lock()
+	workersDone = done
+	workersDoneMutex.Unlock()
+	var wait sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wait.Add(1)
+		go func(worker int) {
+			defer wait.Done()
+			requestWorker(worker, msgs)
+		}(i)
+	}
+	go func() {
+		wait.Wait()
+		log.Warn("Stopped consuming request messages")
+		close(done)
+	}()
+}
+
+// Get a channel that gets closed once the workers stop.
+func getWorkersDone() <-chan struct{} {
+	workersDoneMutex.Lock()
+	defer workersDoneMutex.Unlock()
+	if workersDone == nil {
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+	return workersDone
+}
+
+func requestWorker(worker int, msgs <-chan *Delivery) {
+	for d := range msgs {
+		stats.RecordWorkerStart(worker)
+		processRequestDelivery(d)
+		stats.RecordWorkerDone(worker)
+	}
+}
@@ -0,0 +1,132 @@
+package blob
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/satori/go.uuid"
+	log "github.com/sirupsen/logrus"
+)
+
+// FileStore keeps the blobs as files in a directory. The directory
+// must be shared by all the instances, a shared volume for example.
+type FileStore struct {
+	dir string
+}
+
+// NewFileStore creates a store in the given directory, the directory
+// is created if it doesn't exist yet.
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+// Put writes the blob to a temp file first, that way readers
+// never get to see a half written blob.
+func (s *FileStore) Put(r io.Reader) (string, error) {
+	file, err := ioutil.TempFile(s.dir, ".tmp-")
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(file, r)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	ref := fmt.Sprintf("%s", uuid.NewV4())
+	if err := os.Rename(file.Name(), filepath.Join(s.dir, ref)); err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return ref, nil
+}
+
+// Get opens the blob file.
+func (s *FileStore) Get(ref string) (io.ReadCloser, int64, error) {
+	if !isValidRef(ref) {
+		return nil, 0, ErrNotFound
+	}
+	file, err := os.Open(filepath.Join(s.dir, ref))
+	if os.IsNotExist(err) {
+		return nil, 0, ErrNotFound
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return file, info.Size(), nil
+}
+
+// Delete removes the blob file.
+func (s *FileStore) Delete(ref string) error {
+	if !isValidRef(ref) {
+		return nil
+	}
+	err := os.Remove(filepath.Join(s.dir, ref))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Prune removes the blobs older than maxAge, nobody is going to ask for
+// them anymore. Those are the blobs of requests that expired or timed out
+// before they got processed. It returns the number of blobs removed.
+func (s *FileStore) Prune(maxAge time.Duration) (int, error) {
+	files, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, file := range files {
+		if file.IsDir() || time.Since(file.ModTime()) < maxAge {
+			continue
+		}
+		if err := os.Remove(filepath.Join(s.dir, file.Name())); err == nil {
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// StartPruning prunes the store every interval until the process exits.
+func (s *FileStore) StartPruning(maxAge time.Duration, interval time.Duration) {
+	if maxAge <= 0 || interval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(interval) {
+			removed, err := s.Prune(maxAge)
+			if err != nil {
+				log.WithFields(log.Fields{
+					"error": err,
+				}).Error("Unable to prune the blob store")
+				continue
+			}
+			if removed > 0 {
+				log.WithFields(log.Fields{
+					"removed": removed,
+				}).Info("Pruned old blobs")
+			}
+		}
+	}()
+}
+
+// References can't point outside the store directory.
+func isValidRef(ref string) bool {
+	return ref != "" && !strings.HasPrefix(ref, ".") && !strings.ContainsAny(ref, `/\`)
+}
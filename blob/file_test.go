@@ -0,0 +1,69 @@
+package blob
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileStore(t *testing.T) {
+	store, dir := _createFileStore(t)
+	defer os.RemoveAll(dir)
+	ref, err := store.Put(strings.NewReader("test body"))
+	assert.Nil(t, err)
+	r, size, err := store.Get(ref)
+	if assert.Nil(t, err) {
+		content, _ := ioutil.ReadAll(r)
+		r.Close()
+		assert.Equal(t, "test body", string(content))
+		assert.Equal(t, int64(9), size)
+	}
+	assert.Nil(t, store.Delete(ref))
+	_, _, err = store.Get(ref)
+	assert.Equal(t, ErrNotFound, err)
+	assert.Nil(t, store.Delete(ref))
+}
+
+func TestFileStoreInvalidRef(t *testing.T) {
+	store, dir := _createFileStore(t)
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(filepath.Join(dir, "outside"), []byte("test"), 0644)
+	for _, ref := range []string{"", "../outside", ".tmp-123"} {
+		_, _, err := store.Get(ref)
+		assert.Equal(t, ErrNotFound, err)
+	}
+}
+
+func TestFileStorePrune(t *testing.T) {
+	store, dir := _createFileStore(t)
+	defer os.RemoveAll(dir)
+	old, _ := store.Put(strings.NewReader("old"))
+	recent, _ := store.Put(strings.NewReader("recent"))
+	hourAgo := time.Now().Add(-time.Hour)
+	os.Chtimes(filepath.Join(store.dir, old), hourAgo, hourAgo)
+	removed, err := store.Prune(time.Minute)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, removed)
+	_, _, err = store.Get(old)
+	assert.Equal(t, ErrNotFound, err)
+	_, _, err = store.Get(recent)
+	assert.Nil(t, err)
+}
+
+// The store lives in a subdirectory of the returned one.
+func _createFileStore(t *testing.T) (*FileStore, string) {
+	dir, err := ioutil.TempDir("", "postman-blob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := NewFileStore(filepath.Join(dir, "blobs"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return store, dir
+}
@@ -0,0 +1,24 @@
+// Package blob stores the message bodies that are too big to go through
+// the broker. The message carries a reference to the body instead, the
+// receiving end resolves the reference using the same store.
+package blob
+
+import (
+	"errors"
+	"io"
+)
+
+// ErrNotFound is returned when there is no blob with the given reference.
+var ErrNotFound = errors.New("blob not found")
+
+// Store is implemented by each storage backend. Every postman instance
+// sending or receiving blobs needs access to the same storage.
+type Store interface {
+	// Put saves the content of r and returns the reference to it.
+	Put(r io.Reader) (string, error)
+	// Get opens the blob for reading and returns its size.
+	Get(ref string) (io.ReadCloser, int64, error)
+	// Delete removes the blob, deleting a blob that
+	// doesn't exist is not an error.
+	Delete(ref string) error
+}
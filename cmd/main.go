@@ -2,9 +2,12 @@ package main
 
 import (
 	"flag"
+	"net/http"
 	"os"
+	"time"
 
 	"github.com/rgamba/postman/async"
+	"github.com/rgamba/postman/blob"
 	"github.com/rgamba/postman/dashboard"
 	"github.com/rgamba/postman/middleware/logger"
 	"github.com/rgamba/postman/middleware/trace"
@@ -40,28 +43,79 @@ func main() {
 		log.Info("Service name: ", cmd.Config.GetString("service.name"))
 	}
 
-	async.Connect(cmd.Config.GetString("broker.uri"), cmd.Config.GetString("service.name"))
-	defer async.Close()
+	async.SetConcurrency(cmd.Config.GetInt("message.concurrency"), cmd.Config.GetInt("message.prefetch"))
+	async.SetMaxVersionRetries(cmd.Config.GetInt("message.max_version_retries"))
+	async.SetMaxPendingRequests(cmd.Config.GetInt("message.max_pending_requests"))
+	async.SetMaxRedeliveries(cmd.Config.GetInt("message.max_redeliveries"))
+	async.SetStreaming(cmd.Config.GetInt("message.stream_window"), cmd.Config.GetDuration("message.stream_idle_timeout"))
+	async.SetChannelPoolSize(cmd.Config.GetInt("broker.channel_pool_size"))
+	async.SetConfirmTimeout(cmd.Config.GetDuration("broker.confirm_timeout"))
+	async.SetManagementURL(cmd.Config.GetString("broker.management_url"))
+	if err := async.SetBrokerDownMode(cmd.Config.GetString("broker.down_mode"), cmd.Config.GetInt("broker.buffer_size")); err != nil {
+		log.Fatal(err)
+	}
+	async.SetMaxBodySize(cmd.Config.GetInt("message.max_body_size"))
+	if err := async.SetCompression(cmd.Config.GetString("message.compression"), cmd.Config.GetInt("message.compression_threshold")); err != nil {
+		log.Fatal(err)
+	}
+	if err := async.SetOutbox(cmd.Config.GetString("outbox.dir")); err != nil {
+		log.Fatal(err)
+	}
+	if err := async.SetTLSOptions(cmd.Config.GetTLSOptions()); err != nil {
+		log.Fatal(err)
+	}
+	if err := async.SetFailoverStrategy(cmd.Config.GetString("broker.failover")); err != nil {
+		log.Fatal(err)
+	}
+	async.SetReconnectBackoff(cmd.Config.GetDuration("broker.reconnect_interval"), cmd.Config.GetDuration("broker.max_reconnect_interval"))
+	async.Connect(cmd.Config.GetBrokerURIs(), cmd.Config.GetString("service.name"))
 
 	activateMiddlewares(&cmd)
 
 	// Start http proxy server
-	proxy.StartHTTPServer(cmd.Config.GetInt("http.listen_port"), cmd.Config.GetString("http.fwd_host"))
+	proxy.SetTimeouts(cmd.Config.GetDuration("message.receive_timeout"), cmd.Config.GetServiceTimeouts())
+	proxy.SetRetryPolicy(cmd.Config.GetRetryPolicy())
+	proxy.SetIdempotencyCache(cmd.Config.GetInt("http.idempotency.cache_size"), cmd.Config.GetDuration("http.idempotency.ttl"))
+	setClaimCheck(&cmd)
+	servers := []*http.Server{
+		proxy.StartHTTPServer(cmd.Config.GetInt("http.listen_port"), cmd.Config.GetString("http.fwd_host")),
+	}
 	if cmd.isVerbose2() {
 		log.Infof("HTTP proxy server listening on 127.0.0.1:%d", cmd.Config.GetInt("http.listen_port"))
 	}
 
 	// Start the dashboard service
 	if cmd.Config.GetBool("dashboard.enabled") {
-		dashboard.StartHTTPServer(cmd.Config.GetInt("dashboard.listen_port"), cmd.Config.GetViper(), Version, Build)
+		servers = append(servers, dashboard.StartHTTPServer(cmd.Config.GetInt("dashboard.listen_port"), cmd.Config.GetViper(), Version, Build))
 		log.Infof("Dashboard HTTP server listening on 127.0.0.1:%d", cmd.Config.GetInt("dashboard.listen_port"))
 	}
 
 	// Stats module needs to purge data periodically.
 	stats.AutoPurgeOldEvents()
 
-	c := make(chan bool)
-	<-c
+	sig := waitForSignal()
+	log.Infof("Received %s, shutting down", sig)
+	shutdown(cmd.Config.GetDuration("shutdown.grace_period"), servers)
+}
+
+// Big bodies go through the blob store in the claim check directory.
+// Blobs nobody asked for in max_age are removed.
+func setClaimCheck(cmd *app) {
+	dir := cmd.Config.GetString("claim_check.dir")
+	if dir == "" {
+		return
+	}
+	store, err := blob.NewFileStore(dir)
+	if err != nil {
+		log.Fatal(err)
+	}
+	maxAge := cmd.Config.GetDuration("claim_check.max_age")
+	interval := time.Hour
+	if maxAge < interval {
+		interval = maxAge
+	}
+	store.StartPruning(maxAge, interval)
+	proxy.SetClaimCheck(store, int64(cmd.Config.GetInt("claim_check.threshold")))
 }
 
 func activateMiddlewares(cmd *app) {
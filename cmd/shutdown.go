@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/rgamba/postman/async"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Block until we get a signal to terminate.
+func waitForSignal() os.Signal {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	return <-signals
+}
+
+// Drain the instance and then shut down the HTTP servers, letting the
+// active requests finish. Everything must be done within the grace period,
+// once it expires we'll close the connection to the broker anyway and
+// the broker will put back in the queue any request we didn't ack.
+func shutdown(gracePeriod time.Duration, servers []*http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), gracePeriod)
+	defer cancel()
+	if err := async.Drain(gracePeriod); err != nil {
+		log.WithFields(log.Fields{
+			"error":            err,
+			"pending_requests": async.CountPendingRequests(),
+		}).Warn("Unable to drain")
+	}
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			log.WithFields(log.Fields{
+				"error":  err,
+				"server": srv.Addr,
+			}).Warn("Unable to shut down the HTTP server")
+		}
+	}
+	async.Close()
+	log.Info("Shut down")
+}
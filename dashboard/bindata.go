@@ -113,7 +113,7 @@ func AssetsHtmlHeaderHtml() (*asset, error) {
 	return a, nil
 }
 
-var _AssetsHtmlIndexHtml = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x00\xff\xec\x57\x4d\x6f\x1a\x3d\x10\xbe\xf3\x2b\xe6\xf5\x9b\xde\x6a\x36\x34\x69\x0e\xd1\xb2\x52\x95\x5c\xb8\xb4\x55\x5b\xf5\x6e\xec\x81\xb5\xba\xb6\xb7\xf6\x2c\x49\x8a\xf8\xef\xd5\xae\x81\x2e\x84\x0d\x24\xa5\x12\x52\x7b\x41\xb6\xe7\xc3\xf3\xcc\xcc\xc3\xac\xe7\x73\x42\x53\x16\x82\x10\x58\x8e\x42\xa1\xef\xe7\x64\x0a\x06\xfd\xc5\xa2\x97\x2a\x3d\x03\x59\x88\x10\x86\x4c\x3a\x4b\x42\x5b\xf4\x2c\xeb\xf5\x00\x00\xda\xc2\x40\xc2\x13\x7a\xbe\xf2\xc5\xb2\xa8\x92\x0f\xb2\x5b\x11\xf2\xb1\x13\x5e\xa5\x49\x3e\xd8\x61\xea\xdd\x1d\x83\x40\x0f\x05\x0e\x99\x11\x7e\xaa\x2d\x27\x57\x5e\xc3\xe5\x79\x79\xbf\x74\xb3\x6d\x22\x5d\xc1\x83\xe1\x57\x2d\xf1\x23\x15\xe1\xd5\x96\x78\x97\x0a\x1f\x3b\xf5\xb0\x43\x2f\x06\x7f\xb9\xa1\x4a\x9a\x0a\x64\xd9\x4d\xe5\x3d\x5a\x82\x80\x7e\xa6\x25\xa6\x49\x7e\xd9\x65\x7f\xb5\x61\x1f\xaa\x71\xe3\x02\xcc\x98\xbf\x01\xc2\x7b\xe2\xa6\x22\x54\x2c\xfb\x92\xeb\x00\xda\x06\x12\x56\x22\x68\x3b\x71\xfd\x34\xc9\xaf\x3a\xdc\x92\x18\x17\xb8\xf2\xdc\x6c\x76\xe6\xef\x62\x33\x7f\x8f\xdd\xf8\x6e\x61\x54\xc8\x21\x48\x57\x62\x2c\x51\xf6\x39\xe2\x05\x2b\x0c\xa6\x09\xe5\xfb\xac\x55\x96\x86\x52\xd8\x55\xa0\x63\xa1\xa6\x08\xcd\x2f\x2f\xbd\x36\xc2\x3f\xac\xc3\x9e\x38\x4b\x3c\xe8\x1f\x78\x0d\x83\xf3\xf3\x57\x2c\x9b\xcf\xfb\x32\xa6\x79\x79\xeb\x7b\x61\x70\xb1\x48\x93\xda\x63\x96\x26\xa4\x9e\x00\x96\x3c\x85\xec\xd9\xb0\xdf\x49\xd2\x33\x5c\x57\x27\x1c\x06\xfd\x11\x80\xd1\xca\xbe\x46\xf1\xb2\xf0\xd3\xa4\x29\x76\x87\x50\x40\xee\x71\x32\x64\xff\xb3\x8d\xa6\x2b\xb4\xfd\xc6\xb2\xaf\x1a\xef\xc0\x38\x8f\x69\x22\x76\x90\x22\x51\x7a\xb6\x45\xa5\xcd\xa3\xed\xed\xa9\x71\xb1\xf4\x4e\x62\x08\xc7\xe0\xe2\xc7\xe8\xea\x54\x59\xb8\x0a\x6f\x74\x7b\x70\x23\x2e\x93\x33\x52\x7f\xa0\xf5\x9e\xd5\x3a\xed\xe5\x01\x03\xe0\xe2\x44\x07\xc0\xc8\x4a\x67\x8c\xb6\x53\xf0\xf8\xbd\xc2\x40\x47\xe9\xbb\x1b\x67\x4c\x65\xb5\x14\xa4\x9d\x05\x8f\x85\x68\xfe\x77\xc8\x01\xb5\xa7\xc3\x11\x5a\x72\xf0\x76\x4f\x4b\xd6\x9f\x01\x7b\xbb\x32\xfb\x14\xc1\xd7\x79\x58\x8f\xc2\xfd\x1d\xb9\xb6\x0b\x50\x88\x40\x60\xb4\xad\x68\x8f\x65\x2d\x7d\x32\xa4\xf9\xdc\x0b\x3b\x45\x38\x0b\xbf\xa6\xc5\x6b\x38\x93\xae\xb2\x04\xd7\x43\xe8\xeb\xba\x64\xda\x4e\x57\x77\x2f\x16\xbf\xc3\xc8\x9a\x55\xed\xab\xf6\xf1\xaa\x65\xd5\x84\xf4\x72\x1e\x46\xb0\x68\x55\x07\x80\xe3\xf0\x14\x4e\x89\x6d\x1f\x2a\x9a\xba\xbf\x9e\x6c\xb7\x0d\xd3\x62\xb8\x27\xcf\x36\xb7\x2c\xd9\x3f\xb6\x75\x1e\x75\x4c\xc5\xb8\x6c\xd6\xbd\xb8\x49\xff\xe3\x1c\x92\xfe\xfa\xf1\x05\x9c\x67\xbd\xf6\x9b\x6d\xe2\x1c\xb5\xdf\x6c\x3f\x03\x00\x00\xff\xff\xb6\x3e\x1f\x0d\xd0\x0d\x00\x00")
+var _AssetsHtmlIndexHtml = []byte("\x1f\x8b\x08\x00\x00\x00\x00\x00\x02\xff\xed\x58\x59\x6f\xd3\x40\x10\x7e\xcf\xaf\x18\x4c\x91\x40\xc2\x49\x4b\x4b\x1f\xaa\xc4\x52\x0f\x90\x22\xa1\x82\x28\xe2\x7d\x63\x8f\xe3\x55\xed\xdd\xb0\xbb\xee\x65\xe5\xbf\x33\x6b\x3b\xae\x73\x9f\x85\x48\x90\x87\x68\x37\xb3\x33\xfb\xcd\xf1\x79\x26\xce\x32\x83\xc9\x20\x66\x06\xc1\x89\x90\x05\xa8\x9a\x91\x49\x62\x07\x9a\xc3\x61\xa3\x1d\xf0\x3b\xf0\x63\xa6\x75\xc7\xf1\xa5\x30\x8c\x0b\x54\x8e\xd7\x68\x00\x7d\xea\x42\x6d\x98\x32\xa8\xdc\x91\x2d\x3a\x93\x1f\x89\x8e\xbc\x2b\xa6\xa3\x9e\x64\x2a\x68\xb7\x68\x37\xad\xaa\xe4\xbd\x03\xda\x3c\xc6\xd8\x71\x12\xa6\xfa\x5c\xb8\x46\x0e\xce\xe0\xe4\x70\xf0\x50\x9a\x99\x54\xf1\x65\xec\xea\xc4\x3d\xad\x89\xa7\x8e\xd0\x85\x13\xe2\x59\x47\xdc\x9e\x0c\x1e\x67\x9c\x2b\xc0\x9f\x8c\x1d\x35\xdc\xc4\xe4\xd8\x65\xaa\x14\x0a\x03\x1a\xd5\x1d\xf7\x91\xbc\x3a\x99\xa7\x7f\x3a\xa6\xaf\xd3\x5e\x6e\x02\x92\x9e\xfb\x01\x0c\x3e\x18\x37\x49\x0d\x12\xcc\x1f\x11\xd7\xc0\x05\x05\x51\xf8\x48\x8b\x50\x36\xc9\xec\xe9\x1c\xb3\x86\xf5\xc8\x48\x69\x39\xdf\xcc\x8c\xdf\xf1\x78\xfc\xa6\xcd\xa8\xf9\xc2\xe2\x40\x04\xda\x97\x03\x2c\x52\xe4\xdd\x14\xfe\x82\x60\x09\x39\x6d\xa2\x65\xda\x81\xd7\xd6\x03\x26\x46\x40\x7b\x2c\xe8\x23\xe4\xdf\xee\x40\x71\x42\xfa\x58\xc1\x0e\xa9\xb4\x5c\xcd\x9f\xf0\x0c\x8e\x0e\x0f\xdf\x38\x5e\x96\x35\xfd\x22\xcc\xe5\xad\xd7\x74\xe9\x70\xd8\x6e\x59\x8b\x1e\xdd\x1e\x2c\x70\xac\xb5\xc8\xb3\xb5\xdd\x3e\xf7\x0d\xbf\xc3\x2a\x3b\x7a\x35\xd7\xa7\x1c\xe8\x8e\xf4\xad\x17\x9b\xc1\x27\x89\x4d\xf6\x1c\x21\x83\x48\x61\xd8\x71\x5e\x3b\x63\x45\x17\x73\x71\xeb\x78\x3f\x39\xde\x43\x22\x15\x25\x8e\xcd\x20\x45\x8b\x58\x31\x41\xa5\xf1\x9f\x26\xb7\xfb\xc6\xc5\x81\x92\x14\x5a\xbd\x0b\x2e\x7e\x2b\x4c\xed\x2b\x0b\x47\xf0\xba\x57\x2b\x17\x62\x19\x9c\x6e\xb0\x79\xe9\x6d\x04\xf5\x42\xc9\x5b\x54\x40\x7d\x43\x20\x91\x48\x8a\xd5\xa9\x53\xa9\xdc\x18\x6a\x26\x7f\x07\xb7\x90\x01\xae\x8c\xb8\x97\xeb\x58\xb4\xba\x79\x4d\x8a\x7f\x18\xf2\x65\x15\x30\x60\xc6\xf6\x60\xa3\x37\x82\x7e\x5e\x2a\x0f\x87\xf0\x76\x42\xf4\x99\xf1\x38\x55\xf6\xf9\x05\x21\x2d\x31\x78\xb7\x8d\x87\x59\xc6\x43\x18\xb3\xff\x85\x69\xf3\x49\x29\xa9\x68\xec\xd8\x59\x5c\xac\xd1\x5a\x01\x02\xda\x0b\x36\x8a\x4c\x0d\xde\x76\x7e\xa3\x08\x76\xe9\xe1\x45\x1a\x86\xa8\x30\x00\x85\xbf\x52\xd4\xeb\xe4\xbd\xd4\xfc\x5e\x2a\xbe\x40\x63\x5a\xab\xb1\xd4\x97\x2b\x8c\x87\xc7\x7b\x3a\x1e\x76\x85\x2f\x93\x84\x8b\x7e\x2d\x23\xdb\x77\xa5\x4b\xb2\x99\x0a\xee\xb3\xbc\x8c\x15\xd2\x8c\x6d\xa7\x12\x23\xc1\xd4\x67\xc7\x1d\x34\xac\xa3\x8f\x4b\x1a\x96\xfd\x93\xb0\xb4\x46\xbd\xb2\xaa\x6c\x1c\xaa\x41\x79\x79\x61\x56\x7a\x1a\x62\x4b\x5d\x8a\x23\xf9\xbf\x58\xd3\x4a\x17\x42\xca\x32\xc5\x04\xcd\x9e\x07\xfa\x79\x96\x7c\x0f\x07\xbe\x4c\x69\x72\x38\xeb\x40\x93\xdb\x94\x11\xd2\x67\x26\x6c\xc3\x4f\x4b\xae\xfa\x55\xcb\x78\x55\xd3\xca\x21\xbd\xdc\x03\x66\x37\x3c\xdd\x2b\xb6\x7d\x4d\x4d\x5f\xfe\xf3\x64\xbb\xca\x99\x56\xc0\xdd\x7b\xb6\xc9\x32\x65\xff\xd9\xb6\x6e\x57\x2c\x96\xf9\xba\x51\x6c\xda\xaf\x5c\x17\x5a\xcd\xea\xd5\x0c\xb8\xae\xd7\xc8\x6a\x6f\x74\x42\x29\x4d\xfd\x8d\xce\x6f\x94\x54\xd6\x27\xee\x11\x00\x00")
 
 func AssetsHtmlIndexHtmlBytes() ([]byte, error) {
 	return bindataRead(
@@ -128,7 +128,7 @@ func AssetsHtmlIndexHtml() (*asset, error) {
 		return nil, err
 	}
 
-	info := bindataFileInfo{name: "../assets/html/index.html", size: 3536, mode: os.FileMode(420), modTime: time.Unix(1505920459, 0)}
+	info := bindataFileInfo{name: "../assets/html/index.html", size: 4590, mode: os.FileMode(420), modTime: time.Unix(1792205874, 0)}
 	a := &asset{bytes: bytes, info: info}
 	return a, nil
 }
@@ -8,6 +8,7 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/rgamba/postman/async"
 	"github.com/rgamba/postman/lib"
@@ -30,6 +31,7 @@ func StartHTTPServer(port int, config *viper.Viper, version string, build string
 	mux := http.NewServeMux()
 	mux.HandleFunc("/stats/requests", statsHandler)
 	mux.HandleFunc("/settings", settingsHandler)
+	mux.HandleFunc("/admin/drain", drainHandler)
 	mux.HandleFunc("/", defaultHandler)
 
 	srv := &http.Server{
@@ -38,7 +40,8 @@ func StartHTTPServer(port int, config *viper.Viper, version string, build string
 	}
 
 	go func() {
-		if err := srv.ListenAndServe(); err != nil {
+		// ErrServerClosed means the server is being shut down.
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Dashboard: ListenAndServe() error: %s", err)
 		}
 	}()
@@ -77,6 +80,9 @@ func defaultHandler(w http.ResponseWriter, r *http.Request) {
 		"processId":               os.Getpid(),
 		"incomingRequests":        stats.GetRequestsLastMinutePerService(stats.Incoming),
 		"outgoingRequests":        stats.GetRequestsLastMinutePerService(stats.Outgoing),
+		"connectionState":         async.GetConnectionState(),
+		"bufferedRequests":        async.CountBufferedRequests(),
+		"brokerStats":             stats.GetConnectionStats(),
 		"appVersion":              appVersion,
 		"appBuild":                appBuild,
 	}
@@ -91,9 +97,37 @@ func statsHandler(w http.ResponseWriter, r *http.Request) {
 		"incoming": map[string]interface{}{
 			"last_minute": stats.GetRequestsLastMinutePerService(stats.Incoming),
 		},
+		"workers":           stats.GetWorkerStats(),
+		"pending_requests":  async.CountPendingRequests(),
+		"late_responses":    stats.CountLateResponses(),
+		"draining":          async.IsDraining(),
+		"connection":        async.GetConnectionState(),
+		"buffered_requests": async.CountBufferedRequests(),
+		"outbox":            async.CountOutboxMessages(),
+		"broker":            stats.GetConnectionStats(),
+		"forward_retries":   stats.GetRetryStats(),
+		"compression":       stats.GetCompressionStats(),
 	}, 200)
 }
 
+// Drain the instance before a deploy, same as we do before shutting down.
+// The instance stops taking requests but keeps running.
+func drainHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		lib.SendJSON(w, map[string]string{"error": "method not allowed"}, http.StatusMethodNotAllowed)
+		return
+	}
+	gracePeriod := time.Duration(appConfig.GetFloat64("shutdown.grace_period") * float64(time.Second))
+	if err := async.Drain(gracePeriod); err != nil {
+		lib.SendJSON(w, map[string]interface{}{
+			"error":            err.Error(),
+			"pending_requests": async.CountPendingRequests(),
+		}, http.StatusGatewayTimeout)
+		return
+	}
+	lib.SendJSON(w, map[string]string{"status": "drained"}, http.StatusOK)
+}
+
 func renderView(w http.ResponseWriter, tpl string, data interface{}) {
 	defer func() {
 		if rec := recover(); rec != nil {
@@ -0,0 +1,117 @@
+package proxy
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/rgamba/postman/async/protobuf"
+	"github.com/rgamba/postman/blob"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ClaimCheckHeader carries the reference to the body in the blob
+// store, for the bodies too big to go through the broker.
+const ClaimCheckHeader = "Postman-Claim-Check"
+
+// Store for the big bodies, nil when disabled.
+var blobStore blob.Store
+
+// Bodies bigger than this, in bytes, go to the blob store.
+var claimCheckThreshold int64
+
+// SetClaimCheck sends the request and response bodies bigger than the
+// threshold through the blob store instead of the broker. The store must
+// be shared by the instances of all the services. A nil store disables it.
+func SetClaimCheck(store blob.Store, threshold int64) {
+	blobStore = store
+	claimCheckThreshold = threshold
+}
+
+// Read the whole body, unless it's bigger than the threshold. In that case
+// it goes to the blob store and we get the reference to it instead.
+func readBody(r io.Reader) ([]byte, string, error) {
+	store := blobStore
+	if store == nil {
+		body, err := ioutil.ReadAll(r)
+		return body, "", err
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(r, claimCheckThreshold+1))
+	if err != nil || int64(len(body)) <= claimCheckThreshold {
+		return body, "", err
+	}
+	ref, err := store.Put(io.MultiReader(bytes.NewReader(body), r))
+	if err != nil {
+		return nil, "", err
+	}
+	return nil, ref, nil
+}
+
+// Get the reference to the body in the blob store, if any.
+func getClaimCheck(headers []*protobuf.Header) string {
+	for _, header := range headers {
+		if isClaimCheckHeader(header.Name) && len(header.Values) > 0 {
+			return header.Values[0]
+		}
+	}
+	return ""
+}
+
+func isClaimCheckHeader(name string) bool {
+	return http.CanonicalHeaderKey(name) == ClaimCheckHeader
+}
+
+// Open the body, either from the message or from the blob store.
+func openBody(body []byte, headers []*protobuf.Header) (io.ReadCloser, int64, error) {
+	ref := getClaimCheck(headers)
+	if ref == "" {
+		return ioutil.NopCloser(bytes.NewReader(body)), int64(len(body)), nil
+	}
+	store := blobStore
+	if store == nil {
+		return nil, 0, fmt.Errorf("The body is in the blob store but claim check is disabled")
+	}
+	return store.Get(ref)
+}
+
+// Remove the body from the blob store once nobody needs it.
+func deleteClaimCheck(ref string) {
+	store := blobStore
+	if store == nil || ref == "" {
+		return
+	}
+	if err := store.Delete(ref); err != nil {
+		log.WithFields(log.Fields{
+			"error": err,
+			"ref":   ref,
+		}).Warn("Unable to delete the body from the blob store")
+	}
+}
+
+// Copy the response, the copy gets its own copy of the
+// body in the blob store so both can be removed separately.
+func copyClaimCheck(resp *protobuf.Response) (*protobuf.Response, error) {
+	copied := copyResponse(resp)
+	ref := getClaimCheck(resp.Headers)
+	if ref == "" {
+		return copied, nil
+	}
+	body, _, err := openBody(nil, resp.Headers)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	copiedRef, err := blobStore.Put(body)
+	if err != nil {
+		return nil, err
+	}
+	for i, header := range copied.Headers {
+		if isClaimCheckHeader(header.Name) {
+			copied.Headers[i] = &protobuf.Header{Name: ClaimCheckHeader, Values: []string{copiedRef}}
+		}
+	}
+	return copied, nil
+}
@@ -0,0 +1,151 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rgamba/postman/async/protobuf"
+	"github.com/rgamba/postman/blob"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadBody(t *testing.T) {
+	store, dir := _setClaimCheck(t, 10)
+	defer os.RemoveAll(dir)
+	defer SetClaimCheck(nil, 0)
+	body, ref, err := readBody(strings.NewReader("small"))
+	assert.Nil(t, err)
+	assert.Equal(t, "small", string(body))
+	assert.Equal(t, "", ref)
+	body, ref, err = readBody(strings.NewReader("a big body"))
+	assert.Nil(t, err)
+	assert.Equal(t, "a big body", string(body))
+	body, ref, err = readBody(strings.NewReader("a bigger body"))
+	assert.Nil(t, err)
+	assert.Nil(t, body)
+	assert.Equal(t, "a bigger body", _readBlob(t, store, ref))
+}
+
+func TestForwardRequestFromClaimCheck(t *testing.T) {
+	store, dir := _setClaimCheck(t, 10)
+	defer os.RemoveAll(dir)
+	defer SetClaimCheck(nil, 0)
+	server, received := _startEchoServer()
+	defer server.Close()
+	forwardHost = server.URL
+	defer func() {
+		forwardHost = fmt.Sprintf("http://localhost:%d", MockServerPort)
+	}()
+	ref, _ := store.Put(strings.NewReader("a bigger body"))
+	req := &protobuf.Request{
+		Method:   "POST",
+		Endpoint: "/",
+		Headers:  []*protobuf.Header{{Name: ClaimCheckHeader, Values: []string{ref}}},
+	}
+	resp, err := forwardRequestAndCreateResponse(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Equal(t, "", (<-received).Get(ClaimCheckHeader))
+	// Not in a request delivery, the request body is removed once we are done.
+	_, _, getErr := store.Get(ref)
+	assert.Equal(t, blob.ErrNotFound, getErr)
+	// The echoed body is too big for the response as well.
+	assert.Nil(t, resp.Body)
+	responseRef := getClaimCheck(resp.Headers)
+	assert.NotEqual(t, "", responseRef)
+
+	w := httptest.NewRecorder()
+	sendHTTPResponseFromProtobufResponse(w, resp, nil)
+	assert.Equal(t, "a bigger body", w.Body.String())
+	assert.Equal(t, "13", w.Header().Get("Content-Length"))
+	assert.Equal(t, "", w.Header().Get(ClaimCheckHeader))
+	_, _, getErr = store.Get(responseRef)
+	assert.Equal(t, blob.ErrNotFound, getErr)
+}
+
+func TestClaimCheckFromFwdHostIsDropped(t *testing.T) {
+	response := &http.Response{
+		StatusCode: 200,
+		Header:     http.Header{ClaimCheckHeader: []string{"../secret"}},
+		Body:       ioutil.NopCloser(strings.NewReader("body")),
+	}
+	resp, err := convertHTTPResponseToProtoResponse(response)
+	assert.Nil(t, err)
+	assert.Equal(t, "", getClaimCheck(resp.Headers))
+}
+
+func TestMissingClaimCheckBody(t *testing.T) {
+	_, dir := _setClaimCheck(t, 10)
+	defer os.RemoveAll(dir)
+	defer SetClaimCheck(nil, 0)
+	w := httptest.NewRecorder()
+	resp := &protobuf.Response{
+		StatusCode: 200,
+		Headers:    []*protobuf.Header{{Name: ClaimCheckHeader, Values: []string{"missing"}}},
+	}
+	sendHTTPResponseFromProtobufResponse(w, resp, nil)
+	assert.Equal(t, 502, w.Code)
+}
+
+func TestIdempotentReplayFromClaimCheck(t *testing.T) {
+	store, dir := _setClaimCheck(t, 0)
+	defer os.RemoveAll(dir)
+	defer SetClaimCheck(nil, 0)
+	server, _ := _startCountingServer(nil)
+	defer server.Close()
+	defer _resetIdempotency()
+	_setIdempotency(server.URL, 10, time.Minute)
+	first, err := forwardRequestAndCreateResponse(context.Background(), _idempotentRequest("1", "service1", "key1"))
+	assert.Nil(t, err)
+	// The requester removes the body once it gets the response.
+	firstRef := getClaimCheck(first.Headers)
+	assert.Equal(t, "1", _readBlob(t, store, firstRef))
+	store.Delete(firstRef)
+	second, err := forwardRequestAndCreateResponse(context.Background(), _idempotentRequest("2", "service1", "key1"))
+	assert.Nil(t, err)
+	assert.NotEqual(t, firstRef, getClaimCheck(second.Headers))
+	assert.Equal(t, "1", _readBlob(t, store, getClaimCheck(second.Headers)))
+}
+
+func _setClaimCheck(t *testing.T, threshold int64) (*blob.FileStore, string) {
+	dir, err := ioutil.TempDir("", "postman-claim-check")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store, err := blob.NewFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	SetClaimCheck(store, threshold)
+	return store, dir
+}
+
+func _readBlob(t *testing.T, store blob.Store, ref string) string {
+	r, _, err := store.Get(ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	content, _ := ioutil.ReadAll(r)
+	return string(content)
+}
+
+// A server that responds with the request body, the
+// request headers are sent through the channel.
+func _startEchoServer() (*httptest.Server, chan http.Header) {
+	received := make(chan http.Header, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header
+		var body bytes.Buffer
+		body.ReadFrom(r.Body)
+		w.Write(body.Bytes())
+	}))
+	return server, received
+}
@@ -0,0 +1,467 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rgamba/postman/async"
+	"github.com/rgamba/postman/async/protobuf"
+)
+
+// Error codes of the steps that can't be sent.
+const (
+	// One of the steps it depends on failed.
+	errorCodeSkipped = "skipped"
+	// One of its templates points to something that isn't there.
+	errorCodeInvalidTemplate = "invalid_template"
+)
+
+// References to earlier responses, like {{user.body.orders[0].id}}.
+var templateRegexp = regexp.MustCompile(`\{\{\s*([^{}]+?)\s*\}\}`)
+
+var stepNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// A call sent through the compose endpoint. Its endpoint, headers and body
+// can reference the responses of the steps it depends on.
+type composeStep struct {
+	Name string `json:"name"`
+	// Steps it depends on besides the ones its templates reference.
+	DependsOn []string `json:"depends_on"`
+	batchCall
+	dependencies []int
+}
+
+type composeRequest struct {
+	Steps []*composeStep `json:"steps"`
+}
+
+type composeResult struct {
+	Name string `json:"name"`
+	*batchResult
+	// Skipped steps have no timing.
+	Timing *composeTiming `json:"timing,omitempty"`
+	// The body decoded as JSON, once a template needs it.
+	decodedBody interface{}
+	decoded     bool
+}
+
+// Times in milliseconds, since the composition started.
+type composeTiming struct {
+	StartedMs  int64 `json:"started_ms"`
+	DurationMs int64 `json:"duration_ms"`
+}
+
+type composeResponse struct {
+	Steps      []*composeResult `json:"steps"`
+	DurationMs int64            `json:"duration_ms"`
+}
+
+type stepResponse struct {
+	index int
+	resp  *protobuf.Response
+	err   *async.Error
+	at    time.Time
+}
+
+// Send the steps in the JSON document as soon as the steps they depend
+// on are done, independent steps are sent at once. The response has the
+// response, or error, and timing of each step in the same order.
+func composeCalls(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var composition composeRequest
+	if err := json.NewDecoder(r.Body).Decode(&composition); err != nil {
+		sendJSON(w, map[string]string{
+			"error":   "invalid_parameters",
+			"message": fmt.Sprintf("The body must be a JSON object with the steps: %s", err),
+		}, 400)
+		return
+	}
+	steps := composition.Steps
+	if err := resolveDependencies(steps); err != nil {
+		sendJSON(w, map[string]string{
+			"error":   "invalid_parameters",
+			"message": err.Error(),
+		}, 400)
+		return
+	}
+	start := time.Now()
+	results := make([]*composeResult, len(steps))
+	started := make([]time.Time, len(steps))
+	requestIDs := make([]string, len(steps))
+	responses := make(chan stepResponse, len(steps))
+	running := 0
+	canceled := false
+	sender := &batchSender{}
+	done := r.Context().Done()
+	for {
+		// Every step done may let others go.
+		for progress := true; progress; {
+			progress = false
+			for i, step := range steps {
+				if results[i] != nil || !started[i].IsZero() || !isStepReady(step, results) {
+					continue
+				}
+				progress = true
+				if canceled {
+					results[i] = createSkippedResult(step, async.NewError(errorCodeCanceled, "The caller went away", nil))
+					continue
+				}
+				if name := getFailedDependency(step, steps, results); name != "" {
+					results[i] = createSkippedResult(step, async.NewError(
+						errorCodeSkipped,
+						fmt.Sprintf("Step '%s' failed", name),
+						nil,
+					))
+					continue
+				}
+				request, err := createStepRequest(r, step, steps, results)
+				if err != nil {
+					results[i] = createSkippedResult(step, async.NewError(errorCodeInvalidTemplate, err.Error(), nil))
+					continue
+				}
+				index := i
+				started[i] = time.Now()
+				requestIDs[i] = request.Id
+				running++
+				deadline := started[i].Add(getCallTimeout(r, &step.batchCall))
+				sender.send(step.Service, request, deadline, func(resp *protobuf.Response, err *async.Error) {
+					responses <- stepResponse{index: index, resp: resp, err: err, at: time.Now()}
+				})
+			}
+		}
+		if running == 0 {
+			break
+		}
+		select {
+		case response := <-responses:
+			running--
+			results[response.index] = &composeResult{
+				Name:        steps[response.index].Name,
+				batchResult: createBatchResult(response.resp, response.err),
+				Timing:      createTiming(start, started[response.index], response.at),
+			}
+		case <-done:
+			done = nil
+			canceled = true
+			sender.cancel("The caller went away")
+			// Steps already done aren't canceled, we still wait for their response.
+			for i, id := range requestIDs {
+				if results[i] == nil && id != "" && async.CancelRequest(id) {
+					running--
+					results[i] = &composeResult{
+						Name:        steps[i].Name,
+						batchResult: createBatchResult(nil, async.NewError(errorCodeCanceled, "The caller went away", nil)),
+						Timing:      createTiming(start, started[i], time.Now()),
+					}
+				}
+			}
+		}
+	}
+	sendJSON(w, composeResponse{
+		Steps:      results,
+		DurationMs: toMilliseconds(time.Since(start)),
+	}, 200)
+}
+
+// Find the steps each step depends on, the explicit ones and the ones its
+// templates reference. Steps can only depend on other steps and there
+// can't be cycles.
+func resolveDependencies(steps []*composeStep) error {
+	indexes := map[string]int{}
+	for i, step := range steps {
+		if step == nil {
+			return fmt.Errorf("Step %d must be a JSON object", i)
+		}
+		if !stepNameRegexp.MatchString(step.Name) {
+			return fmt.Errorf("Step %d: the name can only have letters, numbers, '_' and '-'", i)
+		}
+		if _, ok := indexes[step.Name]; ok {
+			return fmt.Errorf("Step '%s' is defined more than once", step.Name)
+		}
+		if step.Service == "" {
+			return fmt.Errorf("Step '%s': service name is required", step.Name)
+		}
+		indexes[step.Name] = i
+	}
+	for _, step := range steps {
+		names := append([]string{}, step.DependsOn...)
+		for _, template := range getStepTemplates(step) {
+			for _, match := range templateRegexp.FindAllStringSubmatch(template, -1) {
+				names = append(names, getReferencedStep(match[1]))
+			}
+		}
+		seen := map[int]bool{}
+		for _, name := range names {
+			index, ok := indexes[name]
+			if !ok {
+				return fmt.Errorf("Step '%s' depends on the unknown step '%s'", step.Name, name)
+			}
+			if !seen[index] {
+				seen[index] = true
+				step.dependencies = append(step.dependencies, index)
+			}
+		}
+	}
+	return checkForCycles(steps)
+}
+
+// Remove the steps with no dependencies left until there are none, the
+// steps that are left are part of a cycle.
+func checkForCycles(steps []*composeStep) error {
+	removed := make([]bool, len(steps))
+	for progress := true; progress; {
+		progress = false
+		for i, step := range steps {
+			if removed[i] {
+				continue
+			}
+			ready := true
+			for _, dependency := range step.dependencies {
+				ready = ready && removed[dependency]
+			}
+			if ready {
+				removed[i] = true
+				progress = true
+			}
+		}
+	}
+	for i, step := range steps {
+		if !removed[i] {
+			return fmt.Errorf("Step '%s' is part of a dependency cycle", step.Name)
+		}
+	}
+	return nil
+}
+
+// The parts of the step that can have templates.
+func getStepTemplates(step *composeStep) []string {
+	templates := []string{step.Endpoint, step.Body}
+	for _, value := range step.Headers {
+		templates = append(templates, value)
+	}
+	return templates
+}
+
+// References start with the name of the step.
+func getReferencedStep(reference string) string {
+	if end := strings.IndexAny(reference, ".["); end >= 0 {
+		return reference[:end]
+	}
+	return reference
+}
+
+func isStepReady(step *composeStep, results []*composeResult) bool {
+	for _, dependency := range step.dependencies {
+		if results[dependency] == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Get the name of the first step the step depends on that failed, if any.
+func getFailedDependency(step *composeStep, steps []*composeStep, results []*composeResult) string {
+	for _, dependency := range step.dependencies {
+		if isFailedResult(results[dependency].batchResult) {
+			return steps[dependency].Name
+		}
+	}
+	return ""
+}
+
+func createSkippedResult(step *composeStep, err *async.Error) *composeResult {
+	return &composeResult{Name: step.Name, batchResult: createBatchResult(nil, err)}
+}
+
+func createTiming(start time.Time, started time.Time, finished time.Time) *composeTiming {
+	return &composeTiming{
+		StartedMs:  toMilliseconds(started.Sub(start)),
+		DurationMs: toMilliseconds(finished.Sub(started)),
+	}
+}
+
+func toMilliseconds(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
+}
+
+// Replace the templates of the step with the values they reference.
+// Values in the endpoint are escaped. When the body is JSON, values
+// inside its strings are encoded as JSON and the result must be JSON.
+func createStepRequest(r *http.Request, step *composeStep, steps []*composeStep, results []*composeResult) (*protobuf.Request, error) {
+	indexes := map[string]int{}
+	for _, dependency := range step.dependencies {
+		indexes[steps[dependency].Name] = dependency
+	}
+	var templateErr error
+	resolve := func(reference string) string {
+		value, err := resolveReference(reference, results[indexes[getReferencedStep(reference)]])
+		if err != nil && templateErr == nil {
+			templateErr = err
+		}
+		return value
+	}
+	call := step.batchCall
+	call.Endpoint = renderTemplate(step.Endpoint, func(reference string, inString bool) string {
+		return strings.Replace(url.QueryEscape(resolve(reference)), "+", "%20", -1)
+	})
+	isJSON := isJSONTemplate(step.Body)
+	call.Body = renderTemplate(step.Body, func(reference string, inString bool) string {
+		if isJSON && inString {
+			return encodeJSONString(resolve(reference))
+		}
+		return resolve(reference)
+	})
+	call.Headers = map[string]string{}
+	for name, value := range step.Headers {
+		call.Headers[name] = renderTemplate(value, func(reference string, inString bool) string {
+			return resolve(reference)
+		})
+	}
+	if templateErr != nil {
+		return nil, templateErr
+	}
+	if isJSON {
+		var body interface{}
+		if err := json.Unmarshal([]byte(call.Body), &body); err != nil {
+			return nil, fmt.Errorf("The body is not valid JSON once rendered: %s", err)
+		}
+	}
+	return createBatchRequest(r, &call)
+}
+
+// Replace each template with the value replace gives for its reference. It
+// also gets whether the template is inside a string, if the text is JSON.
+func renderTemplate(template string, replace func(reference string, inString bool) string) string {
+	var rendered bytes.Buffer
+	inString, escaped := false, false
+	last := 0
+	for _, match := range templateRegexp.FindAllStringSubmatchIndex(template, -1) {
+		for _, c := range []byte(template[last:match[0]]) {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\' && inString:
+				escaped = true
+			case c == '"':
+				inString = !inString
+			}
+		}
+		rendered.WriteString(template[last:match[0]])
+		rendered.WriteString(replace(template[match[2]:match[3]], inString))
+		last = match[1]
+	}
+	rendered.WriteString(template[last:])
+	return rendered.String()
+}
+
+// Bodies that look like JSON objects or arrays and have templates.
+func isJSONTemplate(body string) bool {
+	trimmed := strings.TrimSpace(body)
+	return (strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[")) && templateRegexp.MatchString(body)
+}
+
+// Encode the value as the content of a JSON string, without the quotes.
+func encodeJSONString(value string) string {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(value)
+	encoded := strings.TrimSpace(buf.String())
+	return encoded[1 : len(encoded)-1]
+}
+
+// Get the value a reference points to. References are the name of the step
+// followed by request_id, status_code, headers.<name> or body, the body can
+// be followed by the path to a value in it, like body.orders[0].id. Strings
+// are used as they are and any other value is encoded as JSON.
+func resolveReference(reference string, result *composeResult) (string, error) {
+	parts := strings.SplitN(reference, ".", 3)
+	if len(parts) < 2 {
+		return "", fmt.Errorf("Invalid reference '%s'", reference)
+	}
+	switch {
+	case parts[1] == "request_id":
+		return result.RequestID, nil
+	case parts[1] == "status_code":
+		return strconv.Itoa(int(result.StatusCode)), nil
+	case parts[1] == "headers" && len(parts) == 3:
+		values := result.Headers[http.CanonicalHeaderKey(parts[2])]
+		if len(values) == 0 {
+			return "", fmt.Errorf("Step '%s' has no header '%s'", parts[0], parts[2])
+		}
+		return values[0], nil
+	case parts[1] == "body" || strings.HasPrefix(parts[1], "body["):
+		path := strings.TrimPrefix(reference, parts[0]+".body")
+		if path == "" {
+			// Binary bodies are inserted as they are.
+			if result.BodyBase64 != "" {
+				content, _ := base64.StdEncoding.DecodeString(result.BodyBase64)
+				return string(content), nil
+			}
+			return result.Body, nil
+		}
+		if !result.decoded {
+			result.decoded = true
+			json.Unmarshal([]byte(result.Body), &result.decodedBody)
+		}
+		value, err := getJSONValue(result.decodedBody, path)
+		if err != nil {
+			return "", fmt.Errorf("Step '%s': %s", parts[0], err)
+		}
+		if s, ok := value.(string); ok {
+			return s, nil
+		}
+		encoded, _ := json.Marshal(value)
+		return string(encoded), nil
+	}
+	return "", fmt.Errorf("Invalid reference '%s'", reference)
+}
+
+// Walk the decoded JSON document following a path like .orders[0].id
+func getJSONValue(document interface{}, path string) (interface{}, error) {
+	value := document
+	for path != "" {
+		switch path[0] {
+		case '.':
+			end := strings.IndexAny(path[1:], ".[") + 1
+			if end == 0 {
+				end = len(path)
+			}
+			key := path[1:end]
+			object, ok := value.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("the body has no field '%s'", key)
+			}
+			if value, ok = object[key]; !ok {
+				return nil, fmt.Errorf("the body has no field '%s'", key)
+			}
+			path = path[end:]
+		case '[':
+			end := strings.Index(path, "]")
+			if end < 0 {
+				return nil, fmt.Errorf("missing ']' in the path")
+			}
+			index, err := strconv.Atoi(path[1:end])
+			array, ok := value.([]interface{})
+			if err != nil || !ok || index < 0 || index >= len(array) {
+				return nil, fmt.Errorf("the body has no item %s", path[:end+1])
+			}
+			value = array[index]
+			path = path[end+1:]
+		default:
+			return nil, fmt.Errorf("invalid path '%s'", path)
+		}
+	}
+	return value, nil
+}
@@ -0,0 +1,173 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCompose(t *testing.T) {
+	result, status := _postComposition(t, `{"steps": [
+		{"name": "orders", "service": "test", "method": "POST", "endpoint": "/echo",
+		 "body": "{\"user\": {{user.body.id}}, \"orders\": {{user.body.orders}}}"},
+		{"name": "user", "service": "test", "endpoint": "/json"},
+		{"name": "search", "service": "test", "endpoint": "/query?name={{user.body.name}}&order={{user.body.orders[1].id}}"},
+		{"name": "header", "service": "test", "endpoint": "/header",
+		 "headers": {"X-Test": "{{user.status_code}} {{user.headers.content-type}}"}}
+	]}`)
+	if !assert.Equal(t, 200, status) || !assert.Len(t, result.Steps, 4) {
+		return
+	}
+	assert.Equal(t, "orders", result.Steps[0].Name)
+	assert.Equal(t, `{"user": 7, "orders": [{"id":"a1"},{"id":"b2"}]}`, result.Steps[0].Body)
+	assert.Equal(t, int32(200), result.Steps[1].StatusCode)
+	assert.Equal(t, "name=Ann%20Lee&order=b2", result.Steps[2].Body)
+	assert.Equal(t, "200 application/json", result.Steps[3].Body)
+	// Steps start once the steps they depend on are done.
+	user := result.Steps[1].Timing
+	if assert.NotNil(t, user) && assert.NotNil(t, result.Steps[0].Timing) {
+		assert.True(t, result.Steps[0].Timing.StartedMs >= user.StartedMs+user.DurationMs)
+	}
+}
+
+func TestComposeIndependentStepsRunAtOnce(t *testing.T) {
+	result, _ := _postComposition(t, `{"steps": [
+		{"name": "a", "service": "test", "endpoint": "/one"},
+		{"name": "b", "service": "test", "endpoint": "/two"},
+		{"name": "c", "service": "test", "endpoint": "/one", "depends_on": ["a", "b"]}
+	]}`)
+	if !assert.Len(t, result.Steps, 3) {
+		return
+	}
+	a, b := result.Steps[0].Timing, result.Steps[1].Timing
+	assert.True(t, b.StartedMs <= a.StartedMs+a.DurationMs)
+	assert.True(t, a.StartedMs <= b.StartedMs+b.DurationMs)
+	assert.Equal(t, "one", result.Steps[2].Body)
+}
+
+func TestComposeFailedStep(t *testing.T) {
+	result, _ := _postComposition(t, `{"steps": [
+		{"name": "a", "service": "nonexistent", "endpoint": "/"},
+		{"name": "b", "service": "test", "endpoint": "/query?id={{a.body.id}}"},
+		{"name": "c", "service": "test", "endpoint": "/one", "depends_on": ["b"]},
+		{"name": "d", "service": "test", "endpoint": "/two"}
+	]}`)
+	if !assert.Len(t, result.Steps, 4) {
+		return
+	}
+	assert.Equal(t, "queue_not_found", result.Steps[0].Error["code"])
+	assert.Equal(t, errorCodeSkipped, result.Steps[1].Error["code"])
+	assert.Nil(t, result.Steps[1].Timing)
+	assert.Equal(t, errorCodeSkipped, result.Steps[2].Error["code"])
+	assert.Equal(t, "two", result.Steps[3].Body)
+}
+
+func TestComposeInvalidTemplate(t *testing.T) {
+	result, _ := _postComposition(t, `{"steps": [
+		{"name": "user", "service": "test", "endpoint": "/json"},
+		{"name": "b", "service": "test", "endpoint": "/query?id={{user.body.missing}}"},
+		{"name": "c", "service": "test", "endpoint": "/query?id={{user.body.orders[5].id}}"}
+	]}`)
+	if !assert.Len(t, result.Steps, 3) {
+		return
+	}
+	assert.Equal(t, errorCodeInvalidTemplate, result.Steps[1].Error["code"])
+	assert.Equal(t, errorCodeInvalidTemplate, result.Steps[2].Error["code"])
+}
+
+func TestComposeBinaryBody(t *testing.T) {
+	result, _ := _postComposition(t, `{"steps": [
+		{"name": "binary", "service": "test", "endpoint": "/binary"},
+		{"name": "echo", "service": "test", "method": "POST", "endpoint": "/echo", "body": "data:{{binary.body}}"}
+	]}`)
+	if assert.Len(t, result.Steps, 2) {
+		assert.Equal(t, "/wD+", result.Steps[0].BodyBase64)
+		// The body is sent as it is.
+		assert.Equal(t, "ZGF0YTr/AP4=", result.Steps[1].BodyBase64)
+	}
+}
+
+func TestComposeJSONBody(t *testing.T) {
+	result, _ := _postComposition(t, `{"steps": [
+		{"name": "a", "service": "test", "method": "POST", "endpoint": "/echo", "body": "{\"name\": \"say \\\"hi\\\"\"}"},
+		{"name": "b", "service": "test", "method": "POST", "endpoint": "/echo", "body": "{\"greeting\": \"{{a.body.name}}, \\\"{{a.body.name}}\\\"\"}"},
+		{"name": "c", "service": "test", "method": "POST", "endpoint": "/echo", "body": "{\"greeting\": {{a.body.name}}}"}
+	]}`)
+	if !assert.Len(t, result.Steps, 3) {
+		return
+	}
+	// Values inside JSON strings are encoded, the body is still JSON.
+	assert.Equal(t, `{"greeting": "say \"hi\", \"say \"hi\"\""}`, result.Steps[1].Body)
+	var body map[string]string
+	assert.Nil(t, json.Unmarshal([]byte(result.Steps[1].Body), &body))
+	assert.Equal(t, `say "hi", "say "hi""`, body["greeting"])
+	assert.Equal(t, errorCodeInvalidTemplate, result.Steps[2].Error["code"])
+}
+
+func TestRenderTemplate(t *testing.T) {
+	rendered := renderTemplate(`{"a": "x {{a}} \" {{b}}", "b": {{c}}}`, func(reference string, inString bool) string {
+		return fmt.Sprintf("%s=%t", reference, inString)
+	})
+	assert.Equal(t, `{"a": "x a=true \" b=true", "b": c=false}`, rendered)
+}
+
+func TestComposeInvalidSteps(t *testing.T) {
+	compositions := []string{
+		`[]`,
+		`{"steps": [{"name": "a", "endpoint": "/one"}]}`,
+		`{"steps": [{"name": "a b", "service": "test"}]}`,
+		`{"steps": [{"name": "a", "service": "test"}, {"name": "a", "service": "test"}]}`,
+		`{"steps": [{"name": "a", "service": "test", "endpoint": "/{{b.body}}"}]}`,
+		`{"steps": [{"name": "a", "service": "test", "depends_on": ["b"]}, {"name": "b", "service": "test", "endpoint": "/{{a.body}}"}]}`,
+	}
+	for _, composition := range compositions {
+		_, status := _postComposition(t, composition)
+		assert.Equal(t, 400, status, composition)
+	}
+}
+
+func TestGetJSONValue(t *testing.T) {
+	var document interface{}
+	json.Unmarshal([]byte(`{"a": {"b": [1, {"c": "d"}]}}`), &document)
+	value, err := getJSONValue(document, ".a.b[1].c")
+	assert.Nil(t, err)
+	assert.Equal(t, "d", value)
+	value, err = getJSONValue(document, ".a.b[0]")
+	assert.Nil(t, err)
+	assert.Equal(t, float64(1), value)
+	_, err = getJSONValue(document, ".a.b[2]")
+	assert.NotNil(t, err)
+	_, err = getJSONValue(document, ".a.x")
+	assert.NotNil(t, err)
+	_, err = getJSONValue(document, ".a[0]")
+	assert.NotNil(t, err)
+}
+
+type _composeResult struct {
+	Steps []struct {
+		Name       string                 `json:"name"`
+		StatusCode int32                  `json:"status_code"`
+		Body       string                 `json:"body"`
+		BodyBase64 string                 `json:"body_base64"`
+		Error      map[string]interface{} `json:"error"`
+		Timing     *composeTiming         `json:"timing"`
+	} `json:"steps"`
+}
+
+func _postComposition(t *testing.T, composition string) (*_composeResult, int) {
+	url := fmt.Sprintf("http://localhost:%d/_postman/compose", TestServerPort)
+	resp, err := http.Post(url, "application/json", bytes.NewBufferString(composition))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	result := &_composeResult{}
+	if resp.StatusCode == 200 {
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(result))
+	}
+	return result, resp.StatusCode
+}
@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/rgamba/postman/async"
+	"github.com/rgamba/postman/async/protobuf"
+)
+
+// ReplayHeader is added to the responses replayed from the
+// idempotency cache instead of sent by fwd_host.
+const ReplayHeader = "Postman-Idempotent-Replay"
+
+// Streamed responses, and the ones opening a tunnel, are not
+// kept, the duplicates waiting for one of those get this error.
+var errResponseStreamed = errors.New("The response was streamed and can't be replayed")
+
+// Responses to the requests with an idempotency key, nil when disabled.
+var idempotency *idempotencyCache
+
+// SetIdempotencyCache sets the max number of responses kept to replay
+// the requests with the same idempotency key, and for how long they are
+// kept. A size of zero disables the cache.
+func SetIdempotencyCache(size int, ttl time.Duration) {
+	if size <= 0 || ttl <= 0 {
+		idempotency = nil
+		return
+	}
+	idempotency = newIdempotencyCache(size, ttl)
+}
+
+// Get the idempotency key of the request, if any.
+func getIdempotencyKey(req *protobuf.Request) string {
+	for _, header := range req.Headers {
+		if http.CanonicalHeaderKey(header.Name) == IdempotencyKeyHeader && len(header.Values) > 0 {
+			return header.Values[0]
+		}
+	}
+	return ""
+}
+
+// The cache keeps the most recent calls, the oldest
+// ones are dropped once it is full or they expire.
+type idempotencyCache struct {
+	mutex sync.Mutex
+	size  int
+	ttl   time.Duration
+	calls map[string]*list.Element
+	// Most recent calls first.
+	order *list.List
+}
+
+// A request to fwd_host, done is closed once we get the response.
+type idempotentCall struct {
+	key     string
+	done    chan struct{}
+	resp    *protobuf.Response
+	err     error
+	expires time.Time
+}
+
+func newIdempotencyCache(size int, ttl time.Duration) *idempotencyCache {
+	return &idempotencyCache{
+		size:  size,
+		ttl:   ttl,
+		calls: map[string]*list.Element{},
+		order: list.New(),
+	}
+}
+
+// Call forward unless there is a call with the same key already, in that
+// case we wait for it if it's still in progress and replay its response.
+// Only responses are kept, calls that fail can be retried right away.
+func (c *idempotencyCache) do(ctx context.Context, key string, forward func() (*protobuf.Response, error)) (*protobuf.Response, bool, error) {
+	c.mutex.Lock()
+	if el, ok := c.calls[key]; ok {
+		call := el.Value.(*idempotentCall)
+		if !call.isDone() || time.Now().Before(call.expires) {
+			c.mutex.Unlock()
+			resp, err := call.wait(ctx)
+			return resp, true, err
+		}
+		c.remove(el)
+	}
+	call := &idempotentCall{key: key, done: make(chan struct{})}
+	c.calls[key] = c.order.PushFront(call)
+	c.prune()
+	c.mutex.Unlock()
+
+	resp, err := forward()
+	// The caller may change the response, we keep a copy. The caller
+	// also removes the body from the blob store, we keep our own.
+	var kept *protobuf.Response
+	keepErr := err
+	if err == nil {
+		kept, keepErr = copyClaimCheck(resp)
+	}
+	c.mutex.Lock()
+	call.resp, call.err = kept, keepErr
+	call.expires = time.Now().Add(c.ttl)
+	if el, ok := c.calls[key]; ok && keepErr != nil && el.Value == call {
+		c.remove(el)
+	}
+	c.mutex.Unlock()
+	close(call.done)
+	return resp, false, err
+}
+
+// Drop the oldest calls over the size and the expired ones.
+func (c *idempotencyCache) prune() {
+	now := time.Now()
+	for el := c.order.Back(); el != nil; el = c.order.Back() {
+		call := el.Value.(*idempotentCall)
+		if c.order.Len() <= c.size && (!call.isDone() || now.Before(call.expires)) {
+			return
+		}
+		c.remove(el)
+	}
+}
+
+func (c *idempotencyCache) remove(el *list.Element) {
+	call := el.Value.(*idempotentCall)
+	c.order.Remove(el)
+	delete(c.calls, call.key)
+	if call.isDone() && call.resp != nil {
+		go deleteClaimCheck(getClaimCheck(call.resp.Headers))
+	}
+}
+
+func (call *idempotentCall) isDone() bool {
+	select {
+	case <-call.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func (call *idempotentCall) wait(ctx context.Context) (*protobuf.Response, error) {
+	select {
+	case <-call.done:
+		return call.resp, call.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Send the request to fwd_host only once per caller service and
+// idempotency key, duplicates get the same response.
+func forwardIdempotentRequest(ctx context.Context, req *protobuf.Request) (*protobuf.Response, error) {
+	key := getIdempotencyKey(req)
+	cache := idempotency
+	if key == "" || cache == nil {
+		return forwardRequestWithRetries(ctx, req)
+	}
+	resp, replayed, err := cache.do(ctx, req.Service+"\x00"+key, func() (*protobuf.Response, error) {
+		resp, err := forwardRequestWithRetries(ctx, req)
+		if err == nil && (async.IsResponseStreamed(ctx) || async.IsTunnelOpened(ctx)) {
+			return resp, errResponseStreamed
+		}
+		return resp, err
+	})
+	if err == errResponseStreamed && !replayed {
+		return resp, nil
+	}
+	if err != nil || !replayed {
+		return resp, err
+	}
+	// The response is shared, the copy gets the id of this request.
+	replay, err := copyClaimCheck(resp)
+	if err != nil {
+		return nil, err
+	}
+	replay.RequestId = req.Id
+	replay.Headers = append(replay.Headers, &protobuf.Header{Name: ReplayHeader, Values: []string{"true"}})
+	return replay, nil
+}
+
+// Copy the response and its list of headers, the body is never modified.
+func copyResponse(resp *protobuf.Response) *protobuf.Response {
+	if resp == nil {
+		return nil
+	}
+	copied := *resp
+	copied.Headers = append([]*protobuf.Header{}, resp.Headers...)
+	return &copied
+}
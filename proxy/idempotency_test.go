@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rgamba/postman/async/protobuf"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIdempotentRequestIsReplayed(t *testing.T) {
+	server, calls := _startCountingServer(nil)
+	defer server.Close()
+	defer _resetIdempotency()
+	_setIdempotency(server.URL, 10, time.Minute)
+	first, err := forwardRequestAndCreateResponse(context.Background(), _idempotentRequest("1", "service1", "key1"))
+	assert.Nil(t, err)
+	second, err := forwardRequestAndCreateResponse(context.Background(), _idempotentRequest("2", "service1", "key1"))
+	assert.Nil(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(calls))
+	assert.Equal(t, "1", string(second.Body))
+	assert.Equal(t, "2", second.RequestId)
+	assert.Equal(t, []string{"true"}, _getProtoHeader(second, ReplayHeader))
+	assert.Nil(t, _getProtoHeader(first, ReplayHeader))
+}
+
+func TestIdempotencyKeyIsPerService(t *testing.T) {
+	server, calls := _startCountingServer(nil)
+	defer server.Close()
+	defer _resetIdempotency()
+	_setIdempotency(server.URL, 10, time.Minute)
+	forwardRequestAndCreateResponse(context.Background(), _idempotentRequest("1", "service1", "key1"))
+	resp, err := forwardRequestAndCreateResponse(context.Background(), _idempotentRequest("2", "service2", "key1"))
+	assert.Nil(t, err)
+	assert.Equal(t, int32(2), atomic.LoadInt32(calls))
+	assert.Equal(t, "2", string(resp.Body))
+}
+
+func TestConcurrentIdempotentRequestsWait(t *testing.T) {
+	release := make(chan bool)
+	server, calls := _startCountingServer(release)
+	defer server.Close()
+	defer _resetIdempotency()
+	_setIdempotency(server.URL, 10, time.Minute)
+	responses := make(chan *protobuf.Response, 2)
+	for i := 1; i <= 2; i++ {
+		go func(id string) {
+			resp, err := forwardRequestAndCreateResponse(context.Background(), _idempotentRequest(id, "service1", "key1"))
+			assert.Nil(t, err)
+			responses <- resp
+		}(fmt.Sprintf("%d", i))
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	for i := 0; i < 2; i++ {
+		resp := <-responses
+		assert.Equal(t, "1", string(resp.Body))
+	}
+	assert.Equal(t, int32(1), atomic.LoadInt32(calls))
+}
+
+func TestFailedIdempotentRequestIsNotKept(t *testing.T) {
+	server, calls := _startCountingServer(nil)
+	defer server.Close()
+	defer _resetIdempotency()
+	_setIdempotency("http://localhost:8095", 10, time.Minute) // Invalid port
+	_, err := forwardRequestAndCreateResponse(context.Background(), _idempotentRequest("1", "service1", "key1"))
+	assert.NotNil(t, err)
+	forwardHost = server.URL
+	resp, err := forwardRequestAndCreateResponse(context.Background(), _idempotentRequest("2", "service1", "key1"))
+	assert.Nil(t, err)
+	assert.Equal(t, int32(1), atomic.LoadInt32(calls))
+	assert.Nil(t, _getProtoHeader(resp, ReplayHeader))
+}
+
+func TestIdempotentResponsesExpire(t *testing.T) {
+	server, calls := _startCountingServer(nil)
+	defer server.Close()
+	defer _resetIdempotency()
+	_setIdempotency(server.URL, 10, 10*time.Millisecond)
+	forwardRequestAndCreateResponse(context.Background(), _idempotentRequest("1", "service1", "key1"))
+	time.Sleep(20 * time.Millisecond)
+	forwardRequestAndCreateResponse(context.Background(), _idempotentRequest("2", "service1", "key1"))
+	assert.Equal(t, int32(2), atomic.LoadInt32(calls))
+}
+
+func TestIdempotencyCacheIsBounded(t *testing.T) {
+	server, calls := _startCountingServer(nil)
+	defer server.Close()
+	defer _resetIdempotency()
+	_setIdempotency(server.URL, 1, time.Minute)
+	forwardRequestAndCreateResponse(context.Background(), _idempotentRequest("1", "service1", "key1"))
+	forwardRequestAndCreateResponse(context.Background(), _idempotentRequest("2", "service1", "key2"))
+	forwardRequestAndCreateResponse(context.Background(), _idempotentRequest("3", "service1", "key1"))
+	assert.Equal(t, int32(3), atomic.LoadInt32(calls))
+	assert.Equal(t, 1, idempotency.order.Len())
+}
+
+func TestIdempotencyCacheDisabled(t *testing.T) {
+	server, calls := _startCountingServer(nil)
+	defer server.Close()
+	defer _resetIdempotency()
+	_setIdempotency(server.URL, 0, time.Minute)
+	forwardRequestAndCreateResponse(context.Background(), _idempotentRequest("1", "service1", "key1"))
+	forwardRequestAndCreateResponse(context.Background(), _idempotentRequest("2", "service1", "key1"))
+	assert.Equal(t, int32(2), atomic.LoadInt32(calls))
+}
+
+func _setIdempotency(host string, size int, ttl time.Duration) {
+	forwardHost = host
+	SetIdempotencyCache(size, ttl)
+}
+
+func _resetIdempotency() {
+	forwardHost = fmt.Sprintf("http://localhost:%d", MockServerPort)
+	SetIdempotencyCache(0, 0)
+}
+
+func _idempotentRequest(id string, service string, key string) *protobuf.Request {
+	return &protobuf.Request{
+		Id:       id,
+		Method:   "POST",
+		Endpoint: "/",
+		Service:  service,
+		Headers:  []*protobuf.Header{{Name: IdempotencyKeyHeader, Values: []string{key}}},
+	}
+}
+
+// A server that responds with the number of requests it got so far,
+// after waiting for release if not nil.
+func _startCountingServer(release chan bool) (*httptest.Server, *int32) {
+	calls := new(int32)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		count := atomic.AddInt32(calls, 1)
+		if release != nil {
+			<-release
+		}
+		fmt.Fprintf(w, "%d", count)
+	}))
+	return server, calls
+}
@@ -0,0 +1,282 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/rgamba/postman/async"
+	"github.com/rgamba/postman/async/protobuf"
+	"github.com/twinj/uuid"
+)
+
+// Error code of the calls canceled because another call failed.
+const errorCodeCanceled = "canceled"
+
+// A call sent through the multiple calls endpoint.
+type batchCall struct {
+	Service string `json:"service"`
+	Method  string `json:"method"`
+	// Path and query of the call, like "/users/123?fields=name".
+	Endpoint string            `json:"endpoint"`
+	Headers  map[string]string `json:"headers"`
+	Body     string            `json:"body"`
+	// Binary bodies go base64 encoded here instead of in the body.
+	BodyBase64 string `json:"body_base64"`
+	// Same as the timeout header, it can only shorten the timeout.
+	Timeout interface{} `json:"timeout"`
+}
+
+// The response, or the error, of a call.
+type batchResult struct {
+	RequestID  string              `json:"request_id,omitempty"`
+	StatusCode int32               `json:"status_code,omitempty"`
+	Headers    map[string][]string `json:"headers,omitempty"`
+	Body       string              `json:"body,omitempty"`
+	// Bodies that aren't valid UTF-8 go base64 encoded here instead.
+	BodyBase64 string                 `json:"body_base64,omitempty"`
+	Error      map[string]interface{} `json:"error,omitempty"`
+}
+
+// Sends the calls of a batch at the same time, sending a call waits for the
+// broker to confirm it got it. Calls not sent yet once the batch is canceled
+// get a canceled error instead.
+type batchSender struct {
+	mutex  sync.Mutex
+	reason string
+}
+
+func (s *batchSender) send(serviceName string, request *protobuf.Request, deadline time.Time, onResponse func(*protobuf.Response, *async.Error)) {
+	go func() {
+		s.mutex.Lock()
+		reason := s.reason
+		s.mutex.Unlock()
+		if reason != "" {
+			onResponse(nil, async.NewError(errorCodeCanceled, reason, nil))
+			return
+		}
+		async.SendRequestMessageWithDeadline(serviceName, request, deadline, onResponse)
+	}()
+}
+
+// Only the first reason is kept.
+func (s *batchSender) cancel(reason string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.reason == "" {
+		s.reason = reason
+	}
+}
+
+type batchResponse struct {
+	index int
+	resp  *protobuf.Response
+	err   *async.Error
+}
+
+// Send all the calls in the JSON array at once and respond with the
+// responses, or errors, in the same order. With fail_fast set, the
+// calls still waiting for a response are canceled as soon as one of
+// them fails.
+func multipleCalls(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var calls []batchCall
+	if err := json.NewDecoder(r.Body).Decode(&calls); err != nil {
+		sendJSON(w, map[string]string{
+			"error":   "invalid_parameters",
+			"message": fmt.Sprintf("The body must be a JSON array of calls: %s", err),
+		}, 400)
+		return
+	}
+	requests := make([]*protobuf.Request, len(calls))
+	for i := range calls {
+		request, err := createBatchRequest(r, &calls[i])
+		if err != nil {
+			sendJSON(w, map[string]string{
+				"error":   "invalid_parameters",
+				"message": fmt.Sprintf("Call %d: %s", i, err),
+			}, 400)
+			return
+		}
+		requests[i] = request
+	}
+	failFast := isTrue(r.URL.Query().Get("fail_fast"))
+	responses := make(chan batchResponse, len(calls))
+	sender := &batchSender{}
+	for i, request := range requests {
+		index := i
+		deadline := time.Now().Add(getCallTimeout(r, &calls[i]))
+		sender.send(calls[i].Service, request, deadline, func(resp *protobuf.Response, err *async.Error) {
+			responses <- batchResponse{index: index, resp: resp, err: err}
+		})
+	}
+	results := make([]*batchResult, len(calls))
+	pending := len(calls)
+	// Calls already done aren't canceled, we still wait for their response.
+	cancel := func(message string) {
+		sender.cancel(message)
+		for i, request := range requests {
+			if results[i] == nil && async.CancelRequest(request.Id) {
+				results[i] = createBatchResult(nil, async.NewError(errorCodeCanceled, message, nil))
+				pending--
+			}
+		}
+	}
+	done := r.Context().Done()
+	for pending > 0 {
+		select {
+		case response := <-responses:
+			result := createBatchResult(response.resp, response.err)
+			results[response.index] = result
+			pending--
+			if failFast && isFailedResult(result) {
+				failFast = false
+				cancel(fmt.Sprintf("Canceled because call %d failed", response.index))
+			}
+		case <-done:
+			done = nil
+			cancel("The caller went away")
+		}
+	}
+	sendJSON(w, results, 200)
+}
+
+// The call gets the host and protocol of the batch request, its body
+// goes to the blob store if it's too big for the broker. The request id
+// is set here, the calls are sent from other goroutines.
+func createBatchRequest(r *http.Request, call *batchCall) (*protobuf.Request, error) {
+	if call.Service == "" {
+		return nil, fmt.Errorf("service name is required")
+	}
+	endpoint, err := url.Parse(call.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	method := strings.ToUpper(call.Method)
+	if method == "" {
+		method = "GET"
+	}
+	path := endpoint.Path
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	headers := http.Header{}
+	for name, value := range call.Headers {
+		headers.Set(name, value)
+	}
+	headers.Del(ClaimCheckHeader)
+	content, err := getCallBody(call)
+	if err != nil {
+		return nil, err
+	}
+	body, ref, err := readBody(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	request := &protobuf.Request{
+		Id:            fmt.Sprintf("%s", uuid.NewV4()),
+		Method:        method,
+		Headers:       convertHTTPHeadersToProto(headers),
+		Body:          body,
+		Endpoint:      path,
+		Query:         endpoint.RawQuery,
+		Host:          r.Host,
+		Protocol:      r.Proto,
+		ResponseQueue: async.ResponseQueueName,
+		Service:       async.ServiceName,
+	}
+	if ref != "" {
+		request.Headers = append(request.Headers, &protobuf.Header{Name: ClaimCheckHeader, Values: []string{ref}})
+	}
+	return request, nil
+}
+
+// The body of the call, decoded if it's base64 encoded.
+func getCallBody(call *batchCall) ([]byte, error) {
+	if call.BodyBase64 == "" {
+		return []byte(call.Body), nil
+	}
+	if call.Body != "" {
+		return nil, fmt.Errorf("body and body_base64 can't be used together")
+	}
+	content, err := base64.StdEncoding.DecodeString(call.BodyBase64)
+	if err != nil {
+		return nil, fmt.Errorf("body_base64 is not valid base64: %s", err)
+	}
+	return content, nil
+}
+
+// The timeout of the call can only shorten the timeout of the batch request.
+func getCallTimeout(r *http.Request, call *batchCall) time.Duration {
+	timeout := getRequestTimeout(call.Service, r)
+	if call.Timeout == nil {
+		return timeout
+	}
+	if callTimeout, ok := parseTimeout(fmt.Sprintf("%v", call.Timeout)); ok && callTimeout < timeout {
+		timeout = callTimeout
+	}
+	return timeout
+}
+
+// The body is read from the blob store if it's there, it's removed once read.
+func createBatchResult(resp *protobuf.Response, err *async.Error) *batchResult {
+	if err != nil {
+		return &batchResult{Error: err.ToMap()}
+	}
+	result := &batchResult{
+		RequestID:  resp.RequestId,
+		StatusCode: resp.StatusCode,
+		Headers:    map[string][]string{},
+	}
+	for _, header := range resp.Headers {
+		if isClaimCheckHeader(header.Name) {
+			continue
+		}
+		result.Headers[http.CanonicalHeaderKey(header.Name)] = header.Values
+	}
+	ref := getClaimCheck(resp.Headers)
+	body, _, openErr := openBody(resp.Body, resp.Headers)
+	if openErr != nil {
+		return createBatchResult(nil, async.NewError(
+			async.ErrorCodeUpstreamError,
+			fmt.Sprintf("Unable to get the response body: %s", openErr),
+			nil,
+		))
+	}
+	defer body.Close()
+	content, readErr := ioutil.ReadAll(body)
+	if readErr != nil {
+		return createBatchResult(nil, async.NewError(async.ErrorCodeUpstreamError, readErr.Error(), nil))
+	}
+	deleteClaimCheck(ref)
+	if utf8.Valid(content) {
+		result.Body = string(content)
+	} else {
+		result.BodyBase64 = base64.StdEncoding.EncodeToString(content)
+	}
+	return result
+}
+
+// Calls fail when they get an error or a server error response.
+func isFailedResult(result *batchResult) bool {
+	return result.Error != nil || result.StatusCode >= 500
+}
+
+func isTrue(value string) bool {
+	switch strings.ToLower(value) {
+	case "1", "true", "yes":
+		return true
+	}
+	return false
+}
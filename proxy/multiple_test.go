@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/rgamba/postman/async"
+	"github.com/rgamba/postman/async/protobuf"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMultipleCalls(t *testing.T) {
+	results, status := _postMultipleCalls(t, "", `[
+		{"service": "test", "endpoint": "/one"},
+		{"service": "test", "method": "post", "endpoint": "/query?a=1"},
+		{"service": "test", "endpoint": "/header", "headers": {"X-Test": "hello"}},
+		{"service": "test", "endpoint": "/notfound"}
+	]`)
+	if !assert.Equal(t, 200, status) || !assert.Len(t, results, 4) {
+		return
+	}
+	assert.Equal(t, int32(200), results[0].StatusCode)
+	assert.Equal(t, "one", results[0].Body)
+	assert.NotEmpty(t, results[0].RequestID)
+	assert.Equal(t, "a=1", results[1].Body)
+	assert.Equal(t, "hello", results[2].Body)
+	assert.Equal(t, []string{"hello"}, results[2].Headers["X-Test"])
+	assert.Equal(t, int32(404), results[3].StatusCode)
+	assert.Equal(t, "notfound", results[3].Body)
+}
+
+func TestMultipleCallsAreSentInParallel(t *testing.T) {
+	done := make(chan []*batchResult)
+	go func() {
+		results, _ := _postMultipleCalls(t, "", `[
+			{"service": "test", "endpoint": "/slow"},
+			{"service": "test", "endpoint": "/slow"}
+		]`)
+		done <- results
+	}()
+	// All the calls wait for their response at the same time.
+	pending := 0
+	for i := 0; i < 50 && pending < 2; i++ {
+		time.Sleep(10 * time.Millisecond)
+		pending = async.CountPendingRequests()
+	}
+	assert.Equal(t, 2, pending)
+	for _, result := range <-done {
+		assert.Equal(t, "slow", result.Body)
+	}
+}
+
+func TestMultipleCallsTimeout(t *testing.T) {
+	results, _ := _postMultipleCalls(t, "", `[
+		{"service": "test", "endpoint": "/slow", "timeout": "50ms"},
+		{"service": "test", "endpoint": "/one", "timeout": 5}
+	]`)
+	if !assert.Len(t, results, 2) {
+		return
+	}
+	// The deadline gets to the other end too, whichever end notices first.
+	assert.Contains(t, []interface{}{async.ErrorCodeTimeout, async.ErrorCodeUpstreamTimeout}, results[0].Error["code"])
+	assert.Equal(t, "one", results[1].Body)
+}
+
+func TestMultipleCallsFailFast(t *testing.T) {
+	start := time.Now()
+	results, _ := _postMultipleCalls(t, "?fail_fast=true", `[
+		{"service": "test", "endpoint": "/slow"},
+		{"service": "nonexistent", "endpoint": "/"}
+	]`)
+	assert.True(t, time.Since(start) < time.Second)
+	if !assert.Len(t, results, 2) {
+		return
+	}
+	assert.Equal(t, errorCodeCanceled, results[0].Error["code"])
+	assert.Equal(t, async.ErrorCodeQueueNotFound, results[1].Error["code"])
+}
+
+func TestMultipleCallsWithoutFailFast(t *testing.T) {
+	results, _ := _postMultipleCalls(t, "", `[
+		{"service": "test", "endpoint": "/slow"},
+		{"service": "nonexistent", "endpoint": "/"}
+	]`)
+	if !assert.Len(t, results, 2) {
+		return
+	}
+	assert.Equal(t, "slow", results[0].Body)
+	assert.Equal(t, async.ErrorCodeQueueNotFound, results[1].Error["code"])
+}
+
+func TestBatchSenderCanceled(t *testing.T) {
+	sender := &batchSender{}
+	sender.cancel("Canceled because call 0 failed")
+	sender.cancel("The caller went away")
+	c := make(chan *async.Error)
+	sender.send("test", &protobuf.Request{Endpoint: "/one"}, time.Now().Add(time.Second), func(resp *protobuf.Response, err *async.Error) {
+		c <- err
+	})
+	err := <-c
+	if assert.NotNil(t, err) {
+		assert.Equal(t, errorCodeCanceled, err.Code)
+		assert.Equal(t, "Canceled because call 0 failed", err.Message)
+	}
+}
+
+func TestMultipleCallsBinaryBody(t *testing.T) {
+	results, _ := _postMultipleCalls(t, "", `[
+		{"service": "test", "endpoint": "/binary"},
+		{"service": "test", "method": "POST", "endpoint": "/echo", "body_base64": "/wD+"},
+		{"service": "test", "method": "POST", "endpoint": "/echo", "body": "caf\u00e9"}
+	]`)
+	if !assert.Len(t, results, 3) {
+		return
+	}
+	assert.Equal(t, "", results[0].Body)
+	assert.Equal(t, "/wD+", results[0].BodyBase64)
+	assert.Equal(t, "/wD+", results[1].BodyBase64)
+	// Valid UTF-8 bodies stay as they are.
+	assert.Equal(t, "café", results[2].Body)
+	assert.Equal(t, "", results[2].BodyBase64)
+	_, status := _postMultipleCalls(t, "", `[{"service": "test", "body_base64": "not base64"}]`)
+	assert.Equal(t, 400, status)
+	_, status = _postMultipleCalls(t, "", `[{"service": "test", "body": "a", "body_base64": "/wD+"}]`)
+	assert.Equal(t, 400, status)
+}
+
+func TestMultipleCallsInvalidBody(t *testing.T) {
+	_, status := _postMultipleCalls(t, "", `{"service": "test"}`)
+	assert.Equal(t, 400, status)
+	_, status = _postMultipleCalls(t, "", `[{"endpoint": "/one"}]`)
+	assert.Equal(t, 400, status)
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/_postman/multiple/", TestServerPort))
+	if assert.Nil(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+	}
+}
+
+func _postMultipleCalls(t *testing.T, query string, calls string) ([]*batchResult, int) {
+	url := fmt.Sprintf("http://localhost:%d/_postman/multiple/%s", TestServerPort, query)
+	resp, err := http.Post(url, "application/json", bytes.NewBufferString(calls))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	results := []*batchResult{}
+	if resp.StatusCode == 200 {
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&results))
+	}
+	return results, resp.StatusCode
+}
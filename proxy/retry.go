@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"context"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/rgamba/postman/async"
+	"github.com/rgamba/postman/async/protobuf"
+)
+
+// RetriesHeader is the response header with the number of times
+// the request to fwd_host was retried.
+const RetriesHeader = "Postman-Retries"
+
+// IdempotencyKeyHeader is the request header that makes any
+// request safe to retry, whatever the method.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// RetryPolicy decides when a failed request to fwd_host is retried.
+type RetryPolicy struct {
+	// Max number of attempts, the first one included.
+	// One or less means no retries at all.
+	MaxAttempts int
+	// Response status codes that are retried.
+	StatusCodes []int
+	// Error codes that are retried, like upstream_unavailable.
+	ErrorCodes []string
+	// Time we wait before the first retry, it doubles
+	// after every retry up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+var retryPolicy = RetryPolicy{MaxAttempts: 1}
+
+// Methods we can send more than once without changing the outcome.
+var idempotentMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+	http.MethodPut:     true,
+	http.MethodDelete:  true,
+}
+
+// SetRetryPolicy sets the policy used to retry the failed requests to fwd_host.
+func SetRetryPolicy(policy RetryPolicy) {
+	if policy.MaxBackoff < policy.Backoff {
+		policy.MaxBackoff = policy.Backoff
+	}
+	retryPolicy = policy
+}
+
+// Only requests with an idempotent method, or with an idempotency key,
+// can be sent again.
+func isRetryableRequest(req *protobuf.Request) bool {
+	return idempotentMethods[strings.ToUpper(req.Method)] || getIdempotencyKey(req) != ""
+}
+
+// Check if the policy says the outcome of the request is worth a retry.
+func shouldRetry(resp *protobuf.Response, err *async.Error) bool {
+	if err != nil {
+		for _, code := range retryPolicy.ErrorCodes {
+			if code == err.Code {
+				return true
+			}
+		}
+		return false
+	}
+	for _, status := range retryPolicy.StatusCodes {
+		if int32(status) == resp.StatusCode {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the time to wait before the given retry, starting from zero.
+// Half of it is random so the retries of concurrent requests spread out.
+func getRetryDelay(retry int) time.Duration {
+	delay := retryPolicy.Backoff
+	for i := 0; i < retry && delay < retryPolicy.MaxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > retryPolicy.MaxBackoff {
+		delay = retryPolicy.MaxBackoff
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
+
+// Wait before the next retry. It returns false when the context is
+// done before that or the retry wouldn't make it before the deadline.
+func waitForRetry(ctx context.Context, delay time.Duration) bool {
+	if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+		return false
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,149 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/rgamba/postman/async"
+	"github.com/rgamba/postman/async/protobuf"
+	"github.com/rgamba/postman/stats"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestForwardRetriesFailedStatus(t *testing.T) {
+	server, calls := _startFlakyServer(2)
+	defer server.Close()
+	defer _resetRetries()
+	_setRetries(server.URL, 3)
+	before := stats.GetRetryStats()
+	resp, err := forwardRequestAndCreateResponse(context.Background(), &protobuf.Request{Method: "GET", Endpoint: "/"})
+	assert.Nil(t, err)
+	assert.Equal(t, int32(200), resp.StatusCode)
+	assert.Equal(t, int32(3), atomic.LoadInt32(calls))
+	assert.Equal(t, []string{"2"}, _getProtoHeader(resp, RetriesHeader))
+	after := stats.GetRetryStats()
+	assert.Equal(t, before.Requests+1, after.Requests)
+	assert.Equal(t, before.Retries+2, after.Retries)
+}
+
+func TestForwardRetriesExhausted(t *testing.T) {
+	server, calls := _startFlakyServer(10)
+	defer server.Close()
+	defer _resetRetries()
+	_setRetries(server.URL, 2)
+	resp, err := forwardRequestAndCreateResponse(context.Background(), &protobuf.Request{Method: "GET", Endpoint: "/"})
+	assert.Nil(t, err)
+	assert.Equal(t, int32(503), resp.StatusCode)
+	assert.Equal(t, int32(2), atomic.LoadInt32(calls))
+	assert.Equal(t, []string{"1"}, _getProtoHeader(resp, RetriesHeader))
+}
+
+func TestForwardDoesntRetryNonIdempotentRequests(t *testing.T) {
+	server, calls := _startFlakyServer(1)
+	defer server.Close()
+	defer _resetRetries()
+	_setRetries(server.URL, 3)
+	resp, err := forwardRequestAndCreateResponse(context.Background(), &protobuf.Request{Method: "POST", Endpoint: "/"})
+	assert.Nil(t, err)
+	assert.Equal(t, int32(503), resp.StatusCode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(calls))
+	assert.Nil(t, _getProtoHeader(resp, RetriesHeader))
+}
+
+func TestForwardRetriesRequestsWithIdempotencyKey(t *testing.T) {
+	server, calls := _startFlakyServer(1)
+	defer server.Close()
+	defer _resetRetries()
+	_setRetries(server.URL, 3)
+	req := &protobuf.Request{
+		Method:   "POST",
+		Endpoint: "/",
+		Headers:  []*protobuf.Header{{Name: "idempotency-key", Values: []string{"abc"}}},
+	}
+	resp, err := forwardRequestAndCreateResponse(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(200), resp.StatusCode)
+	assert.Equal(t, int32(2), atomic.LoadInt32(calls))
+}
+
+func TestForwardRetriesErrors(t *testing.T) {
+	defer _resetRetries()
+	_setRetries("http://localhost:8095", 3) // Invalid port
+	_, err := forwardRequestAndCreateResponse(context.Background(), &protobuf.Request{Method: "GET", Endpoint: "/"})
+	if assert.NotNil(t, err) {
+		assert.Equal(t, async.ErrorCodeUpstreamUnavailable, err.(*async.Error).Code)
+		assert.Contains(t, err.Error(), "after 2 retries")
+	}
+}
+
+func TestForwardDoesntRetryPastTheDeadline(t *testing.T) {
+	server, calls := _startFlakyServer(1)
+	defer server.Close()
+	defer _resetRetries()
+	_setRetries(server.URL, 3)
+	retryPolicy.Backoff = time.Second
+	retryPolicy.MaxBackoff = time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	resp, err := forwardRequestAndCreateResponse(ctx, &protobuf.Request{Method: "GET", Endpoint: "/"})
+	assert.Nil(t, err)
+	assert.Equal(t, int32(503), resp.StatusCode)
+	assert.Equal(t, int32(1), atomic.LoadInt32(calls))
+}
+
+func TestGetRetryDelay(t *testing.T) {
+	defer _resetRetries()
+	SetRetryPolicy(RetryPolicy{Backoff: 10 * time.Millisecond, MaxBackoff: 30 * time.Millisecond})
+	cases := map[int]time.Duration{
+		0: 10 * time.Millisecond,
+		1: 20 * time.Millisecond,
+		5: 30 * time.Millisecond,
+	}
+	for retry, max := range cases {
+		delay := getRetryDelay(retry)
+		assert.True(t, delay >= max/2 && delay <= max, "retry %d: %s", retry, delay)
+	}
+}
+
+func _setRetries(host string, attempts int) {
+	forwardHost = host
+	SetRetryPolicy(RetryPolicy{
+		MaxAttempts: attempts,
+		StatusCodes: []int{502, 503},
+		ErrorCodes:  []string{async.ErrorCodeUpstreamUnavailable},
+		Backoff:     time.Millisecond,
+		MaxBackoff:  5 * time.Millisecond,
+	})
+}
+
+func _resetRetries() {
+	forwardHost = fmt.Sprintf("http://localhost:%d", MockServerPort)
+	SetRetryPolicy(RetryPolicy{MaxAttempts: 1})
+}
+
+// A server that fails the first requests with a 503.
+func _startFlakyServer(failures int32) (*httptest.Server, *int32) {
+	calls := new(int32)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(calls, 1) <= failures {
+			w.WriteHeader(503)
+			return
+		}
+		w.WriteHeader(200)
+	}))
+	return server, calls
+}
+
+func _getProtoHeader(resp *protobuf.Response, name string) []string {
+	for _, header := range resp.Headers {
+		if header.Name == name {
+			return header.Values
+		}
+	}
+	return nil
+}
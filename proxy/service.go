@@ -1,16 +1,19 @@
 package proxy
 
 import (
-	"bytes"
+	"context"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/rgamba/postman/async"
 	"github.com/rgamba/postman/async/protobuf"
 	"github.com/rgamba/postman/lib"
+	"github.com/rgamba/postman/stats"
 
 	log "github.com/sirupsen/logrus"
 )
@@ -24,6 +27,7 @@ func StartHTTPServer(port int, forwardToHost string) *http.Server {
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/_postman/multiple/", multipleCalls)
+	mux.HandleFunc("/_postman/compose", composeCalls)
 	mux.HandleFunc("/", outgoingRequestHandler)
 
 	srv := &http.Server{
@@ -32,7 +36,8 @@ func StartHTTPServer(port int, forwardToHost string) *http.Server {
 	}
 
 	go func() {
-		if err := srv.ListenAndServe(); err != nil {
+		// ErrServerClosed means the server is being shut down.
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
 			log.Fatalf("Httpserver: ListenAndServe() error: %s", err)
 		}
 	}()
@@ -42,62 +47,173 @@ func StartHTTPServer(port int, forwardToHost string) *http.Server {
 
 // Here we need to forward the request as an HTTP call to
 // http.fwd_host which will normally be localhost.
-func forwardRequestAndCreateResponse(req *protobuf.Request) (*protobuf.Response, error) {
-	httpResponse, err := forwardRequestCall(req)
+// Any error will be returned as an *async.Error so the error
+// code gets propagated back to the caller.
+// Requests with an idempotency key we already got a response for
+// are not forwarded again, they get the same response.
+// A request body in the blob store is removed once the request is acked,
+// or once we are done with it if the request isn't coming from the broker.
+func forwardRequestAndCreateResponse(ctx context.Context, req *protobuf.Request) (*protobuf.Response, error) {
+	if ref := getClaimCheck(req.Headers); ref != "" {
+		cleanup := func() {
+			deleteClaimCheck(ref)
+		}
+		if !async.AfterAck(ctx, cleanup) {
+			defer cleanup()
+		}
+	}
+	return forwardIdempotentRequest(ctx, req)
+}
+
+// Failed requests are retried according to the retry policy, the
+// number of retries is sent back in the retries header.
+func forwardRequestWithRetries(ctx context.Context, req *protobuf.Request) (*protobuf.Response, error) {
+	retries := 0
+	resp, err := forwardRequest(ctx, req)
+	// Streamed responses, and tunnels, are already on their way to the requester.
+	for retries+1 < retryPolicy.MaxAttempts && isRetryableRequest(req) && !async.IsResponseStreamed(ctx) && !async.IsTunnelOpened(ctx) && shouldRetry(resp, err) {
+		if !waitForRetry(ctx, getRetryDelay(retries)) {
+			break
+		}
+		retries++
+		if resp != nil {
+			deleteClaimCheck(getClaimCheck(resp.Headers))
+		}
+		resp, err = forwardRequest(ctx, req)
+	}
+	stats.RecordForwardRetries(retries)
 	if err != nil {
+		if retries > 0 {
+			err.Message = fmt.Sprintf("%s (after %d retries)", err.Message, retries)
+		}
 		return nil, err
 	}
+	if retries > 0 {
+		resp.Headers = append(resp.Headers, &protobuf.Header{
+			Name:   RetriesHeader,
+			Values: []string{strconv.Itoa(retries)},
+		})
+	}
+	return resp, nil
+}
+
+// Send a single request to fwd_host. The response is streamed
+// if it can be and the requester accepts it.
+func forwardRequest(ctx context.Context, req *protobuf.Request) (*protobuf.Response, *async.Error) {
+	// The requester wants to switch to the WebSocket protocol.
+	if async.CanOpenTunnel(ctx) {
+		return forwardWebSocketUpgrade(ctx, req)
+	}
+	httpResponse, err := forwardRequestCall(ctx, req)
+	if err != nil {
+		return nil, createForwardError(err)
+	}
+	if async.CanStreamResponse(ctx) && isStreamingResponse(httpResponse) {
+		return streamHTTPResponse(ctx, req, httpResponse)
+	}
 	resp, err := convertHTTPResponseToProtoResponse(httpResponse)
 	if err != nil {
-		return nil, err
+		return nil, async.NewError(async.ErrorCodeUpstreamUnavailable, err.Error(), nil)
 	}
 	resp.RequestId = req.Id
 	return resp, nil
 }
 
+// Get the async error that corresponds to an error
+// returned by forwardRequestCall.
+func createForwardError(err error) *async.Error {
+	urlErr, ok := err.(*url.Error)
+	if !ok {
+		// The request couldn't even be created.
+		return async.NewError(async.ErrorCodeInvalidRequest, err.Error(), nil)
+	}
+	if urlErr.Timeout() {
+		return async.NewError(async.ErrorCodeUpstreamTimeout, err.Error(), nil)
+	}
+	return async.NewError(async.ErrorCodeUpstreamUnavailable, err.Error(), nil)
+}
+
 // Convert the proto.Request message to an HTTP request and send it through
 // to forwardHost via HTTP which will normally live in the same host.
-// TODO: we should split this function in several smaller ones.
-func forwardRequestCall(req *protobuf.Request) (*http.Response, error) {
-	// Make request
+// The call is aborted once the context is done, that is when the caller
+// cancels the request or the request deadline is reached. The deadline
+// can be lifted once we get the response head, see keepReadingPastDeadline.
+func forwardRequestCall(ctx context.Context, req *protobuf.Request) (*http.Response, error) {
+	callCtx, deadline := watchDeadline(ctx)
+	request, err := createForwardRequest(callCtx, req)
+	if err != nil {
+		deadline.stop()
+		return nil, err
+	}
+	// Send and get the response
 	client := &http.Client{}
+	response, err := client.Do(request)
+	if err != nil {
+		deadline.stop()
+		// The call was aborted because of the deadline, that's a timeout.
+		if urlErr, ok := err.(*url.Error); ok && ctx.Err() == context.DeadlineExceeded {
+			urlErr.Err = ctx.Err()
+		}
+		return nil, err
+	}
+	response.Body = &forwardBody{ReadCloser: response.Body, deadline: deadline}
+	return response, nil
+}
+
+// Convert the proto.Request message to the HTTP request sent to forwardHost.
+func createForwardRequest(ctx context.Context, req *protobuf.Request) (*http.Request, error) {
 	if forwardHost[len(forwardHost)-1] == '/' {
 		forwardHost = forwardHost[:len(forwardHost)-1]
 	}
 	endpoint := fmt.Sprintf("%s%s", forwardHost, req.Endpoint)
-	// Create request body
-	body := bytes.NewBuffer([]byte{})
-	if req.Body != "" {
-		body = bytes.NewBuffer([]byte(req.Body))
+	if req.Query != "" {
+		endpoint += "?" + req.Query
+	}
+	// Create request, the body is streamed from the blob store if it's there.
+	body, size, err := openBody(req.Body, req.Headers)
+	if err != nil {
+		return nil, err
 	}
-	// Create request
 	request, err := http.NewRequest(req.Method, endpoint, body)
 	if err != nil {
+		body.Close()
 		return nil, err
 	}
+	request.ContentLength = size
+	request = request.WithContext(ctx)
 	// Add headers to request
 	for _, header := range req.Headers {
-		parts := strings.Split(header, ":")
-		request.Header.Add(parts[0], parts[1])
+		if isClaimCheckHeader(header.Name) {
+			continue
+		}
+		for _, value := range header.Values {
+			request.Header.Add(header.Name, value)
+		}
 	}
-	// Send and get the response
-	response, err := client.Do(request)
-	if err != nil {
-		return nil, err
+	// Let the service know the host the caller used.
+	if req.Host != "" && request.Header.Get("X-Forwarded-Host") == "" {
+		request.Header.Set("X-Forwarded-Host", req.Host)
 	}
-	return response, nil
+	return request, nil
 }
 
+// Big response bodies go to the blob store, the response
+// gets the reference to the body in the claim check header.
 func convertHTTPResponseToProtoResponse(response *http.Response) (*protobuf.Response, error) {
 	defer response.Body.Close()
-	body, err := ioutil.ReadAll(response.Body)
+	body, ref, err := readBody(response.Body)
 	if err != nil {
 		return nil, err
 	}
+	// Only we get to set it, the reference could point to any blob.
+	response.Header.Del(ClaimCheckHeader)
 	resp := &protobuf.Response{
-		Body:       string(body),
+		Body:       body,
 		StatusCode: int32(response.StatusCode),
-		Headers:    convertHTTPHeadersToSlice(response.Header),
+		Headers:    convertHTTPHeadersToProto(response.Header),
+	}
+	if ref != "" {
+		resp.Headers = append(resp.Headers, &protobuf.Header{Name: ClaimCheckHeader, Values: []string{ref}})
 	}
 	return resp, nil
 }
@@ -106,60 +222,98 @@ func convertHTTPResponseToProtoResponse(response *http.Response) (*protobuf.Resp
 // and convert it to a protobuf.Response and then send it via the async package.
 // TODO: We need to break this large function apart.
 func outgoingRequestHandler(w http.ResponseWriter, r *http.Request) {
-	ch, err := async.CreateNewChannel()
+	serviceName := getServiceNameFromPath(r.URL.Path)
+	if serviceName == "" {
+		// TODO: generalize and create a return error func
+		sendJSON(w, map[string]string{
+			"error":   "invalid_parameters",
+			"message": "service name is required",
+		}, 400)
+		return
+	}
+	body, ref, err := readBody(r.Body)
 	if err != nil {
-		log.WithFields(log.Fields{
-			"error": err.ToMap(),
-		}).Warnf("Create channel error")
-		sendJSON(w, err.ToMap(), http.StatusBadRequest)
+		sendJSON(w, map[string]string{
+			"error":   "unexpected",
+			"message": fmt.Sprintf("Unable to read the request body: %s", err),
+		}, 500)
 		return
 	}
-	defer ch.Close()
-
-	body, _ := ioutil.ReadAll(r.Body)
+	// Only we get to set it, the reference could point to any blob.
+	r.Header.Del(ClaimCheckHeader)
 	request := &protobuf.Request{
 		Method:        r.Method,
-		Headers:       convertHTTPHeadersToSlice(r.Header),
-		Body:          string(body),
+		Headers:       convertHTTPHeadersToProto(r.Header),
+		Body:          body,
 		Endpoint:      getPathWithoutServiceName(r.URL.Path),
+		Query:         r.URL.RawQuery,
+		Host:          r.Host,
+		Protocol:      r.Proto,
 		ResponseQueue: async.ResponseQueueName,
 		Service:       async.ServiceName,
 	}
-	serviceName := getServiceNameFromPath(r.URL.Path)
-	if serviceName == "" {
-		// TODO: generalize and create a return error func
-		sendJSON(w, map[string]string{
-			"error":   "invalid_parameters",
-			"message": "service name is required",
-		}, 400)
+	if ref != "" {
+		request.Headers = append(request.Headers, &protobuf.Header{Name: ClaimCheckHeader, Values: []string{ref}})
+	}
+	if isWebSocketUpgrade(r.Header) {
+		tunnelWebSocket(w, r, serviceName, request)
 		return
 	}
 	// Check if the request needs a response or we can discard the response.
 	if requestWantsToDiscardResponse(r) {
 		// The request doesn't need us to wait for a response, then we'll just
 		// send the response and send back a 201 - Created status code.
-		err := async.SendMessageAndDiscardResponse(ch, serviceName, request)
+		err := async.SendMessageAndDiscardResponse(serviceName, request)
 		var resp *protobuf.Response
 		if err == nil {
-			resp = &protobuf.Response{StatusCode: 201, Body: ""}
+			resp = &protobuf.Response{StatusCode: 201}
 		}
 		sendHTTPResponseFromProtobufResponse(w, resp, err)
 		return
 	}
 	// As the response is async we'll need to sync processes.
 	c := make(chan bool)
+	// The destination service will drop the request if it can't get to
+	// it before the deadline, we'll get a timeout error by then.
+	deadline := time.Now().Add(getRequestTimeout(serviceName, r))
+	// Streamed responses are sent from here, that way we can abort the
+	// connection if the stream fails.
+	var head *protobuf.Response
+	var stream *async.ResponseStream
 	// Send the message via async and get back a response
-	async.SendRequestMessage(ch, serviceName, request, func(resp *protobuf.Response, err *async.Error) {
-		sendHTTPResponseFromProtobufResponse(w, resp, err)
-		c <- true
+	async.SendStreamingRequestMessage(serviceName, request, deadline, func(resp *protobuf.Response, s *async.ResponseStream, err *async.Error) {
+		if s != nil {
+			head, stream = resp, s
+		} else {
+			sendHTTPResponseFromProtobufResponse(w, resp, err)
+		}
+		close(c)
 	})
-	// Wait for the response or timeout after 15 seconds.
+	// Wait for the response, the timeout or the caller to go away.
+	// When the caller goes away the destination service is asked
+	// to stop processing the request.
 	select {
 	case <-c:
 		// Pass
-	case <-time.After(15 * time.Second):
-		sendJSON(w, createResponseError("timeout"), http.StatusInternalServerError)
+	case <-r.Context().Done():
+		// The callback may be writing the response already, we can't
+		// return until it is done with the response writer.
+		if !async.CancelRequest(request.Id) {
+			<-c
+		}
+	}
+	if stream != nil {
+		sendHTTPResponseFromStream(r.Context(), w, head, stream)
+	}
+}
+
+// Retry-After is in whole seconds, rounded up.
+func formatRetryAfter(delay time.Duration) string {
+	seconds := int64((delay + time.Second - 1) / time.Second)
+	if seconds < 1 {
+		seconds = 1
 	}
+	return strconv.FormatInt(seconds, 10)
 }
 
 func requestWantsToDiscardResponse(request *http.Request) bool {
@@ -182,28 +336,61 @@ func sendHTTPResponseFromProtobufResponse(w http.ResponseWriter, resp *protobuf.
 		log.WithFields(log.Fields{
 			"error": err,
 		}).Warnf("Message response error")
-		sendJSON(w, err.ToMap(), http.StatusBadRequest)
+		w.Header().Set("Postman-Error", err.Code)
+		if err.Code == async.ErrorCodeBrokerUnavailable {
+			// The caller can retry once we try to reconnect.
+			w.Header().Set("Retry-After", formatRetryAfter(async.TimeUntilReconnect()))
+		}
+		sendJSON(w, err.ToMap(), getStatusCodeFromError(err))
+		return
+	}
+	// The body may be in the blob store, it's removed once sent.
+	ref := getClaimCheck(resp.Headers)
+	body, size, openErr := openBody(resp.Body, resp.Headers)
+	if openErr != nil {
+		sendHTTPResponseFromProtobufResponse(w, nil, async.NewError(
+			async.ErrorCodeUpstreamError,
+			fmt.Sprintf("Unable to get the response body: %s", openErr),
+			nil,
+		))
 		return
 	}
+	defer body.Close()
 	// Add headers
 	for _, header := range resp.Headers {
-		parts := strings.Split(header, ":")
-		w.Header().Set(parts[0], parts[1])
+		if isClaimCheckHeader(header.Name) {
+			continue
+		}
+		w.Header()[http.CanonicalHeaderKey(header.Name)] = header.Values
 	}
 	addRequestIDToHTTPResponse(w, resp)
+	if ref != "" {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+		defer deleteClaimCheck(ref)
+	}
 	// Status code and body
 	w.WriteHeader(int(resp.StatusCode))
-	w.Write([]byte(resp.Body))
+	io.Copy(w, body)
 }
 
-func addRequestIDToHTTPResponse(w http.ResponseWriter, resp *protobuf.Response) {
-	w.Header().Set("Postman-Id", resp.RequestId)
+// Get the HTTP status code we'll send back to the caller for the given error.
+// Errors that happened on the other end are reported as gateway errors.
+func getStatusCodeFromError(err *async.Error) int {
+	switch err.Code {
+	case async.ErrorCodeUpstreamUnavailable, async.ErrorCodeNoAvailableInstances,
+		async.ErrorCodeTooManyPendingRequests, async.ErrorCodeBrokerUnavailable:
+		return http.StatusServiceUnavailable
+	case async.ErrorCodeUpstreamTimeout, async.ErrorCodeTimeout:
+		return http.StatusGatewayTimeout
+	case async.ErrorCodeUpstreamError, async.ErrorCodeInvalidRequest,
+		async.ErrorCodeInvalidFormat, async.ErrorCodeInvalidVersion:
+		return http.StatusBadGateway
+	}
+	return http.StatusBadRequest
 }
 
-func createResponseError(err interface{}) map[string]string {
-	return map[string]string{
-		"error": fmt.Sprintf("%s", err),
-	}
+func addRequestIDToHTTPResponse(w http.ResponseWriter, resp *protobuf.Response) {
+	w.Header().Set("Postman-Id", resp.RequestId)
 }
 
 func sendJSON(w http.ResponseWriter, arr interface{}, statusCode int) {
@@ -214,11 +401,13 @@ func sendResponse(w http.ResponseWriter, content []byte, statusCode int) {
 	lib.SendResponse(w, content, statusCode)
 }
 
-func convertHTTPHeadersToSlice(head map[string][]string) []string {
-	headers := []string{}
-	for headerName, parts := range head {
-		newHeader := fmt.Sprintf("%s: %s", headerName, strings.Join(parts, "; "))
-		headers = append(headers, newHeader)
+func convertHTTPHeadersToProto(head map[string][]string) []*protobuf.Header {
+	headers := []*protobuf.Header{}
+	for headerName, values := range head {
+		headers = append(headers, &protobuf.Header{
+			Name:   headerName,
+			Values: values,
+		})
 	}
 	return headers
 }
@@ -244,10 +433,3 @@ func getPathWithoutServiceName(path string) string {
 	}
 	return "/" + strings.Join(parts[2:], "/")
 }
-
-func multipleCalls(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "POST" {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-	}
-
-}
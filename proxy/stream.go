@@ -0,0 +1,164 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/rgamba/postman/async"
+	"github.com/rgamba/postman/async/protobuf"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Max size of each chunk of a streamed response. Whatever we
+// get from fwd_host is sent right away, even if it's smaller.
+const streamChunkSize = 32 * 1024
+
+// Responses we don't know the length of, like chunked responses,
+// and event streams are streamed as they come.
+func isStreamingResponse(response *http.Response) bool {
+	return response.ContentLength < 0 ||
+		strings.HasPrefix(response.Header.Get("Content-Type"), "text/event-stream")
+}
+
+// Aborts the call to fwd_host once the request deadline is
+// reached, unless we stopped watching it before that.
+type deadlineWatcher struct {
+	mutex    sync.Mutex
+	detached bool
+	cancel   context.CancelFunc
+	done     chan struct{}
+	stopOnce sync.Once
+}
+
+// Get the context for the call to fwd_host. It is done once the request gets
+// canceled or its deadline is reached, just like ctx, but the deadline can
+// be lifted. The watcher must be stopped once we are done with the call.
+func watchDeadline(ctx context.Context) (context.Context, *deadlineWatcher) {
+	callCtx, cancel := context.WithCancel(async.WithoutDeadline(ctx))
+	watcher := &deadlineWatcher{cancel: cancel, done: make(chan struct{})}
+	go func() {
+		select {
+		case <-ctx.Done():
+			watcher.mutex.Lock()
+			if !watcher.detached {
+				cancel()
+			}
+			watcher.mutex.Unlock()
+		case <-watcher.done:
+		}
+	}()
+	return callCtx, watcher
+}
+
+// Stop aborting the call once the deadline is reached, it's
+// still aborted once the request gets canceled.
+func (w *deadlineWatcher) detach() {
+	w.mutex.Lock()
+	w.detached = true
+	w.mutex.Unlock()
+}
+
+func (w *deadlineWatcher) stop() {
+	w.stopOnce.Do(func() {
+		close(w.done)
+		w.cancel()
+	})
+}
+
+// Body of the response of fwd_host, the call is done once it's closed.
+type forwardBody struct {
+	io.ReadCloser
+	deadline *deadlineWatcher
+}
+
+func (b *forwardBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.deadline.stop()
+	return err
+}
+
+// Keep reading the response body once the request deadline is reached.
+func keepReadingPastDeadline(response *http.Response) {
+	if body, ok := response.Body.(*forwardBody); ok {
+		body.deadline.detach()
+	}
+}
+
+// Send the response head to the requester, then send the body in chunks
+// as we read it from fwd_host. The returned response is the head, it
+// doesn't need to be sent anymore. The body is not bound to the request
+// deadline, the stream fails if the requester stops acking the chunks
+// within the idle timeout instead.
+func streamHTTPResponse(ctx context.Context, req *protobuf.Request, response *http.Response) (*protobuf.Response, *async.Error) {
+	defer response.Body.Close()
+	resp := &protobuf.Response{
+		RequestId:  req.Id,
+		StatusCode: int32(response.StatusCode),
+		Headers:    convertHTTPHeadersToProto(response.Header),
+	}
+	writer, err := async.StartResponseStream(ctx, resp)
+	if err != nil {
+		return nil, async.NewError(async.ErrorCodeUpstreamError, err.Error(), nil)
+	}
+	keepReadingPastDeadline(response)
+	buf := make([]byte, streamChunkSize)
+	for {
+		n, readErr := response.Body.Read(buf)
+		if n > 0 {
+			if _, err := writer.Write(buf[:n]); err != nil {
+				log.WithFields(log.Fields{
+					"error":      err,
+					"request_id": req.Id,
+				}).Warn("Stream aborted")
+				writer.Close(async.NewError(async.ErrorCodeUpstreamError, err.Error(), nil))
+				return resp, nil
+			}
+		}
+		if readErr == io.EOF {
+			writer.Close(nil)
+			return resp, nil
+		}
+		if readErr != nil {
+			writer.Close(async.NewError(async.ErrorCodeUpstreamUnavailable, readErr.Error(), nil))
+			return resp, nil
+		}
+	}
+}
+
+// Send the response head to the caller, then each chunk as soon as it
+// arrives. The connection is aborted if the stream fails, that way the
+// caller can tell the body is not complete.
+func sendHTTPResponseFromStream(ctx context.Context, w http.ResponseWriter, resp *protobuf.Response, stream *async.ResponseStream) {
+	defer stream.Close()
+	for _, header := range resp.Headers {
+		w.Header()[http.CanonicalHeaderKey(header.Name)] = header.Values
+	}
+	addRequestIDToHTTPResponse(w, resp)
+	w.WriteHeader(int(resp.StatusCode))
+	flush(w)
+	for {
+		chunk, err := stream.Next(ctx)
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.WithFields(log.Fields{
+				"error":      err,
+				"request_id": resp.RequestId,
+			}).Warn("Streamed response failed")
+			panic(http.ErrAbortHandler)
+		}
+		w.Write(chunk)
+		flush(w)
+	}
+}
+
+func flush(w http.ResponseWriter) {
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/rgamba/postman/async"
+	"github.com/stretchr/testify/assert"
+)
+
+// Lets the stream handler of the mock server go on.
+var streamRelease = make(chan bool)
+
+func TestStreamedResponse(t *testing.T) {
+	async.SetStreaming(2, time.Second)
+	defer async.SetStreaming(0, 30*time.Second)
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/test/stream", TestServerPort))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	// We get the first event before fwd_host sends the rest.
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "data: 1\n", line)
+	streamRelease <- true
+	rest, err := ioutil.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, "\ndata: 2\n\ndata: 3\n\n", string(rest))
+}
+
+func TestStreamedResponsePastDeadline(t *testing.T) {
+	async.SetStreaming(2, time.Second)
+	defer async.SetStreaming(0, 30*time.Second)
+	req, _ := http.NewRequest("GET", fmt.Sprintf("http://localhost:%d/test/stream", TestServerPort), nil)
+	req.Header.Set(TimeoutHeader, "200ms")
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+	line, err := reader.ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "data: 1\n", line)
+	// The rest of the body is sent once the deadline is gone.
+	time.Sleep(400 * time.Millisecond)
+	streamRelease <- true
+	rest, err := ioutil.ReadAll(reader)
+	assert.Nil(t, err)
+	assert.Equal(t, "\ndata: 2\n\ndata: 3\n\n", string(rest))
+}
+
+func TestStreamedResponseFailure(t *testing.T) {
+	async.SetStreaming(2, time.Second)
+	defer async.SetStreaming(0, 30*time.Second)
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/test/stream?fail=1", TestServerPort))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer resp.Body.Close()
+	streamRelease <- true
+	// The connection is aborted, the body is not complete.
+	_, err = ioutil.ReadAll(resp.Body)
+	assert.NotNil(t, err)
+}
+
+func TestResponseIsNotStreamedUnlessAccepted(t *testing.T) {
+	go func() {
+		streamRelease <- true
+	}()
+	body, statusCode, err := _getRequestTestServer("/test/stream")
+	assert.Nil(t, err)
+	assert.Equal(t, 200, statusCode)
+	assert.Equal(t, "data: 1\n\ndata: 2\n\ndata: 3\n\n", body)
+}
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/rgamba/postman/async"
+)
+
+// TimeoutHeader is the request header the caller can use
+// to shorten the time we'll wait for the response.
+const TimeoutHeader = async.TimeoutHeader
+
+var (
+	// Default time we'll wait for the response of a request.
+	receiveTimeout = 10 * time.Second
+	// Time we'll wait for the response of a request per destination
+	// service. Service names are lower case.
+	serviceTimeouts = map[string]time.Duration{}
+)
+
+// SetTimeouts sets the default time we'll wait for the response of
+// a request and the timeouts for specific destination services, those
+// will override the default timeout.
+func SetTimeouts(defaultTimeout time.Duration, services map[string]time.Duration) {
+	if defaultTimeout > 0 {
+		receiveTimeout = defaultTimeout
+	}
+	serviceTimeouts = map[string]time.Duration{}
+	for name, timeout := range services {
+		serviceTimeouts[strings.ToLower(name)] = timeout
+	}
+}
+
+// Get the time we'll wait for the response of the request. The timeout
+// header can only shorten the timeout of the destination service.
+func getRequestTimeout(serviceName string, r *http.Request) time.Duration {
+	timeout := receiveTimeout
+	if serviceTimeout, ok := serviceTimeouts[strings.ToLower(serviceName)]; ok {
+		timeout = serviceTimeout
+	}
+	if headerTimeout, ok := parseTimeout(r.Header.Get(TimeoutHeader)); ok && headerTimeout < timeout {
+		timeout = headerTimeout
+	}
+	return timeout
+}
+
+// Timeouts can be either a number of seconds ("2", "0.5")
+// or a duration ("500ms", "2s").
+func parseTimeout(value string) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		if seconds <= 0 {
+			return 0, false
+		}
+		return time.Duration(seconds * float64(time.Second)), true
+	}
+	timeout, err := time.ParseDuration(value)
+	if err != nil || timeout <= 0 {
+		return 0, false
+	}
+	return timeout, true
+}
@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTimeout(t *testing.T) {
+	values := map[string]time.Duration{
+		"2":     2 * time.Second,
+		"0.5":   500 * time.Millisecond,
+		"500ms": 500 * time.Millisecond,
+		" 1s ":  time.Second,
+	}
+	for value, expected := range values {
+		timeout, ok := parseTimeout(value)
+		assert.True(t, ok, value)
+		assert.Equal(t, expected, timeout, value)
+	}
+	for _, value := range []string{"", "0", "-1", "invalid", "-2s"} {
+		_, ok := parseTimeout(value)
+		assert.False(t, ok, value)
+	}
+}
+
+func TestGetRequestTimeout(t *testing.T) {
+	defer SetTimeouts(receiveTimeout, nil)
+	SetTimeouts(10*time.Second, map[string]time.Duration{"Slow-Service": 30 * time.Second})
+	r, _ := http.NewRequest("GET", "/", nil)
+	assert.Equal(t, 10*time.Second, getRequestTimeout("other-service", r))
+	assert.Equal(t, 30*time.Second, getRequestTimeout("slow-service", r))
+	// The header can shorten the timeout but never extend it.
+	r.Header.Set(TimeoutHeader, "5")
+	assert.Equal(t, 5*time.Second, getRequestTimeout("other-service", r))
+	r.Header.Set(TimeoutHeader, "60")
+	assert.Equal(t, 30*time.Second, getRequestTimeout("slow-service", r))
+}
@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/rgamba/postman/async"
+	"github.com/rgamba/postman/async/protobuf"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Check if the request asks to switch the connection to the WebSocket protocol.
+func isWebSocketUpgrade(header http.Header) bool {
+	if !strings.EqualFold(header.Get("Upgrade"), "websocket") {
+		return false
+	}
+	for _, value := range header["Connection"] {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Send the WebSocket handshake to the destination service through the
+// broker. If the service accepts it, we take over the connection and
+// relay the frames both ways through the tunnel, until either end
+// closes the connection.
+func tunnelWebSocket(w http.ResponseWriter, r *http.Request, serviceName string, request *protobuf.Request) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		sendJSON(w, map[string]string{
+			"error":   "unexpected",
+			"message": "Unable to take over the connection",
+		}, 500)
+		return
+	}
+	c := make(chan bool)
+	deadline := time.Now().Add(getRequestTimeout(serviceName, r))
+	var head *protobuf.Response
+	var tunnel *async.Tunnel
+	async.SendTunnelRequestMessage(serviceName, request, deadline, func(resp *protobuf.Response, t *async.Tunnel, err *async.Error) {
+		if t != nil {
+			head, tunnel = resp, t
+		} else {
+			sendHTTPResponseFromProtobufResponse(w, resp, err)
+		}
+		close(c)
+	})
+	select {
+	case <-c:
+		// Pass
+	case <-r.Context().Done():
+		if !async.CancelRequest(request.Id) {
+			<-c
+		}
+	}
+	if tunnel == nil {
+		return
+	}
+	conn, buf, err := hijacker.Hijack()
+	if err != nil {
+		log.WithFields(log.Fields{
+			"error":      err,
+			"request_id": request.Id,
+		}).Warn("Unable to take over the connection")
+		tunnel.Close()
+		return
+	}
+	header := http.Header{}
+	for _, h := range head.Headers {
+		header[http.CanonicalHeaderKey(h.Name)] = h.Values
+	}
+	header.Set("Postman-Id", head.RequestId)
+	fmt.Fprintf(buf, "HTTP/1.1 %d %s\r\n", head.StatusCode, http.StatusText(int(head.StatusCode)))
+	header.Write(buf)
+	buf.WriteString("\r\n")
+	if err := buf.Flush(); err != nil {
+		conn.Close()
+		tunnel.Close()
+		return
+	}
+	relayTunnel(conn, buf.Reader, tunnel)
+}
+
+// Send the WebSocket handshake to fwd_host. If it switches protocols, the
+// response is sent back along with a tunnel to the requester and the
+// connection is relayed through it in the background. Any other response
+// is sent back as usual.
+func forwardWebSocketUpgrade(ctx context.Context, req *protobuf.Request) (*protobuf.Response, *async.Error) {
+	request, err := createForwardRequest(ctx, req)
+	if err != nil {
+		return nil, async.NewError(async.ErrorCodeInvalidRequest, err.Error(), nil)
+	}
+	conn, err := dialForwardHost(ctx, request.URL)
+	if err != nil {
+		return nil, async.NewError(async.ErrorCodeUpstreamUnavailable, err.Error(), nil)
+	}
+	// The handshake must be done before the deadline, the tunnel has no deadline.
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	reader := bufio.NewReader(conn)
+	response, err := sendWebSocketHandshake(conn, reader, request)
+	if err != nil {
+		conn.Close()
+		return nil, createHandshakeError(err)
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		defer conn.Close()
+		resp, err := convertHTTPResponseToProtoResponse(response)
+		if err != nil {
+			return nil, async.NewError(async.ErrorCodeUpstreamUnavailable, err.Error(), nil)
+		}
+		resp.RequestId = req.Id
+		return resp, nil
+	}
+	conn.SetDeadline(time.Time{})
+	resp := &protobuf.Response{
+		RequestId:  req.Id,
+		StatusCode: int32(response.StatusCode),
+		Headers:    convertHTTPHeadersToProto(response.Header),
+	}
+	tunnel, err := async.OpenTunnel(ctx, resp)
+	if err != nil {
+		conn.Close()
+		return nil, async.NewError(async.ErrorCodeUpstreamError, err.Error(), nil)
+	}
+	go relayTunnel(conn, reader, tunnel)
+	return resp, nil
+}
+
+// Open a connection to fwd_host, the standard ports are used if there is none.
+func dialForwardHost(ctx context.Context, u *url.URL) (net.Conn, error) {
+	host := u.Host
+	if u.Port() == "" {
+		if u.Scheme == "https" {
+			host = net.JoinHostPort(u.Hostname(), "443")
+		} else {
+			host = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+	dialer := &net.Dialer{}
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil || u.Scheme != "https" {
+		return conn, err
+	}
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+	if err := tlsConn.Handshake(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+func sendWebSocketHandshake(conn net.Conn, reader *bufio.Reader, request *http.Request) (*http.Response, error) {
+	if err := request.Write(conn); err != nil {
+		return nil, err
+	}
+	return http.ReadResponse(reader, request)
+}
+
+func createHandshakeError(err error) *async.Error {
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		return async.NewError(async.ErrorCodeUpstreamTimeout, err.Error(), nil)
+	}
+	return async.NewError(async.ErrorCodeUpstreamUnavailable, err.Error(), nil)
+}
+
+// Relay the data both ways between the connection and the tunnel, the
+// WebSocket frames, close and ping frames included, get to the other
+// end as they are. Once either end is done, both are closed.
+func relayTunnel(conn net.Conn, reader io.Reader, tunnel *async.Tunnel) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(tunnel, reader)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, tunnel)
+		done <- struct{}{}
+	}()
+	<-done
+	conn.Close()
+	tunnel.Close()
+	<-done
+}
@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Notified once the mock server closes a WebSocket connection.
+var wsClosed = make(chan bool, 1)
+
+func TestWebSocketTunnel(t *testing.T) {
+	conn, reader, resp := _openWebSocket(t, "/test/ws", "dGhlIHNhbXBsZSBub25jZQ==")
+	defer conn.Close()
+	if !assert.Equal(t, 101, resp.StatusCode) {
+		return
+	}
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", resp.Header.Get("Sec-WebSocket-Accept"))
+	assert.NotEmpty(t, resp.Header.Get("Postman-Id"))
+	// Masked text, ping and close frames get to the other end as they are.
+	frames := [][]byte{
+		{0x81, 0x82, 0x01, 0x02, 0x03, 0x04, 'h' ^ 0x01, 'i' ^ 0x02},
+		{0x89, 0x80, 0x01, 0x02, 0x03, 0x04},
+		{0x88, 0x82, 0x01, 0x02, 0x03, 0x04, 0x03 ^ 0x01, 0xe8 ^ 0x02},
+	}
+	for _, frame := range frames {
+		conn.Write(frame)
+		echo := make([]byte, len(frame))
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err := io.ReadFull(reader, echo)
+		assert.Nil(t, err)
+		assert.Equal(t, frame, echo)
+	}
+	// Closing the connection closes the one to fwd_host.
+	conn.Close()
+	select {
+	case <-wsClosed:
+	case <-time.After(time.Second):
+		t.Fatal("The connection to fwd_host was not closed")
+	}
+}
+
+func TestWebSocketHandshakeRejected(t *testing.T) {
+	conn, reader, resp := _openWebSocket(t, "/test/ws", "")
+	defer conn.Close()
+	assert.Equal(t, 400, resp.StatusCode)
+	body, _ := ioutil.ReadAll(resp.Body)
+	assert.Equal(t, "not a websocket handshake", string(body))
+	// The connection is still HTTP.
+	fmt.Fprintf(conn, "GET /test/one HTTP/1.1\r\nHost: localhost\r\n\r\n")
+	resp, err := http.ReadResponse(reader, nil)
+	if assert.Nil(t, err) {
+		body, _ = ioutil.ReadAll(resp.Body)
+		assert.Equal(t, "one", string(body))
+	}
+}
+
+func TestIsWebSocketUpgrade(t *testing.T) {
+	assert.True(t, isWebSocketUpgrade(http.Header{"Upgrade": {"websocket"}, "Connection": {"Upgrade"}}))
+	assert.True(t, isWebSocketUpgrade(http.Header{"Upgrade": {"WebSocket"}, "Connection": {"keep-alive, upgrade"}}))
+	assert.False(t, isWebSocketUpgrade(http.Header{"Upgrade": {"websocket"}}))
+	assert.False(t, isWebSocketUpgrade(http.Header{"Upgrade": {"h2c"}, "Connection": {"Upgrade"}}))
+}
+
+// Send the WebSocket handshake to the proxy, no key is sent if it's empty.
+func _openWebSocket(t *testing.T, path string, key string) (net.Conn, *bufio.Reader, *http.Response) {
+	conn, err := net.Dial("tcp", fmt.Sprintf("localhost:%d", TestServerPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintf(conn, "GET %s HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n", path)
+	if key != "" {
+		fmt.Fprintf(conn, "Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\n", key)
+	}
+	fmt.Fprintf(conn, "\r\n")
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		conn.Close()
+		t.Fatal(err)
+	}
+	return conn, reader, resp
+}
+
+func _webSocketAccept(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key+"258EAFA5-E914-47DA-95CA-C5AB0DC85B11")
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,39 @@
+package stats
+
+import "sync"
+
+// CompressionStats holds the stats of the compressed messages.
+type CompressionStats struct {
+	// Number of messages sent compressed.
+	Messages int64 `json:"messages"`
+	// Size of those messages before and after compression, in bytes.
+	OriginalBytes   int64 `json:"original_bytes"`
+	CompressedBytes int64 `json:"compressed_bytes"`
+	// Compressed size over original size, zero when
+	// there are no compressed messages yet.
+	Ratio float64 `json:"ratio"`
+}
+
+var compression = CompressionStats{}
+var compressionMutex sync.Mutex
+
+// RecordCompression needs to be called for each compressed
+// message with its size before and after compression.
+func RecordCompression(originalSize int, compressedSize int) {
+	compressionMutex.Lock()
+	defer compressionMutex.Unlock()
+	compression.Messages++
+	compression.OriginalBytes += int64(originalSize)
+	compression.CompressedBytes += int64(compressedSize)
+}
+
+// GetCompressionStats returns a snapshot of the compression stats.
+func GetCompressionStats() CompressionStats {
+	compressionMutex.Lock()
+	defer compressionMutex.Unlock()
+	result := compression
+	if result.OriginalBytes > 0 {
+		result.Ratio = float64(result.CompressedBytes) / float64(result.OriginalBytes)
+	}
+	return result
+}
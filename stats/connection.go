@@ -0,0 +1,38 @@
+package stats
+
+import "sync"
+
+// ConnectionStats holds the stats of the connection to the broker.
+type ConnectionStats struct {
+	// Number of times we tried to connect, including the first one.
+	Attempts int64 `json:"attempts"`
+	// Number of attempts that failed.
+	Failures  int64  `json:"failures"`
+	LastError string `json:"last_error"`
+	// The broker node we are connected to, or were connected to last.
+	Node string `json:"node"`
+}
+
+var connection = ConnectionStats{}
+var connectionMutex sync.Mutex
+
+// RecordConnectionAttempt needs to be called after each attempt to
+// connect to the broker, err is nil when we got connected to node.
+func RecordConnectionAttempt(node string, err error) {
+	connectionMutex.Lock()
+	defer connectionMutex.Unlock()
+	connection.Attempts++
+	if err != nil {
+		connection.Failures++
+		connection.LastError = err.Error()
+		return
+	}
+	connection.Node = node
+}
+
+// GetConnectionStats returns a snapshot of the connection stats.
+func GetConnectionStats() ConnectionStats {
+	connectionMutex.Lock()
+	defer connectionMutex.Unlock()
+	return connection
+}
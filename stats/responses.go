@@ -0,0 +1,18 @@
+package stats
+
+import "sync/atomic"
+
+var lateResponses int64
+
+// RecordLateResponse needs to be called each time we get a response
+// that doesn't match any pending request, normally because the
+// request already timed out or was canceled.
+func RecordLateResponse() {
+	atomic.AddInt64(&lateResponses, 1)
+}
+
+// CountLateResponses returns the number of responses that
+// didn't match any pending request.
+func CountLateResponses() int64 {
+	return atomic.LoadInt64(&lateResponses)
+}
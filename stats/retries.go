@@ -0,0 +1,32 @@
+package stats
+
+import "sync/atomic"
+
+// RetryStats holds the stats of the retried requests to fwd_host.
+type RetryStats struct {
+	// Number of requests retried at least once.
+	Requests int64 `json:"requests"`
+	// Total number of retries.
+	Retries int64 `json:"retries"`
+}
+
+var retriedRequests int64
+var forwardRetries int64
+
+// RecordForwardRetries needs to be called once the request to
+// fwd_host is done, with the number of times it was retried.
+func RecordForwardRetries(retries int) {
+	if retries <= 0 {
+		return
+	}
+	atomic.AddInt64(&retriedRequests, 1)
+	atomic.AddInt64(&forwardRetries, int64(retries))
+}
+
+// GetRetryStats returns a snapshot of the retry stats.
+func GetRetryStats() RetryStats {
+	return RetryStats{
+		Requests: atomic.LoadInt64(&retriedRequests),
+		Retries:  atomic.LoadInt64(&forwardRetries),
+	}
+}
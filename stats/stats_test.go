@@ -1 +1,51 @@
 package stats
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWorkerStats(t *testing.T) {
+	workers = map[int]*WorkerStats{}
+	RecordWorkerStart(1)
+	RecordWorkerStart(2)
+	assert.Equal(t, 2, CountInFlightRequests())
+	RecordWorkerDone(1)
+	workerStats := GetWorkerStats()
+	assert.Equal(t, 0, workerStats[1].InFlight)
+	assert.Equal(t, int64(1), workerStats[1].Processed)
+	assert.Equal(t, 1, workerStats[2].InFlight)
+	assert.Equal(t, 1, CountInFlightRequests())
+}
+
+func TestLateResponses(t *testing.T) {
+	before := CountLateResponses()
+	RecordLateResponse()
+	RecordLateResponse()
+	assert.Equal(t, before+2, CountLateResponses())
+}
+
+func TestConnectionStats(t *testing.T) {
+	connection = ConnectionStats{}
+	RecordConnectionAttempt("node1:5672", errors.New("connection refused"))
+	RecordConnectionAttempt("node2:5672", nil)
+	connectionStats := GetConnectionStats()
+	assert.Equal(t, int64(2), connectionStats.Attempts)
+	assert.Equal(t, int64(1), connectionStats.Failures)
+	assert.Equal(t, "connection refused", connectionStats.LastError)
+	assert.Equal(t, "node2:5672", connectionStats.Node)
+}
+
+func TestCompressionStats(t *testing.T) {
+	compression = CompressionStats{}
+	assert.Equal(t, 0.0, GetCompressionStats().Ratio)
+	RecordCompression(1000, 100)
+	RecordCompression(3000, 900)
+	compressionStats := GetCompressionStats()
+	assert.Equal(t, int64(2), compressionStats.Messages)
+	assert.Equal(t, int64(4000), compressionStats.OriginalBytes)
+	assert.Equal(t, int64(1000), compressionStats.CompressedBytes)
+	assert.Equal(t, 0.25, compressionStats.Ratio)
+}
@@ -0,0 +1,64 @@
+package stats
+
+import "sync"
+
+// WorkerStats holds the processing stats of a
+// single request worker.
+type WorkerStats struct {
+	InFlight  int   `json:"in_flight"`
+	Processed int64 `json:"processed"`
+}
+
+var workers = map[int]*WorkerStats{}
+var workersMutex sync.RWMutex
+
+// RecordWorkerStart needs to be called each time a worker
+// starts processing a new request.
+func RecordWorkerStart(worker int) {
+	workersMutex.Lock()
+	defer workersMutex.Unlock()
+	getOrCreateWorker(worker).InFlight++
+}
+
+// RecordWorkerDone needs to be called each time a worker
+// is done processing a request.
+func RecordWorkerDone(worker int) {
+	workersMutex.Lock()
+	defer workersMutex.Unlock()
+	stats := getOrCreateWorker(worker)
+	if stats.InFlight > 0 {
+		stats.InFlight--
+	}
+	stats.Processed++
+}
+
+// GetWorkerStats returns a snapshot of the stats of each worker.
+func GetWorkerStats() map[int]WorkerStats {
+	workersMutex.RLock()
+	defer workersMutex.RUnlock()
+	result := map[int]WorkerStats{}
+	for worker, stats := range workers {
+		result[worker] = *stats
+	}
+	return result
+}
+
+// CountInFlightRequests returns the total number of requests
+// being processed by all the workers at the moment.
+func CountInFlightRequests() (count int) {
+	workersMutex.RLock()
+	defer workersMutex.RUnlock()
+	for _, stats := range workers {
+		count += stats.InFlight
+	}
+	return count
+}
+
+func getOrCreateWorker(worker int) *WorkerStats {
+	stats, ok := workers[worker]
+	if !ok {
+		stats = &WorkerStats{}
+		workers[worker] = stats
+	}
+	return stats
+}